@@ -0,0 +1,441 @@
+// Package conformance checks the CPU against the reference yis simulator of CS:APP. A corpus
+// is a directory of .ys source files and .yo listings, each with a golden .out file holding
+// the output of yis for the program. Each program is run on the CPU with a tracer and its
+// final state is compared with the golden output; when they differ, the trace is used to find
+// the first instruction that produced a diverging value.
+package conformance
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"y86/model"
+	"y86/trace"
+)
+
+// Most instructions a program may execute, as in yis.
+const MaxSteps = 10000
+
+// Number of registers printed by yis, which has no register 0xf.
+const yisRegisters = 15
+
+// Opcode of the ALU instructions, the only instructions that set the condition codes.
+const opq = 6
+
+// The first line of the output of yis.
+var stoppedLine = regexp.MustCompile(`^Stopped in (\d+) steps at PC = 0x([0-9a-fA-F]+)\.\s+Status '(\w+)', CC Z=([01]) S=([01]) O=([01])$`)
+
+// A register that a program changed.
+type RegChange struct {
+	Name string // name such as %rax
+	Old  int64  // value before the program ran
+	New  int64  // value after the program stopped
+}
+
+// A quad of memory that a program changed.
+type MemChange struct {
+	Addr int   // address of the quad
+	Old  int64 // value before the program ran
+	New  int64 // value after the program stopped
+}
+
+// The final state of a program in the terms yis prints it.
+type Result struct {
+	Steps  int         // number of instructions executed, including the one that stopped the program
+	PC     int         // address of the instruction that stopped the program
+	Status string      // name of the status, such as HLT
+	CC     model.Flags // condition codes
+	Regs   []RegChange // changed registers in register order
+	Mem    []MemChange // changed quads in address order
+}
+
+// Format the result like yis.
+func (r *Result) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Stopped in %d steps at PC = %#x.  Status '%s', CC Z=%d S=%d O=%d\n",
+		r.Steps, r.PC, r.Status, boolToInt(r.CC.ZF), boolToInt(r.CC.SF), boolToInt(r.CC.OF))
+	b.WriteString("Changes to registers:\n")
+	for _, reg := range r.Regs {
+		fmt.Fprintf(&b, "%s:\t0x%016x\t0x%016x\n", reg.Name, uint64(reg.Old), uint64(reg.New))
+	}
+	b.WriteString("\nChanges to memory:\n")
+	for _, mem := range r.Mem {
+		fmt.Fprintf(&b, "0x%04x:\t0x%016x\t0x%016x\n", mem.Addr, uint64(mem.Old), uint64(mem.New))
+	}
+	return b.String()
+}
+
+// Parse the output of yis.
+func Parse(r io.Reader) (*Result, error) {
+	scanner := bufio.NewScanner(r)
+	result := &Result{}
+	section := ""
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		var err error
+
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "Stopped in"):
+			match := stoppedLine.FindStringSubmatch(line)
+			if match == nil {
+				err = fmt.Errorf("malformed %q", line)
+				break
+			}
+			steps, _ := strconv.Atoi(match[1])
+			pc, _ := strconv.ParseInt(match[2], 16, 64)
+			result.Steps, result.PC, result.Status = steps, int(pc), match[3]
+			result.CC = model.Flags{ZF: match[4] == "1", SF: match[5] == "1", OF: match[6] == "1"}
+		case line == "Changes to registers:" || line == "Changes to memory:":
+			section = line
+		case section == "Changes to registers:":
+			var reg RegChange
+			var old, new uint64
+			_, err = fmt.Sscanf(line, "%s\t%v\t%v", &reg.Name, &old, &new)
+			reg.Name = strings.TrimSuffix(reg.Name, ":")
+			reg.Old, reg.New = int64(old), int64(new)
+			result.Regs = append(result.Regs, reg)
+		case section == "Changes to memory:":
+			var mem MemChange
+			var old, new uint64
+			_, err = fmt.Sscanf(line, "%v:\t%v\t%v", &mem.Addr, &old, &new)
+			mem.Old, mem.New = int64(old), int64(new)
+			result.Mem = append(result.Mem, mem)
+		default:
+			err = fmt.Errorf("unexpected %q", line)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if result.Status == "" {
+		return nil, fmt.Errorf("missing the Stopped in line")
+	}
+	return result, nil
+}
+
+// Run a program on the CPU for at most MaxSteps instructions and return its final state and
+// trace. The program is a .yo listing if the name ends in .yo and source code otherwise.
+func Run(name string, program []byte) (*Result, []trace.Record, error) {
+	cpu := &model.CPU{}
+	if strings.EqualFold(filepath.Ext(name), ".yo") {
+		if err := model.LoadListing(bytes.NewReader(program), cpu); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		assembler := model.NewAssembler(string(program))
+		assembler.SetFilename(name)
+		if err := assembler.Assemble(); err != nil {
+			return nil, nil, err
+		}
+		if err := assembler.Load(cpu); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	before := memPages(cpu)
+	var regsBefore [yisRegisters + 1]int64
+	for i := range regsBefore {
+		regsBefore[i] = cpu.Reg(byte(i))
+	}
+
+	var records recorder
+	cpu.SetTracer(&records)
+	for steps := 0; steps < MaxSteps && cpu.Status() == model.StatusAOK; steps++ {
+		cpu.Tick()
+	}
+
+	result := &Result{
+		Steps:  len(records),
+		PC:     cpu.PC(),
+		Status: model.StatusName(cpu.Status()),
+		CC:     cpu.Flags(),
+	}
+
+	for i, old := range regsBefore {
+		// register 0xf isn't a yis register, so it's only reported if machine code writes it
+		if val := cpu.Reg(byte(i)); val != old {
+			result.Regs = append(result.Regs, RegChange{model.RegisterName(byte(i)), old, val})
+		}
+	}
+
+	result.Mem = memChanges(before, memPages(cpu))
+	return result, records, nil
+}
+
+// Return the pages of memory of the CPU that have been written by address, so that large
+// memories can be compared without copying them.
+func memPages(cpu *model.CPU) map[int][]byte {
+	pages := make(map[int][]byte)
+	for _, p := range cpu.MemPages() {
+		pages[p.Addr] = p.Data
+	}
+	return pages
+}
+
+// Return the quads that differ between two sets of pages, in order of address. A page that is
+// missing from one of the sets holds zeros.
+func memChanges(before map[int][]byte, after map[int][]byte) []MemChange {
+	var addrs []int
+	for addr := range before {
+		addrs = append(addrs, addr)
+	}
+	for addr := range after {
+		if _, ok := before[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Ints(addrs)
+
+	var changes []MemChange
+	for _, addr := range addrs {
+		old, new := before[addr], after[addr]
+		if old == nil {
+			old = make([]byte, len(new))
+		}
+		if new == nil {
+			new = make([]byte, len(old))
+		}
+		for offset := 0; offset+8 <= len(new); offset += 8 {
+			if !bytes.Equal(old[offset:offset+8], new[offset:offset+8]) {
+				changes = append(changes, MemChange{addr + offset, quad(old[offset:]), quad(new[offset:])})
+			}
+		}
+	}
+	return changes
+}
+
+// The differences between the golden output of a program and its result on the CPU.
+type Divergence struct {
+	Program string        // name of the program
+	Diffs   []string      // description of each difference
+	First   *trace.Record // first instruction that produced a diverging value, nil if unknown
+}
+
+func (d *Divergence) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d differences from yis\n", d.Program, len(d.Diffs))
+	for _, diff := range d.Diffs {
+		fmt.Fprintf(&b, "  %s\n", diff)
+	}
+	if d.First != nil {
+		fmt.Fprintf(&b, "  first diverging instruction: step %d at %#x: %s\n", d.First.Cycle, d.First.PC, d.First.Inst)
+	}
+	return b.String()
+}
+
+// Compare the result of a program with its golden output. Returns nil if they are the same.
+// The first diverging instruction is the earliest one in the trace that wrote the final value
+// of a diverging register or memory quad, set diverging condition codes, or stopped the
+// program with the wrong status.
+func Compare(program string, expected *Result, actual *Result, records []trace.Record) *Divergence {
+	d := &Divergence{Program: program}
+	first := len(records)
+	suspect := func(i int) {
+		if i >= 0 && i < first {
+			first = i
+		}
+	}
+
+	if expected.Steps != actual.Steps {
+		d.Diffs = append(d.Diffs, fmt.Sprintf("steps: expected %d, got %d", expected.Steps, actual.Steps))
+	}
+	if expected.PC != actual.PC {
+		d.Diffs = append(d.Diffs, fmt.Sprintf("PC: expected %#x, got %#x", expected.PC, actual.PC))
+	}
+	if expected.Status != actual.Status {
+		d.Diffs = append(d.Diffs, fmt.Sprintf("status: expected %s, got %s", expected.Status, actual.Status))
+		suspect(len(records) - 1)
+	}
+	if expected.CC != actual.CC {
+		d.Diffs = append(d.Diffs, fmt.Sprintf("CC: expected %s, got %s", formatCC(expected.CC), formatCC(actual.CC)))
+		suspect(lastWrite(records, func(rec *trace.Record) bool {
+			return rec.Icode == opq
+		}))
+	}
+
+	expectedRegs, actualRegs := regValues(expected.Regs), regValues(actual.Regs)
+	for _, name := range sortedRegs(expectedRegs, actualRegs) {
+		want, got := expectedRegs[name], actualRegs[name]
+		if want == got {
+			continue
+		}
+		d.Diffs = append(d.Diffs, fmt.Sprintf("%s: expected %#x, got %#x", name, uint64(want), uint64(got)))
+		index, _ := model.RegisterIndex(name)
+		suspect(lastWrite(records, func(rec *trace.Record) bool {
+			for _, reg := range rec.Regs {
+				if reg.Reg == index {
+					return true
+				}
+			}
+			return false
+		}))
+	}
+
+	expectedMem, actualMem := memValues(expected.Mem), memValues(actual.Mem)
+	for _, addr := range sortedAddrs(expectedMem, actualMem) {
+		want, got := expectedMem[addr], actualMem[addr]
+		if want == got {
+			continue
+		}
+		d.Diffs = append(d.Diffs, fmt.Sprintf("memory %#04x: expected %#x, got %#x", addr, uint64(want), uint64(got)))
+		suspect(lastWrite(records, func(rec *trace.Record) bool {
+			for _, mem := range rec.Mem {
+				if int(mem.Addr) < addr+8 && int(mem.Addr)+8 > addr {
+					return true
+				}
+			}
+			return false
+		}))
+	}
+
+	if len(d.Diffs) == 0 {
+		return nil
+	}
+	if first < len(records) {
+		d.First = &records[first]
+	}
+	return d
+}
+
+// Run a program and compare it with its golden output. Returns nil if they are the same.
+func Check(program string, golden string) (*Divergence, error) {
+	source, err := os.ReadFile(program)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(golden)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	expected, err := Parse(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", golden, err)
+	}
+	actual, records, err := Run(program, source)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", program, err)
+	}
+	return Compare(filepath.Base(program), expected, actual, records), nil
+}
+
+// Return the .ys and .yo programs of a corpus that have a golden .out file, sorted by name.
+func Corpus(dir string) ([]string, error) {
+	var programs []string
+	for _, pattern := range []string{"*.ys", "*.yo"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		for _, program := range matches {
+			if _, err := os.Stat(GoldenFile(program)); err == nil {
+				programs = append(programs, program)
+			}
+		}
+	}
+	sort.Strings(programs)
+	return programs, nil
+}
+
+// Return the name of the golden output of a program.
+func GoldenFile(program string) string {
+	return strings.TrimSuffix(program, filepath.Ext(program)) + ".out"
+}
+
+// Return the index of the last record that matches, or -1.
+func lastWrite(records []trace.Record, match func(rec *trace.Record) bool) int {
+	for i := len(records) - 1; i >= 0; i-- {
+		if match(&records[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+func regValues(changes []RegChange) map[string]int64 {
+	values := make(map[string]int64)
+	for _, reg := range changes {
+		values[reg.Name] = reg.New
+	}
+	return values
+}
+
+func memValues(changes []MemChange) map[int]int64 {
+	values := make(map[int]int64)
+	for _, mem := range changes {
+		values[mem.Addr] = mem.New
+	}
+	return values
+}
+
+// Return the names of the registers in either map in register order.
+func sortedRegs(a map[string]int64, b map[string]int64) []string {
+	var names []string
+	for i := 0; i <= yisRegisters; i++ {
+		name := model.RegisterName(byte(i))
+		_, inA := a[name]
+		_, inB := b[name]
+		if inA || inB {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Return the addresses in either map in order.
+func sortedAddrs(a map[int]int64, b map[int]int64) []int {
+	var addrs []int
+	for addr := range a {
+		addrs = append(addrs, addr)
+	}
+	for addr := range b {
+		if _, ok := a[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Ints(addrs)
+	return addrs
+}
+
+// Collects the trace of a program.
+type recorder []trace.Record
+
+func (r *recorder) Trace(rec *trace.Record) {
+	*r = append(*r, *rec)
+}
+
+func formatCC(cc model.Flags) string {
+	return fmt.Sprintf("Z=%d S=%d O=%d", boolToInt(cc.ZF), boolToInt(cc.SF), boolToInt(cc.OF))
+}
+
+// Return the little endian quad at the start of a byte slice.
+func quad(b []byte) int64 {
+	var val int64
+	for i := 7; i >= 0; i-- {
+		val = val<<8 | int64(b[i])
+	}
+	return val
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
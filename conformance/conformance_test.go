@@ -0,0 +1,88 @@
+package conformance
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Programs that are known to diverge from yis, with the instruction the harness is expected to
+// blame if it can tell. Remove a program from the list once the CPU is fixed.
+var knownDivergences = map[string]string{}
+
+func TestCorpus(t *testing.T) {
+	programs, err := Corpus("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(programs) < 6 {
+		t.Fatalf("expected at least 6 programs in the corpus but got %d", len(programs))
+	}
+
+	for _, program := range programs {
+		name := filepath.Base(program)
+		d, err := Check(program, GoldenFile(program))
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		blamed, known := knownDivergences[name]
+		switch {
+		case d == nil && known:
+			t.Errorf("%s matches yis, remove it from the known divergences", name)
+		case d != nil && !known:
+			t.Errorf("%s", d)
+		case d != nil && blamed != "" && (d.First == nil || d.First.Inst != blamed):
+			t.Errorf("expected %q to be the first diverging instruction:\n%s", blamed, d)
+		}
+	}
+}
+
+func TestParseFormatsLikeYis(t *testing.T) {
+	programs, err := Corpus("testdata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, program := range programs {
+		golden, err := os.ReadFile(GoldenFile(program))
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := Parse(strings.NewReader(string(golden)))
+		if err != nil {
+			t.Fatalf("%s: %v", program, err)
+		}
+		if result.String() != string(golden) {
+			t.Errorf("expected\n%s\nbut got\n%s", golden, result)
+		}
+	}
+}
+
+func TestCompareFindsFirstDivergence(t *testing.T) {
+	source := "\tirmovq $1, %rax\n\tirmovq $2, %rbx\n\tirmovq $3, %rax\n\thalt\n"
+	actual, records, err := Run("test.ys", []byte(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := *actual
+	expected.Regs = []RegChange{{"%rax", 0, 3}, {"%rbx", 0, 5}}
+	d := Compare("test.ys", &expected, actual, records)
+	if d == nil || len(d.Diffs) != 1 || d.First == nil || d.First.PC != 0xa {
+		t.Errorf("expected %%rbx to diverge at 0xa but got %v", d)
+	}
+
+	if d := Compare("test.ys", actual, actual, records); d != nil {
+		t.Errorf("expected no divergence but got %v", d)
+	}
+}
+
+func TestParseMalformed(t *testing.T) {
+	for _, output := range []string{"", "Stopped in many steps", "Stopped in 1 steps at PC = 0x0.  Status 'HLT', CC Z=1 S=0 O=0\nbogus\n"} {
+		if _, err := Parse(strings.NewReader(output)); err == nil {
+			t.Errorf("expected an error for %q", output)
+		}
+	}
+}
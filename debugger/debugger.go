@@ -0,0 +1,685 @@
+// Package debugger implements an interactive step debugger for the y86 CPU. The debugger
+// reads commands from a reader, one per line, and writes its output to a writer, so it can
+// be driven by a terminal or by a script.
+package debugger
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"y86/model"
+)
+
+const aok = model.StatusAOK
+const wch = model.StatusWCH
+
+const defaultCount = 4       // number of quads printed by the x command
+const maxInstSize = 10       // size of the longest instruction
+const defaultHistory = 10000 // number of instructions that can be undone
+
+// Debugs a program loaded into a processor.
+type Debugger struct {
+	cpu         model.Processor
+	labels      map[int][]string // labels by address
+	symbols     map[string]int   // addresses by label
+	breakpoints map[int]bool     // addresses to stop at
+	out         io.Writer        // where the output of the commands is written
+	last        string           // the last command, repeated by an empty line
+}
+
+// Create a debugger for a processor that has a program loaded. Labels maps addresses to the
+// labels of the program and may be nil. If the processor can execute backwards and its history
+// is disabled, the last 10000 instructions are kept.
+func New(cpu model.Processor, labels map[int][]string, out io.Writer) *Debugger {
+	d := &Debugger{
+		cpu:         cpu,
+		labels:      labels,
+		symbols:     make(map[string]int),
+		breakpoints: make(map[int]bool),
+		out:         out,
+	}
+	for addr, names := range labels {
+		for _, name := range names {
+			d.symbols[name] = addr
+		}
+	}
+	if rewinder, ok := cpu.(model.Rewinder); ok && rewinder.HistorySize() == 0 {
+		rewinder.SetHistory(defaultHistory)
+	}
+	return d
+}
+
+// Add a breakpoint at an address.
+func (d *Debugger) AddBreakpoint(addr int) {
+	d.breakpoints[addr] = true
+}
+
+// Remove the breakpoint at an address. Returns false if there was no breakpoint.
+func (d *Debugger) RemoveBreakpoint(addr int) bool {
+	if !d.breakpoints[addr] {
+		return false
+	}
+	delete(d.breakpoints, addr)
+	return true
+}
+
+// Execute a single instruction and return the status. Execution continues past a watchpoint
+// that stopped the previous instruction.
+func (d *Debugger) Step() byte {
+	if watcher, ok := d.cpu.(model.Watcher); ok && d.cpu.Status() == wch {
+		watcher.Resume()
+	}
+	if status := d.cpu.Status(); status != aok {
+		return status
+	}
+	return d.cpu.Tick()
+}
+
+// Execute a single instruction. If the instruction is a call, keep executing until the
+// function returns, a breakpoint is hit or the CPU stops.
+func (d *Debugger) Next() byte {
+	inst := model.InstructionAt(d.cpu, d.cpu.PC(), nil)
+	if inst.Mnemonic != "call" {
+		return d.Step()
+	}
+
+	rsp, _ := model.RegisterIndex("%rsp")
+	ret := d.cpu.PC() + len(inst.Bytes)
+	sp := d.cpu.Reg(rsp)
+	status := d.Step()
+
+	// the stack pointer check makes recursive calls return to the right frame
+	for status == aok && !(d.cpu.PC() == ret && d.cpu.Reg(rsp) >= sp) && !d.breakpoints[d.cpu.PC()] {
+		status = d.Step()
+	}
+	return status
+}
+
+// Keep executing until a breakpoint is hit or the CPU stops. The instruction at the program
+// counter is always executed, so continuing from a breakpoint moves past it.
+func (d *Debugger) Continue() byte {
+	status := d.Step()
+	for status == aok && !d.breakpoints[d.cpu.PC()] {
+		status = d.Step()
+	}
+	return status
+}
+
+// Keep executing until the program counter reaches an address, a breakpoint is hit or the CPU stops.
+func (d *Debugger) RunTo(addr int) byte {
+	status := d.Step()
+	for status == aok && d.cpu.PC() != addr && !d.breakpoints[d.cpu.PC()] {
+		status = d.Step()
+	}
+	return status
+}
+
+// Undo the last instruction. Returns false if the processor can't execute backwards or there's
+// no history left.
+func (d *Debugger) ReverseStep() bool {
+	rewinder, ok := d.cpu.(model.Rewinder)
+	return ok && rewinder.StepBack()
+}
+
+// Keep executing backwards until a breakpoint is reached, an instruction that hits a
+// watchpoint is undone, or the history runs out. Returns false if the history ran out.
+func (d *Debugger) ReverseContinue() bool {
+	if !d.ReverseStep() {
+		return false
+	}
+	for !d.breakpoints[d.cpu.PC()] && len(d.watchHits()) == 0 {
+		if !d.ReverseStep() {
+			return false
+		}
+	}
+	return true
+}
+
+// Read commands until the input ends or the quit command is given.
+func (d *Debugger) Run(in io.Reader) error {
+	scanner := bufio.NewScanner(in)
+	d.printf("y86 debugger, type help for a list of commands\n")
+	d.printCurrent()
+
+	for {
+		d.printf("(y86) ")
+		if !scanner.Scan() {
+			d.printf("\n")
+			return scanner.Err()
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			line = d.last
+		}
+		d.last = line
+
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "q" || args[0] == "quit" {
+			return nil
+		}
+		if err := d.execute(args[0], args[1:]); err != nil {
+			d.printf("error: %v\n", err)
+		}
+	}
+}
+
+const help = `commands:
+  s, step [n]            execute n instructions (default 1)
+  n, next                execute an instruction, stepping over calls
+  c, continue            execute until a breakpoint is hit or the program stops
+  u, until <loc>         execute until the program counter reaches a location
+  rs, reverse-step [n]   undo n instructions (default 1)
+  rc, reverse-continue   execute backwards until a breakpoint or watchpoint is hit
+  goto <cycle>           go backwards or forwards to a cycle
+  history [n]            print the cycles that can be returned to, or keep the last n
+  b, break <loc>         add a breakpoint
+  d, delete <loc>        remove a breakpoint
+  breakpoints            list the breakpoints
+  w, watch <reg> [== val]
+                         stop when a register changes, optionally to a value
+  w, watch <loc> [n] [r|w|rw] [== val]
+                         stop when a quad or n bytes of memory are written (default),
+                         read, or both, optionally only when the new value is val
+  unwatch <id>           remove a watchpoint
+  watches                list the watchpoints
+  r, regs                print the registers
+  cc                     print the condition codes and status
+  x <loc> [n]            print n quads of memory starting at a location (default 4)
+  l, list [n]            disassemble n instructions from the program counter (default 1)
+  set <reg> <val>        set a register, e.g. set %rax 5
+  set pc <loc>           set the program counter
+  set zf|sf|of <0|1>     set a condition code
+  set mem <loc> <val>    write a quad to memory
+  q, quit                exit the debugger
+a location is an address such as 0x100 or a label. An empty line repeats the last command.
+`
+
+// Execute a command.
+func (d *Debugger) execute(cmd string, args []string) error {
+	switch cmd {
+	case "h", "help":
+		d.printf("%s", help)
+	case "s", "step":
+		n, err := parseCount(args, 1)
+		if err != nil {
+			return err
+		}
+		status := byte(aok)
+		for i := 0; i < n && status == aok; i++ {
+			status = d.Step()
+		}
+		d.stopped(status)
+	case "n", "next":
+		d.stopped(d.Next())
+	case "c", "continue":
+		d.stopped(d.Continue())
+	case "u", "until":
+		addr, err := d.location(args)
+		if err != nil {
+			return err
+		}
+		d.stopped(d.RunTo(addr))
+	case "rs", "reverse-step":
+		n, err := parseCount(args, 1)
+		if err != nil {
+			return err
+		}
+		if _, err := d.rewinder(); err != nil {
+			return err
+		}
+		ok := d.ReverseStep()
+		for i := 1; i < n && ok && len(d.watchHits()) == 0; i++ {
+			ok = d.ReverseStep()
+		}
+		d.reversed(ok)
+	case "rc", "reverse-continue":
+		if _, err := d.rewinder(); err != nil {
+			return err
+		}
+		d.reversed(d.ReverseContinue())
+	case "goto":
+		rewinder, err := d.rewinder()
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("usage: goto <cycle>")
+		}
+		cycle, err := strconv.Atoi(args[0])
+		if err != nil || cycle < 0 {
+			return fmt.Errorf("invalid cycle %s", args[0])
+		}
+		err = rewinder.GoToCycle(cycle)
+		d.printCurrent()
+		return err
+	case "history":
+		return d.history(args)
+	case "b", "break":
+		addr, err := d.location(args)
+		if err != nil {
+			return err
+		}
+		d.AddBreakpoint(addr)
+		d.printf("breakpoint at %s\n", d.describe(addr))
+	case "d", "delete":
+		addr, err := d.location(args)
+		if err != nil {
+			return err
+		}
+		if !d.RemoveBreakpoint(addr) {
+			return fmt.Errorf("no breakpoint at %s", d.describe(addr))
+		}
+	case "breakpoints":
+		d.printBreakpoints()
+	case "w", "watch":
+		return d.addWatch(args)
+	case "unwatch":
+		id, err := parseCount(args, 0)
+		if err != nil || id == 0 {
+			return fmt.Errorf("usage: unwatch <id>")
+		}
+		watcher, err := d.watcher()
+		if err != nil {
+			return err
+		}
+		if !watcher.RemoveWatch(id) {
+			return fmt.Errorf("no watchpoint %d", id)
+		}
+	case "watches":
+		d.printWatches()
+	case "r", "regs":
+		d.printRegisters()
+	case "cc":
+		d.printFlags()
+	case "x":
+		return d.examine(args)
+	case "l", "list":
+		n, err := parseCount(args, 1)
+		if err != nil {
+			return err
+		}
+		d.list(n)
+	case "set":
+		return d.set(args)
+	default:
+		return fmt.Errorf("unknown command %s, type help for a list of commands", cmd)
+	}
+	return nil
+}
+
+// Report why execution stopped and print the next instruction.
+func (d *Debugger) stopped(status byte) {
+	if watcher, ok := d.cpu.(model.Watcher); ok && status == wch {
+		for _, hit := range watcher.WatchHits() {
+			d.printf("%v\n", hit)
+		}
+	} else if status != aok {
+		d.printf("program stopped with status %s\n", model.StatusName(status))
+	} else if d.breakpoints[d.cpu.PC()] {
+		d.printf("breakpoint at %s\n", d.describe(d.cpu.PC()))
+	}
+	d.printCurrent()
+}
+
+// Report why execution backwards stopped and print the next instruction. Ok is false if the
+// history ran out.
+func (d *Debugger) reversed(ok bool) {
+	if hits := d.watchHits(); len(hits) > 0 {
+		for _, hit := range hits {
+			d.printf("%v\n", hit)
+		}
+	} else if !ok {
+		first, _ := d.cpu.(model.Rewinder).History()
+		d.printf("reached the start of the history at cycle %d\n", first)
+	} else if d.breakpoints[d.cpu.PC()] {
+		d.printf("breakpoint at %s\n", d.describe(d.cpu.PC()))
+	}
+	d.printCurrent()
+}
+
+// Print the instruction at the program counter.
+func (d *Debugger) printCurrent() {
+	inst := model.InstructionAt(d.cpu, d.cpu.PC(), d.labels)
+	d.printf("=> %s\n", d.formatInst(inst))
+}
+
+// Format a disassembled instruction with its address and labels.
+func (d *Debugger) formatInst(inst model.DisasmLine) string {
+	text := inst.Text
+	if !inst.Valid {
+		text += "  # invalid instruction"
+	}
+	return fmt.Sprintf("%s: %s", d.describe(inst.Address), text)
+}
+
+// Disassemble instructions starting at the program counter.
+func (d *Debugger) list(n int) {
+	end := d.cpu.PC() + n*maxInstSize
+	if end > d.cpu.MemorySize() {
+		end = d.cpu.MemorySize()
+	}
+	lines, err := model.DisassembleMem(d.cpu, d.cpu.PC(), end, d.labels)
+	if err != nil {
+		d.printf("error: %v\n", err)
+		return
+	}
+	for i := 0; i < n && i < len(lines); i++ {
+		d.printf("   %s\n", d.formatInst(lines[i]))
+	}
+}
+
+// Describe an address with the label defined at it, if any.
+func (d *Debugger) describe(addr int) string {
+	if names, ok := d.labels[addr]; ok {
+		return fmt.Sprintf("%#x <%s>", addr, names[0])
+	}
+	return fmt.Sprintf("%#x", addr)
+}
+
+func (d *Debugger) printRegisters() {
+	for i := byte(0); i < 15; i++ {
+		val := d.cpu.Reg(i)
+		d.printf("%-5s %#-18x %d\n", model.RegisterName(i), uint64(val), val)
+	}
+	d.printf("%-5s %s\n", "pc", d.describe(d.cpu.PC()))
+}
+
+func (d *Debugger) printFlags() {
+	flags := d.cpu.Flags()
+	d.printf("ZF=%d SF=%d OF=%d status %s\n", boolToInt(flags.ZF), boolToInt(flags.SF), boolToInt(flags.OF),
+		model.StatusName(d.cpu.Status()))
+}
+
+func (d *Debugger) printBreakpoints() {
+	addrs := make([]int, 0, len(d.breakpoints))
+	for addr := range d.breakpoints {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+
+	if len(addrs) == 0 {
+		d.printf("no breakpoints\n")
+	}
+	for _, addr := range addrs {
+		d.printf("%s\n", d.describe(addr))
+	}
+}
+
+// Return the processor as a Watcher, or an error if it doesn't support watchpoints.
+func (d *Debugger) watcher() (model.Watcher, error) {
+	if watcher, ok := d.cpu.(model.Watcher); ok {
+		return watcher, nil
+	}
+	return nil, fmt.Errorf("this processor doesn't support watchpoints")
+}
+
+// Return the watchpoints hit by the last instruction executed or undone.
+func (d *Debugger) watchHits() []model.WatchHit {
+	if watcher, ok := d.cpu.(model.Watcher); ok {
+		return watcher.WatchHits()
+	}
+	return nil
+}
+
+// Return the processor as a Rewinder, or an error if it can't execute backwards.
+func (d *Debugger) rewinder() (model.Rewinder, error) {
+	if rewinder, ok := d.cpu.(model.Rewinder); ok {
+		return rewinder, nil
+	}
+	return nil, fmt.Errorf("this processor can't execute backwards")
+}
+
+// Print the range of cycles in the history, or change the history size.
+func (d *Debugger) history(args []string) error {
+	rewinder, err := d.rewinder()
+	if err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		size, err := parseCount(args, 0)
+		if err != nil {
+			return err
+		}
+		rewinder.SetHistory(size)
+	}
+	first, last := rewinder.History()
+	d.printf("cycles %d to %d, at most %d instructions kept\n", first, last, rewinder.HistorySize())
+	return nil
+}
+
+// Add a watchpoint on a register or on memory.
+func (d *Debugger) addWatch(args []string) error {
+	watcher, err := d.watcher()
+	if err != nil {
+		return err
+	}
+
+	w := model.Watchpoint{Kind: model.WatchWrite, Size: 8}
+	if n := len(args); n >= 2 && args[n-2] == "==" {
+		val, err := parseValue(args[n-1])
+		if err != nil {
+			return err
+		}
+		w.Cond, w.Value = true, val
+		args = args[:n-2]
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("expected a register or a location")
+	}
+
+	if index, ok := model.RegisterIndex(args[0]); ok {
+		if len(args) > 1 {
+			return fmt.Errorf("unexpected %s", args[1])
+		}
+		w.Kind, w.Reg = model.WatchReg, index
+	} else {
+		addr, err := d.location(args[:1])
+		if err != nil {
+			return err
+		}
+		w.Addr = addr
+		for _, arg := range args[1:] {
+			switch arg {
+			case "r":
+				w.Kind = model.WatchRead
+			case "w":
+				w.Kind = model.WatchWrite
+			case "rw":
+				w.Kind = model.WatchAccess
+			default:
+				if w.Size, err = parseCount([]string{arg}, 0); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	id, err := watcher.AddWatch(w)
+	if err != nil {
+		return err
+	}
+	w.ID = id
+	d.printf("%s\n", d.describeWatch(w))
+	return nil
+}
+
+// Describe a watchpoint.
+func (d *Debugger) describeWatch(w model.Watchpoint) string {
+	var text string
+	switch w.Kind {
+	case model.WatchReg:
+		text = fmt.Sprintf("watchpoint %d: %s", w.ID, model.RegisterName(w.Reg))
+	default:
+		access := map[model.WatchKind]string{model.WatchRead: "r", model.WatchWrite: "w", model.WatchAccess: "rw"}[w.Kind]
+		text = fmt.Sprintf("watchpoint %d: %s %d bytes %s", w.ID, d.describe(w.Addr), w.Size, access)
+	}
+	if w.Cond {
+		text += fmt.Sprintf(" == %d", w.Value)
+	}
+	return text
+}
+
+func (d *Debugger) printWatches() {
+	var watches []model.Watchpoint
+	if watcher, ok := d.cpu.(model.Watcher); ok {
+		watches = watcher.Watches()
+	}
+	if len(watches) == 0 {
+		d.printf("no watchpoints\n")
+	}
+	for _, w := range watches {
+		d.printf("%s\n", d.describeWatch(w))
+	}
+}
+
+// Print quads of memory.
+func (d *Debugger) examine(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("expected a location")
+	}
+	addr, err := d.location(args[:1])
+	if err != nil {
+		return err
+	}
+	n, err := parseCount(args[1:], defaultCount)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < n; i++ {
+		bytes, err := d.cpu.ReadMem(addr+8*i, 8)
+		if err != nil {
+			return err
+		}
+		var val int64
+		for j := 7; j >= 0; j-- {
+			val = val<<8 | int64(bytes[j])
+		}
+		d.printf("%s: %#-18x %d\n", d.describe(addr+8*i), uint64(val), val)
+	}
+	return nil
+}
+
+// Modify a register, the program counter, a condition code or memory.
+func (d *Debugger) set(args []string) error {
+	if len(args) < 2 {
+		return fmt.Errorf("usage: set <reg|pc|zf|sf|of|mem> ...")
+	}
+	target := strings.ToLower(args[0])
+
+	switch target {
+	case "pc":
+		addr, err := d.location(args[1:])
+		if err != nil {
+			return err
+		}
+		d.cpu.SetPC(addr)
+		d.printCurrent()
+		return nil
+	case "zf", "sf", "of":
+		val, err := strconv.ParseBool(args[1])
+		if err != nil {
+			return fmt.Errorf("expected 0 or 1, got %s", args[1])
+		}
+		flags := d.cpu.Flags()
+		switch target {
+		case "zf":
+			flags.ZF = val
+		case "sf":
+			flags.SF = val
+		case "of":
+			flags.OF = val
+		}
+		d.cpu.SetFlags(flags)
+		return nil
+	case "mem":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: set mem <loc> <val>")
+		}
+		addr, err := d.location(args[1:2])
+		if err != nil {
+			return err
+		}
+		val, err := parseValue(args[2])
+		if err != nil {
+			return err
+		}
+		bytes := make([]byte, 8)
+		for i := range bytes {
+			bytes[i] = byte(val >> (8 * i))
+		}
+		return d.cpu.WriteMem(addr, bytes)
+	}
+
+	name := target
+	if !strings.HasPrefix(name, "%") {
+		name = "%" + name
+	}
+	index, ok := model.RegisterIndex(name)
+	if !ok {
+		return fmt.Errorf("unknown register %s", args[0])
+	}
+	val, err := parseValue(args[1])
+	if err != nil {
+		return err
+	}
+	return d.cpu.SetReg(index, val)
+}
+
+// Return the address of a location given as the first argument. A location is either a
+// number or a label.
+func (d *Debugger) location(args []string) (int, error) {
+	if len(args) == 0 {
+		return 0, fmt.Errorf("expected a location")
+	}
+	if addr, ok := d.symbols[args[0]]; ok {
+		return addr, nil
+	}
+	addr, err := strconv.ParseInt(args[0], 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("unknown location %s", args[0])
+	}
+	return int(addr), nil
+}
+
+// Parse a signed or unsigned 64-bit value.
+func parseValue(s string) (int64, error) {
+	if val, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return val, nil
+	}
+	val, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %s", s)
+	}
+	return int64(val), nil
+}
+
+// Parse an optional positive count.
+func parseCount(args []string, def int) (int, error) {
+	if len(args) == 0 {
+		return def, nil
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid count %s", args[0])
+	}
+	return n, nil
+}
+
+func (d *Debugger) printf(format string, args ...interface{}) {
+	fmt.Fprintf(d.out, format, args...)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
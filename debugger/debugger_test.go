@@ -0,0 +1,219 @@
+package debugger
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"y86/model"
+)
+
+const source = `	.pos 0
+	irmovq stack, %rsp
+	call main
+	halt
+main:	irmovq $3, %rdi
+	call count
+	ret
+count:	irmovq $1, %rsi
+loop:	subq %rsi, %rdi
+	jne loop
+	ret
+	.pos 0x200
+stack:
+`
+
+// Assemble the test program, load it into a CPU and create a debugger for it.
+func newDebugger(t *testing.T, out *bytes.Buffer) (*Debugger, *model.CPU) {
+	assembler := model.NewAssembler(source)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	cpu := &model.CPU{}
+	if err := assembler.Load(cpu); err != nil {
+		t.Fatal(err)
+	}
+	return New(cpu, model.SymbolsByAddress(assembler.Object()), out), cpu
+}
+
+func TestNextStepsOverCalls(t *testing.T) {
+	d, cpu := newDebugger(t, &bytes.Buffer{})
+	d.Step()
+	if status := d.Next(); status != model.StatusAOK || cpu.PC() != 0x13 {
+		t.Errorf("expected to stop after the call at 0x13 but got %#x with status %d\n", cpu.PC(), status)
+	}
+	if rdi := cpu.Reg(7); rdi != 0 {
+		t.Errorf("expected the called function to run but %%rdi is %d\n", rdi)
+	}
+}
+
+func TestContinueStopsAtBreakpoints(t *testing.T) {
+	d, cpu := newDebugger(t, &bytes.Buffer{})
+	d.AddBreakpoint(d.symbols["loop"])
+
+	for i := 3; i > 0; i-- {
+		if status := d.Continue(); status != model.StatusAOK || cpu.PC() != d.symbols["loop"] {
+			t.Fatalf("expected to stop at loop but got %#x with status %d\n", cpu.PC(), status)
+		}
+		if rdi := cpu.Reg(7); rdi != int64(i) {
+			t.Errorf("expected %%rdi to be %d but got %d\n", i, rdi)
+		}
+	}
+
+	d.RemoveBreakpoint(d.symbols["loop"])
+	if status := d.Continue(); status != model.StatusHLT {
+		t.Errorf("expected the program to halt but got status %d\n", status)
+	}
+}
+
+func TestRunTo(t *testing.T) {
+	d, cpu := newDebugger(t, &bytes.Buffer{})
+	if d.RunTo(d.symbols["count"]); cpu.PC() != d.symbols["count"] {
+		t.Errorf("expected to stop at count but got %#x\n", cpu.PC())
+	}
+}
+
+func TestCommands(t *testing.T) {
+	var out bytes.Buffer
+	d, cpu := newDebugger(t, &out)
+
+	script := strings.Join([]string{
+		"break count",
+		"continue",
+		"set %rdi 1",
+		"set %r15 1",
+		"set zf 1",
+		"set mem 0x100 -1",
+		"x 0x100 1",
+		"step",
+		"",
+		"cc",
+		"bogus",
+		"quit",
+	}, "\n")
+	if err := d.Run(strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"breakpoint at 0x28 <count>\n=> 0x28 <count>: irmovq $1, %rsi",
+		"0x100: 0xffffffffffffffff -1",
+		"=> 0x32 <loop>: subq %rsi, %rdi",
+		"=> 0x34: jne loop",
+		"ZF=1 SF=0 OF=0 status AOK",
+		"error: unknown register %r15",
+		"error: unknown command bogus",
+	}
+	for _, s := range expected {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("expected the output to contain %q:\n%s", s, out.String())
+		}
+	}
+	if rdi := cpu.Reg(7); rdi != 0 {
+		t.Errorf("expected %%rdi to be 0 but got %d\n", rdi)
+	}
+}
+
+func TestWatchCommands(t *testing.T) {
+	var out bytes.Buffer
+	d, cpu := newDebugger(t, &out)
+
+	script := strings.Join([]string{
+		"watch %rdi == 1",
+		"watch 0x1f8",
+		"watches",
+		"continue",
+		"continue",
+		"unwatch 2",
+		"unwatch 3",
+		"quit",
+	}, "\n")
+	if err := d.Run(strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"watchpoint 1: %rdi == 1\nwatchpoint 2: 0x1f8 8 bytes w",
+		"watchpoint 2: 0x1f8 written by instruction at 0xa: 0x0 -> 0x13",
+		"watchpoint 1: %rdi changed by instruction at 0x32: 0x2 -> 0x1\n=> 0x34: jne loop",
+		"error: no watchpoint 3",
+	}
+	if watches := cpu.Watches(); len(watches) != 1 || watches[0].ID != 1 {
+		t.Errorf("expected only watchpoint 1 to be left but got %v", watches)
+	}
+	for _, s := range expected {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("expected the output to contain %q:\n%s", s, out.String())
+		}
+	}
+	if rdi := cpu.Reg(7); rdi != 1 {
+		t.Errorf("expected %%rdi to be 1 but got %d\n", rdi)
+	}
+}
+
+func TestDebugPipelinedProcessor(t *testing.T) {
+	assembler := model.NewAssembler(source)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	pipe := model.NewPipe()
+	if err := assembler.Load(pipe); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	d := New(pipe, model.SymbolsByAddress(assembler.Object()), &out)
+	d.AddBreakpoint(d.symbols["loop"])
+	if status := d.Continue(); status != model.StatusAOK || pipe.PC() != d.symbols["loop"] {
+		t.Fatalf("expected to stop at loop but got %#x with status %d\n", pipe.PC(), status)
+	}
+	if rdi := pipe.Reg(7); rdi != 3 {
+		t.Errorf("expected %%rdi to be 3 but got %d\n", rdi)
+	}
+
+	if err := d.execute("watch", []string{"%rax"}); err == nil {
+		t.Error("expected an error for a watchpoint on the pipelined processor")
+	}
+	if err := d.execute("rs", nil); err == nil {
+		t.Error("expected an error for reverse execution on the pipelined processor")
+	}
+}
+
+func TestReverseCommands(t *testing.T) {
+	var out bytes.Buffer
+	d, cpu := newDebugger(t, &out)
+
+	script := strings.Join([]string{
+		"break loop",
+		"continue",
+		"continue",
+		"reverse-step",
+		"reverse-continue",
+		"watch %rsp",
+		"reverse-continue",
+		"goto 0",
+		"rs",
+		"history",
+		"goto 8",
+		"quit",
+	}, "\n")
+	if err := d.Run(strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"(y86) => 0x34: jne loop\n(y86) breakpoint at 0x32 <loop>\n=> 0x32 <loop>: subq %rsi, %rdi",
+		"watchpoint 1: %rsp changed by instruction at 0x1e: 0x1f8 -> 0x1f0\n=> 0x1e: call count",
+		"reached the start of the history at cycle 0\n=> 0x0: irmovq $512, %rsp",
+		"cycles 0 to 0, at most 10000 instructions kept",
+	}
+	for _, s := range expected {
+		if !strings.Contains(out.String(), s) {
+			t.Errorf("expected the output to contain %q:\n%s", s, out.String())
+		}
+	}
+	if cycles := cpu.Cycles(); cpu.PC() != 0x34 || cycles != 8 {
+		t.Errorf("expected to go to cycle 8 at 0x34 but got cycle %d at %#x", cycles, cpu.PC())
+	}
+	if rdi := cpu.Reg(7); rdi != 1 {
+		t.Errorf("expected %%rdi to be 1 but got %d\n", rdi)
+	}
+}
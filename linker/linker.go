@@ -0,0 +1,204 @@
+// Package linker combines y86 object files into a single loadable image. Every object file
+// keeps the addresses it was assembled for unless its sections overlap the sections of the
+// files before it, in which case the whole file is moved after them. Global symbols are
+// resolved across files and the relocations of every file are applied to the moved sections.
+package linker
+
+import (
+	"fmt"
+	"strings"
+	"y86/object"
+)
+
+// Sections of a moved object file start at a multiple of this many bytes.
+const alignment = 8
+
+// A list of problems found while linking. Every problem is reported, not just the first.
+type Errors []string
+
+func (e Errors) Error() string {
+	return strings.Join(e, "\n")
+}
+
+// A global symbol and the object file that defines it.
+type definition struct {
+	value uint64
+	unit  int
+}
+
+// Links object files into a single image.
+type linker struct {
+	units   []*object.File
+	deltas  []uint64              // how far each object file is moved
+	globals map[string]definition // global symbols by name
+	out     *object.File
+	errs    Errors
+}
+
+// Link object files into one image. The entry point of the image is the entry point of
+// the first file. The image has no relocations left and its symbol table contains the
+// symbols of every file at their final addresses. Returns Errors if a global symbol is
+// defined more than once or a symbol is used but never defined.
+func Link(units ...*object.File) (*object.File, error) {
+	l := &linker{
+		units:   units,
+		deltas:  make([]uint64, len(units)),
+		globals: make(map[string]definition),
+		out:     &object.File{},
+	}
+
+	if len(units) == 0 {
+		return nil, Errors{"linker: no object files"}
+	}
+
+	l.layout()
+	l.resolveGlobals()
+	l.relocate()
+
+	if len(l.errs) > 0 {
+		return nil, l.errs
+	}
+	return l.out, nil
+}
+
+// Return a name for an object file that can be used in error messages.
+func (l *linker) name(unit int) string {
+	if src := l.units[unit].Source; src != "" {
+		return src
+	}
+	return fmt.Sprintf("object file %d", unit+1)
+}
+
+func (l *linker) errorf(format string, args ...interface{}) {
+	l.errs = append(l.errs, fmt.Sprintf(format, args...))
+}
+
+// Assign an address to every section and copy the sections into the image.
+func (l *linker) layout() {
+	var end uint64 // end of the highest section placed so far
+	placed := []object.Section{}
+
+	for i, unit := range l.units {
+		if len(unit.Sections) == 0 {
+			continue
+		}
+
+		if overlapsAny(unit.Sections, placed) {
+			low := unit.Sections[0].Addr
+			for _, s := range unit.Sections {
+				if s.Addr < low {
+					low = s.Addr
+				}
+			}
+			base := (end + alignment - 1) / alignment * alignment
+			l.deltas[i] = base - low
+		}
+
+		for _, s := range unit.Sections {
+			data := make([]byte, len(s.Data))
+			copy(data, s.Data)
+			moved := object.Section{Name: s.Name, Kind: s.Kind, Addr: s.Addr + l.deltas[i], Data: data}
+			placed = append(placed, moved)
+			l.out.Sections = append(l.out.Sections, moved)
+
+			if top := moved.Addr + uint64(len(moved.Data)); top > end {
+				end = top
+			}
+		}
+	}
+
+	l.out.Entry = l.units[0].Entry + l.deltas[0]
+	if len(l.units) == 1 {
+		l.out.Source = l.units[0].Source
+		l.out.Lines = l.units[0].Lines
+	}
+}
+
+// Returns true if any of the sections overlaps a section that was already placed.
+func overlapsAny(sections []object.Section, placed []object.Section) bool {
+	for _, s := range sections {
+		for _, p := range placed {
+			if s.Addr < p.Addr+uint64(len(p.Data)) && p.Addr < s.Addr+uint64(len(s.Data)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Return the final address of a symbol defined in an object file.
+func (l *linker) address(unit int, sym *object.Symbol) uint64 {
+	if sym.Section == object.Absolute {
+		return sym.Value
+	}
+	return sym.Value + l.deltas[unit]
+}
+
+// Build the table of global symbols and copy the defined symbols into the image.
+func (l *linker) resolveGlobals() {
+	first := 0 // index of the first section of the current object file in the image
+	for i, unit := range l.units {
+		for j := range unit.Symbols {
+			sym := &unit.Symbols[j]
+			if !sym.Defined() {
+				continue
+			}
+
+			value := l.address(i, sym)
+			if sym.Global {
+				if prev, exists := l.globals[sym.Name]; exists {
+					l.errorf("duplicate symbol %s defined in %s and %s", sym.Name, l.name(prev.unit), l.name(i))
+					continue
+				}
+				l.globals[sym.Name] = definition{value, i}
+			}
+
+			section := sym.Section
+			if section >= 0 {
+				section += int32(first)
+			}
+			l.out.Symbols = append(l.out.Symbols, object.Symbol{Name: sym.Name, Section: section, Value: value, Global: sym.Global})
+		}
+		first += len(unit.Sections)
+	}
+}
+
+// Patch the address of every relocated symbol into the sections of the image.
+func (l *linker) relocate() {
+	first := 0
+	for i, unit := range l.units {
+		reported := make(map[string]bool)
+		for _, r := range unit.Relocations {
+			sym := &unit.Symbols[r.Symbol]
+
+			var value uint64
+			if sym.Defined() {
+				value = l.address(i, sym)
+			} else if def, ok := l.globals[sym.Name]; ok {
+				value = def.value
+			} else {
+				if !reported[sym.Name] {
+					l.errorf("undefined symbol %s referenced in %s", sym.Name, l.name(i))
+					reported[sym.Name] = true
+				}
+				continue
+			}
+
+			if r.Kind != object.Abs64 {
+				l.errorf("unsupported relocation kind %d in %s", r.Kind, l.name(i))
+				continue
+			}
+			data := l.out.Sections[first+int(r.Section)].Data[r.Offset:]
+			putUint64(data, value+uint64(r.Addend))
+		}
+		first += len(unit.Sections)
+	}
+}
+
+// Store a little endian 8-byte value.
+func putUint64(b []byte, val uint64) {
+	for i := 0; i < 8; i++ {
+		b[i] = byte(val)
+		val >>= 8
+	}
+}
@@ -0,0 +1,114 @@
+package linker
+
+import (
+	"strings"
+	"testing"
+	"y86/model"
+	"y86/object"
+)
+
+// Assemble a source string into an object file.
+func assemble(t *testing.T, name string, src string) *object.File {
+	assembler := model.NewAssembler(src)
+	assembler.SetFilename(name)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	return assembler.Object()
+}
+
+const mainSource = `	.extern double, value
+	.pos 0
+	irmovq stack, %rsp
+	irmovq value, %rdi
+	call double
+	halt
+	.pos 0x100
+stack:
+`
+
+const doubleSource = `	.global double, value
+	.pos 0
+double:
+	mrmovq (%rdi), %rax
+	addq %rax, %rax
+	ret
+	.align 8
+value:	.quad 21
+table:	.quad double
+`
+
+func TestLink(t *testing.T) {
+	main := assemble(t, "main.ys", mainSource)
+	double := assemble(t, "double.ys", doubleSource)
+
+	image, err := Link(main, double)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(image.Relocations) != 0 {
+		t.Errorf("expected no relocations but got %d\n", len(image.Relocations))
+	}
+
+	// double.ys is assembled at address 0 like main.ys, so it's moved after main.ys
+	i := image.Lookup("double")
+	if i < 0 || image.Symbols[i].Value != 0x20 {
+		t.Fatalf("expected double at 0x20 but got %+v\n", image.Symbols)
+	}
+
+	// the local reference to double in the table is relocated too
+	table := image.Symbols[image.Lookup("table")]
+	section := image.Sections[table.Section]
+	offset := table.Value - section.Addr
+	if addr := section.Data[offset]; addr != 0x20 {
+		t.Errorf("expected the table to hold 0x20 but got %#x\n", addr)
+	}
+
+	cpu := model.CPU{}
+	if err := model.LoadObject(image, &cpu); err != nil {
+		t.Fatal(err)
+	}
+	cpu.Execute()
+	if rax := cpu.GetRegisterFile()[0]; rax != 42 {
+		t.Errorf("expected 42 in %%rax but got %d\n", rax)
+	}
+}
+
+func TestLinkKeepsDisjointAddresses(t *testing.T) {
+	main := assemble(t, "main.ys", mainSource)
+	double := assemble(t, "double.ys", strings.Replace(doubleSource, ".pos 0", ".pos 0x400", 1))
+
+	image, err := Link(main, double)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if i := image.Lookup("double"); image.Symbols[i].Value != 0x400 {
+		t.Errorf("expected double to stay at 0x400 but got %#x\n", image.Symbols[i].Value)
+	}
+}
+
+func TestLinkErrors(t *testing.T) {
+	main := assemble(t, "main.ys", mainSource)
+	first := assemble(t, "first.ys", ".global value\nvalue: .quad 1\n")
+	second := assemble(t, "second.ys", ".global value\nvalue: .quad 2\n")
+
+	_, err := Link(main, first, second)
+	errs, ok := err.(Errors)
+	if !ok {
+		t.Fatalf("expected link errors but got %v\n", err)
+	}
+
+	expected := Errors{
+		"duplicate symbol value defined in first.ys and second.ys",
+		"undefined symbol double referenced in main.ys",
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("expected %v but got %v\n", expected, errs)
+	}
+	for i := range expected {
+		if errs[i] != expected[i] {
+			t.Errorf("expected %q but got %q\n", expected[i], errs[i])
+		}
+	}
+}
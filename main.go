@@ -1,30 +1,626 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"y86/conformance"
+	"y86/debugger"
+	"y86/linker"
 	"y86/model"
+	"y86/object"
+	"y86/snapshot"
+	"y86/trace"
 )
 
+const usage = `usage:
+  y86 <file>                      assemble and run a source file, .yo listing, object file
+                                  or snapshot
+  y86 run [-pipe] [-trace out.jsonl|out.trace] [-cycles n] [-save out.snap] [-isa set]
+          [-console] [-traps] [-mem size] <file>
+                                  same as above, -pipe runs it on the pipelined processor,
+                                  -trace records every instruction as JSON Lines or binary,
+                                  -cycles stops after n cycles, -save writes a snapshot of
+                                  the CPU when it stops and -console attaches a console to
+                                  stdin and stdout at 0xff00: programs print the byte written
+                                  to 0xff00 or the integer written to 0xff08 and read input
+                                  from the same addresses, -traps enables the iret
+                                  instruction, a trap controller at 0xff10 and a timer on
+                                  interrupt line 0 at 0xff28 and -mem sets the size of
+                                  memory (0x10000 bytes by default, up to 2^48); the exit
+                                  code of a program that calls the exit service of syscall
+                                  is the exit code of y86, and a program that stops with a
+                                  status other than HLT exits with 1
+  y86 asm [-o out.yo|out.o] [-isa set] <file>
+                                  assemble a file and write its .yo listing or object file
+  y86 link -o out.o [-isa set] <file>...
+                                  link source or object files into one object file
+  y86 debug [-pipe] [-isa set] [-mem size] <file>
+                                  debug a program interactively
+  y86 disasm [-start addr] [-end addr] [-isa set] <file>
+                                  disassemble a source, listing or object file
+  y86 conform <dir|file>...       compare programs with their golden yis output (.out files)
+
+The -isa flag selects the instruction set: strict for the Y86-64 of CS:APP, extended (the
+default) for Y86-64 with mulq, divq and modq, or a custom comma separated list of profiles
+and instructions such as strict,iaddq,leave or extended,-modq. The syscall instruction is
+enabled with -isa extended,syscall.
+`
+
 func main() {
-	filename := os.Args[1]
-	bytes, readError := os.ReadFile(filename)
-	source := string(bytes)
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
 
+	switch os.Args[1] {
+	case "run":
+		os.Exit(runCommand(os.Args[2:]))
+	case "asm":
+		os.Exit(asmCommand(os.Args[2:]))
+	case "link":
+		os.Exit(linkCommand(os.Args[2:]))
+	case "debug":
+		os.Exit(debugCommand(os.Args[2:]))
+	case "disasm":
+		os.Exit(disasmCommand(os.Args[2:]))
+	case "conform":
+		os.Exit(conformCommand(os.Args[2:]))
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		os.Exit(runCommand(os.Args[1:]))
+	}
+}
+
+// Assemble a source file for an instruction set and print its diagnostics. Returns nil if the
+// file has errors.
+func assemble(filename string, isa *model.ISA) *model.Assembler {
+	bytes, readError := os.ReadFile(filename)
 	if readError != nil {
-		fmt.Println(readError)
+		fmt.Fprintln(os.Stderr, readError)
+		return nil
 	}
 
-	cpu := model.CPU{}
-	assembler := *model.NewAssembler(source)
+	assembler := model.NewAssembler(string(bytes))
+	assembler.SetFilename(filename)
+	assembler.SetISA(isa)
 	assemblyError := assembler.Assemble()
 
+	for _, diag := range assembler.Diagnostics() {
+		fmt.Fprintln(os.Stderr, diag)
+	}
+
 	if assemblyError != nil {
-		fmt.Println(assemblyError)
+		return nil
+	}
+	return assembler
+}
+
+// A program loaded into a processor.
+type program struct {
+	assembler *model.Assembler // the assembler of a source file, nil for other files
+	labels    map[int][]string // labels by address, nil for listings
+}
+
+// Load a program into a processor. Object files and listings are loaded as they are, snapshots
+// are restored and source files are assembled first for an instruction set. Returns false after
+// printing the problem if the program can't be loaded.
+func loadProgram(filename string, cpu model.Processor, isa *model.ISA) (program, bool) {
+	var prog program
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return prog, false
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte(snapshot.Magic)):
+		s, err := snapshot.Decode(bytes.NewReader(data))
+		if err == nil {
+			err = restore(cpu, s)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			return prog, false
+		}
+	case bytes.HasPrefix(data, []byte(object.Magic)):
+		f, err := object.Decode(bytes.NewReader(data))
+		if err == nil {
+			err = model.LoadObject(f, cpu)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			return prog, false
+		}
+		prog.labels = model.SymbolsByAddress(f)
+	case strings.EqualFold(filepath.Ext(filename), ".yo"):
+		if err := model.LoadListing(bytes.NewReader(data), cpu); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			return prog, false
+		}
+	default:
+		if prog.assembler = assemble(filename, isa); prog.assembler == nil {
+			return prog, false
+		}
+		if err := prog.assembler.Load(cpu); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			return prog, false
+		}
+		prog.labels = model.SymbolsByAddress(prog.assembler.Object())
+	}
+	return prog, true
+}
+
+// Create the sequential CPU, or the pipelined processor if pipe is set, that executes an
+// instruction set.
+func newProcessor(pipe bool, isa *model.ISA) model.Processor {
+	if pipe {
+		p := model.NewPipe()
+		p.SetISA(isa)
+		return p
+	}
+	cpu := &model.CPU{}
+	cpu.SetISA(isa)
+	return cpu
+}
+
+// Parse the value of an -isa flag. Returns nil after printing the problem if it's invalid.
+func parseISA(spec string) *model.ISA {
+	isa, err := model.ParseISA(spec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil
+	}
+	return isa
+}
+
+// Set the size of the memory of a processor from the value of a -mem flag, keeping the default
+// size if it's empty. Returns false after printing the problem if the size is invalid.
+func setMemSize(cpu model.Processor, spec string) bool {
+	size, err := parseAddress(spec, model.MemSize)
+	if err == nil {
+		err = cpu.(interface{ SetMemSize(int) error }).SetMemSize(size)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+// Restore a snapshot into a processor. Only the sequential processor supports snapshots.
+func restore(cpu model.Processor, s *snapshot.State) error {
+	if cpu, ok := cpu.(*model.CPU); ok {
+		return cpu.Restore(s)
+	}
+	return fmt.Errorf("snapshots are only supported by the sequential processor")
+}
+
+// Write a snapshot of a processor to a file.
+func saveSnapshot(filename string, cpu model.Processor) error {
+	s, err := cpu.(*model.CPU).Snapshot()
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := snapshot.Encode(file, s); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Load a program into a processor and execute it.
+func runCommand(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	pipe := flags.Bool("pipe", false, "use the pipelined processor")
+	traceFile := flags.String("trace", "", "file to write the execution trace to")
+	cycles := flags.Int("cycles", 0, "stop after the processor has executed this many cycles")
+	save := flags.String("save", "", "file to write a snapshot of the CPU to when it stops")
+	isaSpec := flags.String("isa", "default", "instruction set")
+	console := flags.Bool("console", false, "attach a console to stdin and stdout")
+	traps := flags.Bool("traps", false, "enable traps, interrupts and a timer")
+	memSize := flags.String("mem", "", "size of memory in bytes")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	if *pipe && *traceFile != "" {
+		fmt.Fprintln(os.Stderr, "tracing is only supported by the sequential processor")
+		return 2
+	}
+	if *pipe && *save != "" {
+		fmt.Fprintln(os.Stderr, "snapshots are only supported by the sequential processor")
+		return 2
+	}
+	if *pipe && (*console || *traps) {
+		fmt.Fprintln(os.Stderr, "devices are only supported by the sequential processor")
+		return 2
+	}
+	if *traps {
+		*isaSpec += ",iret"
+	}
+	isa := parseISA(*isaSpec)
+	if isa == nil {
+		return 2
+	}
+
+	cpu := newProcessor(*pipe, isa)
+	if !setMemSize(cpu, *memSize) {
+		return 2
+	}
+	if *save != "" && cpu.MemorySize() > snapshot.MaxMem {
+		fmt.Fprintf(os.Stderr, "snapshots only support memories of up to %#x bytes\n", snapshot.MaxMem)
+		return 2
+	}
+	// the console device and the services of syscall share one reader of stdin
+	stdio := model.NewConsole(os.Stdin, os.Stdout)
+	if *console {
+		if err := cpu.(*model.CPU).AttachDevice(model.ConsoleAddr, stdio); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	if seq, ok := cpu.(*model.CPU); ok {
+		seq.SetSyscallConsole(stdio)
+	}
+	if *traps {
+		if err := cpu.(*model.CPU).EnableTraps(model.TrapAddr); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if err := cpu.(*model.CPU).AttachDevice(model.TimerAddr, model.NewTimer(0)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+	}
+	prog, ok := loadProgram(flags.Arg(0), cpu, isa)
+	if !ok {
+		return 1
+	}
+
+	var tracer *trace.Writer
+	if *traceFile != "" {
+		file, err := os.Create(*traceFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+
+		format := trace.Binary
+		if ext := strings.ToLower(filepath.Ext(*traceFile)); ext == ".json" || ext == ".jsonl" {
+			format = trace.JSON
+		}
+		tracer = trace.NewWriter(file, format)
+		cpu.(*model.CPU).SetTracer(tracer)
+	}
+
+	// reaching the cycle limit isn't an error, but stopping with a status other than HLT is
+	var runErr error
+	if *cycles > 0 {
+		for cpu.Status() == model.StatusAOK && cpu.Cycles() < *cycles {
+			cpu.Tick()
+		}
+		if status := cpu.Status(); status != model.StatusAOK && status != model.StatusHLT {
+			runErr = fmt.Errorf("error: status %s at %#x", model.StatusName(status), cpu.PC())
+		}
+	} else {
+		runErr = cpu.Execute()
+	}
+	if tracer != nil {
+		if err := tracer.Flush(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	if *save != "" {
+		if err := saveSnapshot(*save, cpu); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	model.PrintRegisterFile(cpu)
+	if prog.assembler != nil {
+		prog.assembler.PrintDataTable()
+	}
+	if runErr != nil {
+		fmt.Fprintln(os.Stderr, runErr)
+		return 1
+	}
+	if seq, ok := cpu.(*model.CPU); ok {
+		return seq.ExitCode()
+	}
+	return 0
+}
+
+// Load a program into a processor and debug it interactively.
+func debugCommand(args []string) int {
+	flags := flag.NewFlagSet("debug", flag.ExitOnError)
+	pipe := flags.Bool("pipe", false, "use the pipelined processor")
+	isaSpec := flags.String("isa", "default", "instruction set")
+	memSize := flags.String("mem", "", "size of memory in bytes")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	isa := parseISA(*isaSpec)
+	if isa == nil {
+		return 2
+	}
+
+	cpu := newProcessor(*pipe, isa)
+	if !setMemSize(cpu, *memSize) {
+		return 2
+	}
+	prog, ok := loadProgram(flags.Arg(0), cpu, isa)
+	if !ok {
+		return 1
+	}
+
+	if err := debugger.New(cpu, prog.labels, os.Stdout).Run(os.Stdin); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// Assemble a source file and write its .yo listing, or an object file if the output file
+// ends in .o. The listing is written next to the source file unless an output file is given.
+func asmCommand(args []string) int {
+	flags := flag.NewFlagSet("asm", flag.ExitOnError)
+	output := flags.String("o", "", "output file")
+	isaSpec := flags.String("isa", "default", "instruction set")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	filename := flags.Arg(0)
+	isa := parseISA(*isaSpec)
+	if isa == nil {
+		return 2
+	}
+
+	assembler := assemble(filename, isa)
+	if assembler == nil {
+		return 1
+	}
+
+	if *output == "" {
+		*output = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".yo"
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+
+	if isObjectFile(*output) {
+		err = object.Encode(file, assembler.Object())
+	} else {
+		err = assembler.WriteListing(file)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// Link source and object files into a single object file. Source files are assembled first.
+func linkCommand(args []string) int {
+	flags := flag.NewFlagSet("link", flag.ExitOnError)
+	output := flags.String("o", "a.o", "output file")
+	isaSpec := flags.String("isa", "default", "instruction set")
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	isa := parseISA(*isaSpec)
+	if isa == nil {
+		return 2
+	}
+
+	units := make([]*object.File, 0, flags.NArg())
+	for _, filename := range flags.Args() {
+		unit := readObject(filename, isa)
+		if unit == nil {
+			return 1
+		}
+		units = append(units, unit)
+	}
+
+	image, err := linker.Link(units...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+
+	if err := object.Encode(file, image); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
 	}
+	return 0
+}
+
+// Disassemble a program. Source and object files are disassembled section by section using
+// their symbol table. Listings are loaded into memory and disassembled from address 0 up to
+// the last byte that isn't zero unless an address range is given.
+func disasmCommand(args []string) int {
+	flags := flag.NewFlagSet("disasm", flag.ExitOnError)
+	startFlag := flags.String("start", "", "first address to disassemble")
+	endFlag := flags.String("end", "", "address to stop disassembling at")
+	isaSpec := flags.String("isa", "default", "instruction set of source files")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+	filename := flags.Arg(0)
+	isa := parseISA(*isaSpec)
+	if isa == nil {
+		return 2
+	}
+
+	start, startErr := parseAddress(*startFlag, 0)
+	end, endErr := parseAddress(*endFlag, -1)
+	if startErr != nil || endErr != nil {
+		fmt.Fprintln(os.Stderr, "invalid address range")
+		return 2
+	}
+
+	var lines []model.DisasmLine
+	if strings.EqualFold(filepath.Ext(filename), ".yo") {
+		file, err := os.Open(filename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer file.Close()
+
+		cpu := model.CPU{}
+		if err := model.LoadListing(file, &cpu); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+			return 1
+		}
+
+		if end < 0 {
+			mem := cpu.GetMem()
+			for end = len(mem); end > start && mem[end-1] == 0; end-- {
+			}
+		}
+		if lines, err = cpu.Disassemble(start, end, nil); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	} else {
+		f := readObject(filename, isa)
+		if f == nil {
+			return 1
+		}
+		for _, line := range model.DisassembleObject(f) {
+			if line.Address >= start && (end < 0 || line.Address < end) {
+				lines = append(lines, line)
+			}
+		}
+	}
+
+	if err := model.WriteDisassembly(os.Stdout, lines); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// Run programs and compare them with their golden yis output. Directories are searched for
+// programs that have a golden output file. Returns 1 if any program diverges.
+func conformCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, usage)
+		return 2
+	}
+
+	var programs []string
+	for _, arg := range args {
+		info, err := os.Stat(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if !info.IsDir() {
+			programs = append(programs, arg)
+			continue
+		}
+		corpus, err := conformance.Corpus(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		programs = append(programs, corpus...)
+	}
+
+	failed := 0
+	for _, program := range programs {
+		d, err := conformance.Check(program, conformance.GoldenFile(program))
+		switch {
+		case err != nil:
+			fmt.Fprintln(os.Stderr, err)
+			failed++
+		case d != nil:
+			fmt.Print(d)
+			failed++
+		default:
+			fmt.Printf("%s: ok\n", filepath.Base(program))
+		}
+	}
+
+	fmt.Printf("%d of %d programs match yis\n", len(programs)-failed, len(programs))
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// Parse a decimal or hexadecimal address. Returns the default value for an empty string.
+func parseAddress(s string, def int) (int, error) {
+	if s == "" {
+		return def, nil
+	}
+	addr, err := strconv.ParseInt(s, 0, 64)
+	return int(addr), err
+}
+
+// Read an object file, or assemble a source file for an instruction set into one. Returns nil
+// after printing the problem if the file can't be read or assembled.
+func readObject(filename string, isa *model.ISA) *object.File {
+	if !isObjectFile(filename) {
+		assembler := assemble(filename, isa)
+		if assembler == nil {
+			return nil
+		}
+		return assembler.Object()
+	}
+
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return nil
+	}
+	defer file.Close()
+
+	f, err := object.Decode(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", filename, err)
+		return nil
+	}
+	return f
+}
 
-	assembler.Load(&cpu)
-	cpu.Execute()
-	cpu.PrintRegisterFile()
-	assembler.PrintDataTable()
+// Returns true if the file name has the extension of an object file.
+func isObjectFile(filename string) bool {
+	ext := strings.ToLower(filepath.Ext(filename))
+	return ext == ".o" || ext == ".obj"
 }
@@ -0,0 +1,220 @@
+package model
+
+import (
+	"fmt"
+	"math"
+	"testing"
+)
+
+const minInt = math.MinInt64
+const maxInt = math.MaxInt64
+
+// Every opq instruction computes valE = valB op valA, where valA is rA and valB is rB.
+var aluTests = []struct {
+	fcode      byte
+	valA       int64
+	valB       int64
+	valE       int64
+	status     byte
+	zf, sf, of bool
+}{
+	{add, 1, 2, 3, aok, false, false, false},
+	{add, 0, 0, 0, aok, true, false, false},
+	{add, -1, 0, -1, aok, false, true, false},
+	{add, -5, 5, 0, aok, true, false, false},
+	{add, 1, maxInt, minInt, aok, false, true, true},
+	{add, maxInt, 1, minInt, aok, false, true, true},
+	{add, -1, minInt, maxInt, aok, false, false, true},
+	{add, minInt, minInt, 0, aok, true, false, true},
+	{add, maxInt, minInt, -1, aok, false, true, false},
+	{add, maxInt, maxInt, -2, aok, false, true, true},
+
+	{sub, 3, 5, 2, aok, false, false, false},
+	{sub, 5, 3, -2, aok, false, true, false},
+	{sub, 4, 4, 0, aok, true, false, false},
+	{sub, 1, minInt, maxInt, aok, false, false, true},
+	{sub, -1, maxInt, minInt, aok, false, true, true},
+	{sub, minInt, 0, minInt, aok, false, true, true},
+	{sub, minInt, -1, maxInt, aok, false, false, false},
+	{sub, maxInt, -1, minInt, aok, false, true, false},
+	{sub, maxInt, -2, maxInt, aok, false, false, true},
+	{sub, minInt, minInt, 0, aok, true, false, false},
+
+	{and, 0xc, 0xa, 0x8, aok, false, false, false},
+	{and, 0xf0, 0x0f, 0, aok, true, false, false},
+	{and, -1, minInt, minInt, aok, false, true, false},
+	{and, maxInt, minInt, 0, aok, true, false, false},
+
+	{xor, 0xc, 0xa, 0x6, aok, false, false, false},
+	{xor, 5, 5, 0, aok, true, false, false},
+	{xor, -1, 0, -1, aok, false, true, false},
+	{xor, maxInt, minInt, -1, aok, false, true, false},
+
+	{mul, 4, 3, 12, aok, false, false, false},
+	{mul, 4, -3, -12, aok, false, true, false},
+	{mul, minInt, 0, 0, aok, true, false, false},
+	{mul, 1, minInt, minInt, aok, false, true, false},
+	{mul, 2, maxInt, -2, aok, false, true, true},
+	{mul, -1, minInt, minInt, aok, false, true, true},
+	{mul, minInt, -1, minInt, aok, false, true, true},
+	{mul, -1, maxInt, -maxInt, aok, false, true, false},
+	{mul, 3037000500, 3037000500, -9223372036709301616, aok, false, true, true},
+	{mul, 3037000499, 3037000499, 9223372030926249001, aok, false, false, false},
+	{mul, 2, minInt / 2, minInt, aok, false, true, false},
+	{mul, minInt, minInt, 0, aok, true, false, true},
+
+	{div, 4, 12, 3, aok, false, false, false},
+	{div, 2, -7, -3, aok, false, true, false},
+	{div, -2, 7, -3, aok, false, true, false},
+	{div, 5, 0, 0, aok, true, false, false},
+	{div, 8, 7, 0, aok, true, false, false},
+	{div, 1, minInt, minInt, aok, false, true, false},
+	{div, -1, minInt, minInt, aok, false, true, true},
+	{div, -1, maxInt, -maxInt, aok, false, true, false},
+	{div, 0, 5, 5, dz, true, false, false},
+
+	{mod, 3, 7, 1, aok, false, false, false},
+	{mod, 3, -7, -1, aok, false, true, false},
+	{mod, -3, 7, 1, aok, false, false, false},
+	{mod, 3, 6, 0, aok, true, false, false},
+	{mod, -1, minInt, 0, aok, true, false, false},
+	{mod, maxInt, minInt, -1, aok, false, true, false},
+	{mod, 0, 5, 5, dz, true, false, false},
+}
+
+func TestALU(t *testing.T) {
+	for _, tc := range aluTests {
+		name := fmt.Sprintf("%s %d, %d", mnemonicTable[opq<<4|tc.fcode], tc.valA, tc.valB)
+		t.Run(name, func(t *testing.T) {
+			valE, status := aluOp(tc.fcode, tc.valA, tc.valB)
+			if valE != tc.valE || status != tc.status {
+				t.Fatalf("expected %d with status %s but got %d with status %s", tc.valE, StatusName(tc.status),
+					valE, StatusName(status))
+			}
+			if status != aok {
+				return
+			}
+
+			c := cc{}
+			c.update(tc.fcode, tc.valA, tc.valB, valE)
+			if expected := (cc{z: tc.zf, s: tc.sf, of: tc.of}); c != expected {
+				t.Errorf("expected %+v but got %+v", expected, c)
+			}
+		})
+	}
+}
+
+// Run every ALU test case as a program on both processors. Instructions that divide by zero
+// leave the condition codes as they were after a reset.
+func TestOpqInstructions(t *testing.T) {
+	for _, tc := range aluTests {
+		name := mnemonicTable[opq<<4|tc.fcode]
+		source := fmt.Sprintf("\tirmovq $%d, %%rax\n\tirmovq $%d, %%rbx\n\t%s %%rax, %%rbx\n\thalt\n",
+			tc.valA, tc.valB, name)
+		cpu, pipe := loadBoth(t, source)
+
+		for _, p := range []Processor{cpu, pipe} {
+			p.Execute()
+			expected := tc.status
+			if expected == aok {
+				expected = hlt
+			}
+			flags := Flags{ZF: tc.zf, SF: tc.sf, OF: tc.of}
+			if p.Status() != expected || p.Reg(3) != tc.valE || p.Flags() != flags {
+				t.Errorf("%T: %s %d, %d: expected %d with %+v and status %s but got %d with %+v and status %s",
+					p, name, tc.valA, tc.valB, tc.valE, flags, StatusName(expected), p.Reg(3), p.Flags(),
+					StatusName(p.Status()))
+			}
+		}
+	}
+}
+
+func TestConditions(t *testing.T) {
+	names := []string{"jmp", "jle", "jl", "je", "jne", "jge", "jg"}
+	testcases := []struct {
+		cc    cc
+		taken string // 1 if each jump in names is taken
+	}{
+		{cc{}, "1000111"},
+		{cc{z: true}, "1101010"},
+		{cc{s: true}, "1110100"},
+		{cc{of: true}, "1110100"},
+		{cc{s: true, of: true}, "1000111"},
+		{cc{z: true, s: true}, "1111000"},
+		{cc{z: true, of: true}, "1111000"},
+		{cc{z: true, s: true, of: true}, "1101010"},
+	}
+
+	for _, tc := range testcases {
+		for i, name := range names {
+			taken, ok := tc.cc.cond(byte(i))
+			if !ok || taken != (tc.taken[i] == '1') {
+				t.Errorf("%s with %+v: expected taken to be %c but got %v", name, tc.cc, tc.taken[i], taken)
+			}
+		}
+	}
+	if _, ok := (cc{}).cond(g + 1); ok {
+		t.Error("expected an invalid condition to be rejected")
+	}
+}
+
+func TestConditionalMoves(t *testing.T) {
+	names := []string{"rrmovq", "cmovle", "cmovl", "cmove", "cmovne", "cmovge", "cmovg"}
+	testcases := []struct {
+		a, b  int64  // the condition codes are set by b - a
+		moved string // 1 if each instruction in names moves
+	}{
+		{2, 1, "1110100"},
+		{2, 2, "1101010"},
+		{2, 3, "1000111"},
+	}
+
+	for _, tc := range testcases {
+		for i, name := range names {
+			// the addq uses the result of the move in the next cycle, which PIPE forwards
+			source := fmt.Sprintf(`
+	irmovq $%d, %%rax
+	irmovq $%d, %%rbx
+	subq %%rax, %%rbx
+	irmovq $1, %%rcx
+	irmovq $2, %%rdx
+	%s %%rcx, %%rdx
+	addq %%rdx, %%rdx
+	halt`, tc.a, tc.b, name)
+			expected := int64(4)
+			if tc.moved[i] == '1' {
+				expected = 2
+			}
+
+			cpu, pipe := loadBoth(t, source)
+			for _, p := range []Processor{cpu, pipe} {
+				if err := p.Execute(); err != nil {
+					t.Fatalf("%T: %s: %v", p, name, err)
+				}
+				if rdx := p.Reg(2); rdx != expected {
+					t.Errorf("%T: %s after %d - %d: expected %%rdx to be %d but got %d", p, name, tc.b, tc.a,
+						expected, rdx)
+				}
+			}
+		}
+	}
+}
+
+func TestConditionalMovesOfZero(t *testing.T) {
+	names := []string{"rrmovq", "cmovle", "cmovl", "cmove", "cmovne", "cmovge", "cmovg"}
+	for _, name := range names {
+		// the fcodes of cmovge and cmovg are those of divq and modq, which must not divide by %rax
+		source := fmt.Sprintf(`
+	irmovq $0, %%rax
+	irmovq $5, %%rbx
+	%s %%rax, %%rbx
+	halt`, name)
+
+		cpu, pipe := loadBoth(t, source)
+		for _, p := range []Processor{cpu, pipe} {
+			if err := p.Execute(); err != nil {
+				t.Errorf("%T: %s: %v", p, name, err)
+			}
+		}
+	}
+}
@@ -3,32 +3,50 @@ package model
 import "fmt"
 
 type Assembler struct {
-	scanner Scanner
-	parser  Parser
+	scanner  Scanner
+	parser   Parser
+	reporter *reporter // shared by the scanner and the parser
 }
 
 // Create a new assembler and set the source string to assemble.
 func NewAssembler(src string) *Assembler {
 	scanner := NewScanner(src)
+	parser := NewParser(nil)
+	parser.reporter = scanner.reporter
 	return &Assembler{
 		*scanner,
-		Parser{symbolTable: make(map[string]int), dataTable: make(map[int]int64)},
+		*parser,
+		scanner.reporter,
 	}
 }
 
-// Assemble the source code and generate the instruction buffer. Return an error if
-// an error occurred in either the scanning or parsing phase.
+// Set the name of the source file that is used in diagnostics.
+func (a *Assembler) SetFilename(name string) {
+	a.reporter.file = name
+}
+
+// Set the instructions that the assembler accepts. Other instructions are reported as errors.
+func (a *Assembler) SetISA(isa *ISA) {
+	a.parser.isa = isa
+}
+
+// Assemble the source code and generate the instruction buffer. Both the scanning and the
+// parsing phase run to completion so that every problem is found. Return the diagnostics
+// as an error if at least one of them is an error.
 func (a *Assembler) Assemble() error {
-	scanError := a.scanner.scan()
+	a.scanner.scan()
 	a.parser.SetTokens(a.scanner.tokens)
-	parseError := a.parser.parse()
-	if scanError != nil {
-		return scanError
-	} else if parseError != nil {
-		return parseError
-	} else {
-		return nil
+	a.parser.parse()
+
+	if diags := a.reporter.diagnostics(); diags.HasErrors() {
+		return diags
 	}
+	return nil
+}
+
+// Return the errors and warnings found by the last call to Assemble in source order.
+func (a *Assembler) Diagnostics() Diagnostics {
+	return a.reporter.diagnostics()
 }
 
 // Print the instrution buffer.
@@ -44,46 +62,13 @@ func (a *Assembler) PrintDataTable() {
 	}
 }
 
-// Load the data table and instruction buffer into the CPU.
-func (a *Assembler) Load(cpu *CPU) error {
-	a.setEntryPoint(cpu)
-	dataError := a.loadData(cpu)
-	instructionError := a.loadInstructions(cpu)
-	if dataError != nil {
-		return dataError
-	} else if instructionError != nil {
-		return instructionError
-	} else {
-		return nil
-	}
-}
-
-// Set the program counter to the entry point of the CPU.
-func (a *Assembler) setEntryPoint(cpu *CPU) {
-	cpu.state.pc = a.parser.start
-}
-
-// Load the instruction buffer into the CPU starting at the location of the program counter.
-func (a *Assembler) loadInstructions(cpu *CPU) error {
-	address := cpu.state.pc
-	for _, bytes := range a.parser.instructions {
-		err := cpu.writeBytesToMem(address, bytes)
-		if err != nil {
-			return err
+// Load the data table and instruction buffer into a processor. Programs that refer to external
+// labels have to be linked first.
+func (a *Assembler) Load(p Processor) error {
+	for _, ref := range a.parser.references {
+		if _, defined := a.parser.symbolTable[ref.symbol]; !defined {
+			return fmt.Errorf("error: undefined symbol %s", ref.symbol)
 		}
-		address += len(bytes)
 	}
-	return nil
-}
-
-// Load the data into memory.
-func (a *Assembler) loadData(cpu *CPU) error {
-	var dataTable map[int]int64 = a.parser.dataTable
-	for address, value := range dataTable {
-		err := cpu.writeLongToMem(address, value)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return p.Load(a.Image())
 }
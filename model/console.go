@@ -0,0 +1,110 @@
+package model
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"unicode"
+)
+
+// Address the command line attaches the console at.
+const ConsoleAddr = 0xff00
+
+// Registers of the console, as offsets from the address it's attached at.
+const (
+	ConsoleChar = 0 // writes print the low byte, reads return the next byte of input or -1 at the end
+	ConsoleInt  = 8 // writes print a decimal integer, reads parse the next integer of the input
+)
+
+// A memory-mapped console device that lets programs print characters and integers to a writer
+// and read them from a reader.
+type Console struct {
+	in  *bufio.Reader // input, nil if the console has no input
+	out io.Writer     // output, nil if the console has no output
+}
+
+// Create a console that reads from in and writes to out. Either may be nil.
+func NewConsole(in io.Reader, out io.Writer) *Console {
+	c := &Console{out: out}
+	if in != nil {
+		c.in = bufio.NewReader(in)
+	}
+	return c
+}
+
+// The console has two quad registers.
+func (c *Console) Size() int {
+	return 16
+}
+
+// Read a character or an integer from the input. Reading an integer fails at the end of the
+// input or if the next word isn't an integer.
+func (c *Console) Read(offset int) (int64, error) {
+	switch offset {
+	case ConsoleChar:
+		if c.in == nil {
+			return -1, nil
+		}
+		b, err := c.in.ReadByte()
+		if err == io.EOF {
+			return -1, nil
+		}
+		return int64(b), err
+	case ConsoleInt:
+		word, err := c.readWord()
+		if err != nil {
+			return 0, err
+		}
+		val, err := strconv.ParseInt(word, 0, 64)
+		if err != nil {
+			return 0, fmt.Errorf("console: %q is not an integer", word)
+		}
+		return val, nil
+	default:
+		return 0, fmt.Errorf("console: invalid register %#x", offset)
+	}
+}
+
+// Print a character or an integer. Printing fails if the console has no output.
+func (c *Console) Write(offset int, val int64) error {
+	if c.out == nil && (offset == ConsoleChar || offset == ConsoleInt) {
+		return fmt.Errorf("console: no output")
+	}
+
+	var err error
+	switch offset {
+	case ConsoleChar:
+		_, err = c.out.Write([]byte{byte(val)})
+	case ConsoleInt:
+		_, err = fmt.Fprint(c.out, val)
+	default:
+		err = fmt.Errorf("console: invalid register %#x", offset)
+	}
+	return err
+}
+
+// Skip white space and return the next word of the input.
+func (c *Console) readWord() (string, error) {
+	if c.in == nil {
+		return "", fmt.Errorf("console: end of input")
+	}
+
+	var word []byte
+	for {
+		b, err := c.in.ReadByte()
+		if err == io.EOF && len(word) > 0 {
+			return string(word), nil
+		} else if err == io.EOF {
+			return "", fmt.Errorf("console: end of input")
+		} else if err != nil {
+			return "", err
+		}
+
+		if !unicode.IsSpace(rune(b)) {
+			word = append(word, b)
+		} else if len(word) > 0 {
+			return string(word), nil
+		}
+	}
+}
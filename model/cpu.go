@@ -2,6 +2,7 @@ package model
 
 import (
 	"fmt"
+	"y86/trace"
 )
 
 // Status codes
@@ -11,8 +12,37 @@ const (
 	adr             // Bad address
 	ins             // Bad instruction
 	dz              // Division by zero
+	wch             // Watchpoint hit
 )
 
+// Status codes visible outside of the package.
+const (
+	StatusAOK = aok
+	StatusHLT = hlt
+	StatusADR = adr
+	StatusINS = ins
+	StatusDZ  = dz
+	StatusWCH = wch
+)
+
+// Names of the status codes as printed by the yis simulator.
+var statusNames = map[byte]string{
+	aok: "AOK",
+	hlt: "HLT",
+	adr: "ADR",
+	ins: "INS",
+	dz:  "DZ",
+	wch: "WCH",
+}
+
+// Return the name of a status code.
+func StatusName(status byte) string {
+	if name, ok := statusNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("status(%d)", status)
+}
+
 // Maps fcodes to ALU functions.
 var alu = map[byte]func(int64, int64) int64{
 	add: func(valA int64, valB int64) int64 { return valB + valA },
@@ -24,14 +54,13 @@ var alu = map[byte]func(int64, int64) int64{
 	mod: func(valA int64, valB int64) int64 { return valB % valA },
 }
 
-const maxMem = 0xffff // Total RAM
 const numReg = 16     // Number of registers the CPU supports.
 const stackPtrReg = 4 // Stack pointer register
 
 // Output of fetch stage. Important data that's used throughout the pipeline.
 type instReg struct {
 	opcode byte  // identifier
-	fcode  byte  // modifier (OPQ and JXX inst.)
+	fcode  byte  // modifier (OPQ, JXX and CMOVXX inst.)
 	rA     byte  // source reg
 	rB     byte  // dest reg
 	valC   int64 // constant
@@ -44,6 +73,16 @@ type cc struct {
 	s  bool // set after negative
 }
 
+// Condition codes after a reset. ZF is set like in the yis simulator.
+var initialCC = cc{z: true}
+
+// The condition codes of the CPU as seen from outside the package.
+type Flags struct {
+	ZF bool // zero
+	SF bool // sign
+	OF bool // overflow
+}
+
 // Container for the CPU state.
 type CpuState struct {
 	instreg instReg // instruction register
@@ -59,132 +98,384 @@ type CpuState struct {
 
 // y86 CPU.
 type CPU struct {
-	mem   [maxMem]byte  // memory
-	reg   [numReg]int64 // registers
-	state CpuState      // state
+	mem          memory        // memory
+	reg          registerFile  // registers
+	state        CpuState      // state
+	watch        watchState    // watchpoints
+	cycles       int           // number of cycles executed
+	instructions int           // number of instructions fetched
+	tracer       Tracer        // receives a record of every instruction, nil if not tracing
+	record       *trace.Record // record of the current instruction while tracing
+	history      history       // undo log of the last instructions executed
+	isa          *ISA          // instructions the CPU executes, nil for the default ISA
+	addrMap      addressMap    // regions of the address space mapped to memory and devices
+	traps        *trapUnit     // trap controller, nil if faults stop the CPU
+	sys          syscalls      // services of the syscall instruction
 }
 
 func (cpu *CPU) PrintRegisterFile() {
-	fmt.Println("Register file:")
-	for i := 0; i < 4; i++ {
-		for j := i; j < 16; j += 4 {
-			fmt.Printf("r%d: %d\t", j, cpu.reg[j])
+	PrintRegisterFile(cpu)
+}
+
+// Reset the CPU and load a program. Watchpoints, the tracer and the history size are kept.
+// The heap of the syscall instruction starts after the program.
+func (cpu *CPU) Load(image *Image) error {
+	if err := loadImage(cpu, image); err != nil {
+		return err
+	}
+	cpu.sys.brk = imageEnd(image)
+	return nil
+}
+
+// Clear the memory, registers, status, counters and undo log and reset the condition codes.
+// Watchpoints, the tracer, the history size, the instruction set, the size of memory, devices
+// and the services of the syscall instruction are kept, and the registers of the trap
+// controller are cleared.
+func (cpu *CPU) Reset() {
+	if cpu.traps != nil {
+		*cpu.traps = trapUnit{}
+	}
+	*cpu = CPU{
+		mem:     memory{size: cpu.mem.size},
+		state:   CpuState{cc: initialCC},
+		watch:   watchState{points: cpu.watch.points, next: cpu.watch.next},
+		tracer:  cpu.tracer,
+		history: history{size: cpu.history.size},
+		isa:     cpu.isa,
+		addrMap: cpu.addrMap,
+		traps:   cpu.traps,
+		sys:     syscalls{handlers: cpu.sys.handlers, console: cpu.sys.console},
+	}
+}
+
+// Set the instructions that the CPU executes. Other instructions raise INS.
+func (cpu *CPU) SetISA(isa *ISA) {
+	cpu.isa = isa
+}
+
+// Return the instructions that the CPU executes.
+func (cpu *CPU) ISA() *ISA {
+	return cpu.isa.get()
+}
+
+// Return the number of cycles executed.
+func (cpu *CPU) Cycles() int {
+	return cpu.cycles
+}
+
+// Return the number of instructions executed. The sequential CPU executes one instruction per cycle.
+func (cpu *CPU) Instructions() int {
+	return cpu.instructions
+}
+
+// Return a copy of the whole memory. The copy is as large as memory, so MemPages is better
+// suited to large memories.
+func (cpu *CPU) GetMem() []byte {
+	return cpu.mem.bytes()
+}
+
+// Return copies of the pages of memory that have been written, sorted by address. Every other
+// address reads as 0.
+func (cpu *CPU) MemPages() []MemPage {
+	return cpu.mem.written()
+}
+
+// Return the size of memory in bytes.
+func (cpu *CPU) MemorySize() int {
+	return cpu.mem.limit()
+}
+
+// Set the size of memory, which can be up to MaxMemSize, and clear it. Devices are kept.
+// Returns an error if the size is invalid or a device would be outside of memory.
+func (cpu *CPU) SetMemSize(size int) error {
+	mem, err := newMemory(size)
+	if err != nil {
+		return err
+	}
+	addrMap := addressMap{size: size}
+	for _, d := range cpu.Devices() {
+		if err := addrMap.attach(d.Addr, d.Device); err != nil {
+			return err
 		}
-		fmt.Println()
 	}
-	fmt.Println()
+	cpu.mem, cpu.addrMap = mem, addrMap
+	return nil
 }
 
-func (cpu *CPU) GetMem() *[maxMem]byte {
-	return &cpu.mem
+func (cpu *CPU) GetRegisterFile() [numReg]int64 {
+	return [numReg]int64(cpu.reg)
+}
+
+// Return the program counter.
+func (cpu *CPU) PC() int {
+	return cpu.state.pc
+}
+
+// Set the program counter.
+func (cpu *CPU) SetPC(pc int) {
+	cpu.state.pc = pc
+}
+
+// Return the status code.
+func (cpu *CPU) Status() byte {
+	return cpu.state.status
+}
+
+// Return the value of a register. Returns 0 for register 0xf and invalid registers.
+func (cpu *CPU) Reg(index byte) int64 {
+	if index >= numReg {
+		return 0
+	}
+	return cpu.readReg(index)
+}
+
+// Set the value of a register. Returns an error if the register is invalid.
+func (cpu *CPU) SetReg(index byte, val int64) error {
+	if index >= numReg {
+		return fmt.Errorf("error: invalid register %d", index)
+	}
+	cpu.logReg(index)
+	cpu.reg[index] = val
+	return nil
+}
+
+// Return the condition codes.
+func (cpu *CPU) Flags() Flags {
+	return Flags{cpu.state.cc.z, cpu.state.cc.s, cpu.state.cc.of}
+}
+
+// Set the condition codes.
+func (cpu *CPU) SetFlags(flags Flags) {
+	cpu.state.cc = cc{of: flags.OF, z: flags.ZF, s: flags.SF}
+}
+
+// Read a sequence of bytes from memory.
+func (cpu *CPU) ReadMem(addr int, size int) ([]byte, error) {
+	return cpu.readBytesFromMem(addr, size)
+}
+
+// Write a sequence of bytes to memory.
+func (cpu *CPU) WriteMem(addr int, bytes []byte) error {
+	return cpu.writeBytesToMem(addr, bytes)
+}
+
+// Return the number of the register with a name such as %rax, or false if there's no such register.
+func RegisterIndex(name string) (byte, bool) {
+	index, ok := registerTable[name]
+	return index, ok
+}
+
+// Return the name of a register such as %rax.
+func RegisterName(index byte) string {
+	return registerName(index)
 }
 
 func (cpu *CPU) Execute() error {
 	// This means that the starting address is invalid
 	var status byte = cpu.state.status
 	if status == adr {
-		return fmt.Errorf("error: entry point %#x is not a 16-bit address", cpu.state.pc)
+		return fmt.Errorf("error: entry point %#x is outside of memory", cpu.state.pc)
 	}
 
 	for status == aok {
 		status = cpu.Tick()
 	}
 
-	if status != halt {
-		return fmt.Errorf("error: status code %d", status)
+	if status == wch && len(cpu.watch.hits) > 0 {
+		return fmt.Errorf("error: %v", cpu.watch.hits[0])
+	} else if status != hlt {
+		return fmt.Errorf("error: status %s at %#x", StatusName(status), cpu.state.pc)
 	} else {
 		return nil
 	}
 }
 
-// Advance the clock by one cycle and return the status.
+// Advance the clock by one cycle and return the status. The status is WCH if the instruction
+// hit a watchpoint; the instruction is completed and Resume must be called to continue.
 func (cpu *CPU) Tick() byte {
+	if cpu.state.status != aok {
+		return cpu.state.status
+	}
+	cpu.logTick()
+	cpu.cycles++
+	if cpu.tracer != nil {
+		cpu.startRecord()
+	}
+
+	cpu.watch.hits = nil
+	cpu.tickDevices()
+	fetched := false
+	if !cpu.interrupt() {
+		fetched = cpu.step()
+	}
+	if len(cpu.watch.hits) > 0 && cpu.state.status == aok {
+		cpu.state.status = wch
+	}
+	if cpu.tracer != nil {
+		cpu.endRecord(fetched)
+	}
+	return cpu.state.status
+}
+
+// Execute the instruction at the program counter. Faults run the handler of their exception
+// if traps are enabled. Returns false if the instruction couldn't be fetched.
+func (cpu *CPU) step() bool {
+	pc := cpu.state.pc
 	cpu.fetch()
+	if cpu.state.status != aok {
+		cpu.exception(pc)
+		return false
+	}
+	cpu.instructions++
+	if cpu.state.instreg.opcode == system {
+		cpu.system()
+		cpu.exception(pc)
+		return true
+	}
+
 	cpu.decode()
 	cpu.execute()
 	cpu.memory()
+	if cpu.state.status != aok {
+		// like yis, an instruction that stops the CPU doesn't write registers or move the PC
+		cpu.exception(pc)
+		return true
+	}
 	cpu.writeback()
 	cpu.updatePC()
-	return cpu.state.status
+	return true
+}
+
+// Execute a system instruction.
+func (cpu *CPU) system() {
+	switch cpu.state.instreg.fcode {
+	case iret:
+		cpu.iret()
+	case syscall:
+		cpu.syscall()
+	}
 }
 
 // Copy a buffer onto a memory location. Return an error if the address is invalid.
 func (cpu *CPU) CopyBuf(addr int, buf []byte) error {
-	len := len(buf)
+	return cpu.writeBytesToMem(addr, buf)
+}
 
-	if addr < 0 || addr+len >= int(maxMem) {
-		return fmt.Errorf("invalid address %#x", addr)
+// Write a little endiann 8-byte integer to memory or a device at an address. If the address
+// is invalid or the device fails then set the status to ADR.
+func (cpu *CPU) writeLongToMem(addr int, val int64) error {
+	if r, ok := cpu.addrMap.find(addr, 8); ok && r.dev != nil {
+		if err := r.dev.Write(addr-r.addr, val); err != nil {
+			cpu.state.status = adr
+			return err
+		}
+		if cpu.record != nil {
+			cpu.record.Mem = append(cpu.record.Mem, trace.MemWrite{Addr: int64(addr), Value: val})
+		}
+		return nil
+	} else if !ok {
+		cpu.state.status = adr
+		return fmt.Errorf("error: invalid address %#x", addr)
 	}
 
-	for i := 0; i < len; i++ {
-		cpu.mem[addr+i] = buf[i]
+	if len(cpu.watch.points) > 0 {
+		old, _ := cpu.mem.readLong(addr)
+		cpu.checkMemWatch(addr, true, old, val)
 	}
 
-	return nil
-}
-
-// Write a little endiann 8-byte integer to memory at an address. If the address is
-// invalid then set the status to ADR.
-func (cpu *CPU) writeLongToMem(addr int, val int64) error {
-	if addr < 0 || addr+8 > maxMem {
+	cpu.logMem(addr, 8)
+	if !cpu.mem.writeLong(addr, val) {
 		cpu.state.status = adr
 		return fmt.Errorf("error: invalid address %#x", addr)
 	}
-
-	const mask byte = 0xff
-	for i := 0; i < 8; i++ {
-		curByte := (byte(val) & mask)
-		cpu.mem[addr+i] = curByte
-		val = val >> 8
+	if cpu.record != nil {
+		cpu.record.Mem = append(cpu.record.Mem, trace.MemWrite{Addr: int64(addr), Value: val})
 	}
 	return nil
 }
 
+// Write a sequence of bytes to memory and the devices that can be accessed byte by byte.
 func (cpu *CPU) writeBytesToMem(addr int, bytes []byte) error {
-	if addr+len(bytes) >= maxMem || addr < 0 {
+	if !cpu.mem.valid(addr, len(bytes)) {
 		return fmt.Errorf("error: cannot write %d bytes to address %#x", len(bytes), addr)
 	}
-
-	for i, value := range bytes {
-		cpu.mem[addr+i] = value
-	}
-	return nil
+	return cpu.addrMap.each(addr, len(bytes), func(r region, start int, size int) error {
+		part := bytes[start-addr : start-addr+size]
+		if r.dev == nil {
+			cpu.logMem(start, size)
+			return cpu.mem.writeBytes(start, part)
+		}
+		dev, err := r.byteDevice(start)
+		if err != nil {
+			return err
+		}
+		return dev.WriteBytes(start-r.addr, part)
+	})
 }
 
-// Read a sequence of bytes from memory and store it into a buffer.
+// Read a sequence of bytes from memory and the devices that can be accessed byte by byte.
 func (cpu *CPU) readBytesFromMem(addr int, size int) ([]byte, error) {
-	if addr+size >= maxMem || addr < 0 {
+	if !cpu.mem.valid(addr, size) {
 		return nil, fmt.Errorf("error: address %#x is invalid", addr)
 	}
-
-	bytes := make([]byte, size)
-	for i := 0; i < size; i++ {
-		bytes[i] = cpu.mem[addr+i]
+	bytes := make([]byte, 0, size)
+	err := cpu.addrMap.each(addr, size, func(r region, start int, size int) error {
+		var part []byte
+		var err error
+		if r.dev == nil {
+			part, err = cpu.mem.readBytes(start, size)
+		} else if dev, devErr := r.byteDevice(start); devErr != nil {
+			err = devErr
+		} else {
+			part, err = dev.ReadBytes(start-r.addr, size)
+		}
+		bytes = append(bytes, part...)
+		return err
+	})
+	if err != nil {
+		return nil, err
 	}
 	return bytes, nil
 }
 
-// Return the little endiann 8-byte int at an address. If the address is invalid then set the
-// status code to ADR and return 0.
+// Return the little endiann 8-byte int at an address in memory or a device. If the address is
+// invalid or the device fails then set the status code to ADR and return 0.
 func (cpu *CPU) readMem(addr int) int64 {
-	if addr > maxMem-8 {
+	if r, ok := cpu.addrMap.find(addr, 8); ok && r.dev != nil {
+		val, err := r.dev.Read(addr - r.addr)
+		if err != nil {
+			cpu.state.status = adr
+			return 0
+		}
+		return val
+	} else if !ok {
 		cpu.state.status = adr
 		return 0
 	}
 
-	var val int64 = 0
-	for i := 7; i >= 0; i-- {
-		byte := cpu.mem[addr+i]
-		val = val << 8
-		val += int64(byte)
+	val, ok := cpu.mem.readLong(addr)
+	if !ok {
+		cpu.state.status = adr
+		return 0
 	}
 
+	cpu.logRead(addr)
+	if len(cpu.watch.points) > 0 {
+		cpu.checkMemWatch(addr, false, val, val)
+	}
 	return val
 }
 
 // Write a value to a register.
 func (cpu *CPU) writeReg(index byte, val int64) {
+	if len(cpu.watch.points) > 0 {
+		cpu.checkRegWatch(index, cpu.reg[index], val)
+	}
+	cpu.logReg(index)
 	cpu.reg[index] = val
+	if cpu.record != nil {
+		cpu.record.Regs = append(cpu.record.Regs, trace.RegWrite{Reg: index, Value: val})
+	}
 }
 
 // Read a value from a register.
@@ -194,99 +485,33 @@ func (cpu *CPU) readReg(index byte) int64 {
 
 // Return true if a conditional operation should be carried out and false otherwise.
 func (cpu *CPU) ccCheck() bool {
-	fcode := cpu.state.instreg.fcode
-
-	switch fcode {
-	case 0:
-		return true
-	case le:
-		return cpu.state.cc.z || cpu.state.cc.s
-	case l:
-		return cpu.state.cc.s
-	case e:
-		return cpu.state.cc.z
-	case ne:
-		return !cpu.state.cc.z
-	case g:
-		return !cpu.state.cc.s
-	case ge:
-		return !(cpu.state.cc.z || cpu.state.cc.s)
-	default:
+	taken, ok := cpu.state.cc.cond(cpu.state.instreg.fcode)
+	if !ok {
 		cpu.state.status = ins // bad instruction
-		return false
 	}
+	return taken
 }
 
 // Store the hypothetical next value of the program counter in valP.
 func (cpu *CPU) setNextPC() {
-	opcode := cpu.state.instreg.opcode
-
-	switch opcode {
-	case halt:
-		cpu.state.valP = cpu.state.pc + 1
-	case nop:
-		cpu.state.valP = cpu.state.pc + 1
-	case rrmovq:
-		cpu.state.valP = cpu.state.pc + 2
-	case irmovq:
-		cpu.state.valP = cpu.state.pc + 10
-	case rmmovq:
-		cpu.state.valP = cpu.state.pc + 10
-	case mrmovq:
-		cpu.state.valP = cpu.state.pc + 10
-	case opq:
-		cpu.state.valP = cpu.state.pc + 2
-	case jxx:
-		cpu.state.valP = cpu.state.pc + 9
-	case call:
-		cpu.state.valP = cpu.state.pc + 9
-	case ret:
-		cpu.state.valP = cpu.state.pc + 1
-	case pushq:
-		cpu.state.valP = cpu.state.pc + 2
-	case popq:
-		cpu.state.valP = cpu.state.pc + 2
-	default:
+	size := instructionSize(cpu.state.instreg.opcode)
+	if size == 0 {
 		cpu.state.status = ins // bad instruction
 		return
 	}
+	cpu.state.valP = cpu.state.pc + size
 }
 
-// Fetch the next instruction and set the instruction register and valP.
+// Fetch the next instruction and set the instruction register and valP. Clears the values
+// computed for the previous instruction. Sets the status to INS if the opcode is invalid.
 func (cpu *CPU) fetch() {
-	var size int
-	var opcode byte = cpu.mem[cpu.state.pc] >> 4
-	switch opcode {
-	case halt:
-		size = 1
-	case nop:
-		size = 1
-	case rrmovq:
-		size = 2
-	case irmovq:
-		size = 10
-	case rmmovq:
-		size = 10
-	case mrmovq:
-		size = 10
-	case opq:
-		size = 2
-	case jxx:
-		size = 9
-	case call:
-		size = 9
-	case ret:
-		size = 1
-	case pushq:
-		size = 2
-	case popq:
-		size = 2
-	}
-	var instruction, err = cpu.readBytesFromMem(cpu.state.pc, size)
-	if err != nil {
-		cpu.state.status = adr
+	cpu.state.valA, cpu.state.valB, cpu.state.valE, cpu.state.valM = 0, 0, 0, 0
+	instreg, status := fetch(cpu.readBytesFromMem, cpu.state.pc, cpu.isa)
+	if status != aok {
+		cpu.state.status = status
+		return
 	}
-	cpu.state.instreg = createInstReg(instruction)
+	cpu.state.instreg = instreg
 	cpu.setNextPC()
 }
 
@@ -322,76 +547,69 @@ func (cpu *CPU) decode() {
 		cpu.state.valA = cpu.readReg(instreg.rA)
 		cpu.state.valB = cpu.readReg(stackPtrReg)
 	default:
-		cpu.state.status = ins
+		x := extensionOf(instreg)
+		if x == nil {
+			cpu.state.status = ins
+			return
+		}
+		if src := x.SrcA.index(instreg); src != rnone {
+			cpu.state.valA = cpu.readReg(src)
+		}
+		if src := x.SrcB.index(instreg); src != rnone {
+			cpu.state.valB = cpu.readReg(src)
+		}
 	}
 }
 
-// Run the ALU and set valE. Also set the condition codes if an ALU instruction was used.
+// Run the ALU and set valE. Also set the condition codes if an ALU instruction was used. Only
+// opq uses its fcode as the ALU function, the other instructions add.
 func (cpu *CPU) execute() {
 	opcode := cpu.state.instreg.opcode
 	fcode := cpu.state.instreg.fcode
 
 	switch opcode {
 	case rrmovq:
-		cpu.state.valE = cpu.alu(fcode, cpu.state.valA, 0)
+		cpu.state.valE = cpu.alu(add, cpu.state.valA, 0) // the fcode of cmovXX is its condition
 	case irmovq:
-		cpu.state.valE = cpu.alu(fcode, cpu.state.instreg.valC, 0)
+		cpu.state.valE = cpu.alu(add, cpu.state.instreg.valC, 0)
 	case rmmovq:
-		cpu.state.valE = cpu.alu(fcode, cpu.state.valB, cpu.state.instreg.valC)
+		cpu.state.valE = cpu.alu(add, cpu.state.valB, cpu.state.instreg.valC)
 	case mrmovq:
-		cpu.state.valE = cpu.alu(fcode, cpu.state.valB, cpu.state.instreg.valC)
+		cpu.state.valE = cpu.alu(add, cpu.state.valB, cpu.state.instreg.valC)
 	case opq:
 		cpu.state.valE = cpu.alu(fcode, cpu.state.valA, cpu.state.valB)
-		cpu.updateCC()
+		if cpu.state.status == aok {
+			cpu.updateCC()
+		}
 	case call:
-		cpu.state.valE = cpu.alu(fcode, -8, cpu.state.valB)
+		cpu.state.valE = cpu.alu(add, -8, cpu.state.valB)
 	case pushq:
-		cpu.state.valE = cpu.alu(fcode, -8, cpu.state.valB)
+		cpu.state.valE = cpu.alu(add, -8, cpu.state.valB)
 	case ret:
-		cpu.state.valE = cpu.alu(fcode, 8, cpu.state.valB)
+		cpu.state.valE = cpu.alu(add, 8, cpu.state.valB)
 	case popq:
-		cpu.state.valE = cpu.alu(fcode, 8, cpu.state.valB)
+		cpu.state.valE = cpu.alu(add, 8, cpu.state.valB)
 	default:
-		return
+		if x := extensionOf(cpu.state.instreg); x != nil {
+			cpu.executeExtension(x)
+		}
 	}
-
 }
 
-// Returns true if both a and b are negative integers and false otherwise.
-func areBothNeg(a int64, b int64) bool {
-	return a < 0 && b < 0
-}
-
-// Returns true if both a and b are positive integers and false otherwise.
-func areBothPos(a int64, b int64) bool {
-	return a > 0 && b > 0
-}
-
-// Returns true if both a and b are the same sign and false otherwise.
-func areSameSign(a int64, b int64) bool {
-	return (a < 0) == (b < 0)
+// Run the ALU of an extension and set valE. Also set the condition codes if the extension sets them.
+func (cpu *CPU) executeExtension(x *Extension) {
+	s := &cpu.state
+	aluA := x.ALUA.of(s.valA, s.valB, s.instreg.valC, 0)
+	aluB := x.ALUB.of(s.valA, s.valB, s.instreg.valC, 0)
+	s.valE = x.alu(aluA, aluB)
+	if x.SetCC && s.status == aok {
+		x.updateCC(&s.cc, aluA, aluB, s.valE)
+	}
 }
 
 // Update the condition codes based on the last ALU computation.
 func (cpu *CPU) updateCC() {
-	if cpu.state.valE == 0 {
-		cpu.state.cc.z = true
-		return
-	}
-
-	if cpu.state.valE < 0 {
-		cpu.state.cc.z = true
-	}
-
-	switch cpu.state.instreg.fcode {
-	case add:
-		cpu.state.cc.of = cpu.state.valE > 0 && areBothNeg(cpu.state.valA, cpu.state.valB) || cpu.state.valE < 0 && areBothPos(cpu.state.valA, cpu.state.valB)
-	case mul:
-		cpu.state.cc.of = cpu.state.valE > 0 && !areSameSign(cpu.state.valA, cpu.state.valB) || cpu.state.valE < 0 && areSameSign(cpu.state.valA, cpu.state.valB)
-	case sub:
-		cpu.state.cc.of = cpu.state.valE > 0 && cpu.state.valB < 0 && cpu.state.valA > 0 || cpu.state.valE < 0 && cpu.state.valB > 0 && cpu.state.valA < 0
-		cpu.state.cc.s = cpu.state.valE < 0
-	}
+	cpu.state.cc.update(cpu.state.instreg.fcode, cpu.state.valA, cpu.state.valB, cpu.state.valE)
 }
 
 // Write or read a value to memory. Set valM if a value was read.
@@ -415,9 +633,17 @@ func (cpu *CPU) memory() {
 	case popq:
 		cpu.state.valM = cpu.readMem(valB)
 	default:
-		return
+		x := extensionOf(cpu.state.instreg)
+		if x == nil || !x.MemRead && !x.MemWrite {
+			return
+		}
+		addr := int(x.MemAddr.of(cpu.state.valA, cpu.state.valB, cpu.state.instreg.valC, cpu.state.valE))
+		if x.MemRead {
+			cpu.state.valM = cpu.readMem(addr)
+		} else {
+			cpu.writeLongToMem(addr, cpu.state.valA)
+		}
 	}
-
 }
 
 // Write a value to a register.
@@ -429,7 +655,10 @@ func (cpu *CPU) writeback() {
 	case irmovq:
 		cpu.writeReg(instreg.rB, cpu.state.instreg.valC)
 	case rrmovq:
-		cpu.writeReg(instreg.rB, cpu.state.valA)
+		// cmovXX only moves if its condition holds
+		if cpu.ccCheck() {
+			cpu.writeReg(instreg.rB, cpu.state.valA)
+		}
 	case mrmovq:
 		cpu.writeReg(instreg.rA, cpu.state.valM)
 	case call:
@@ -444,7 +673,16 @@ func (cpu *CPU) writeback() {
 	case opq:
 		cpu.writeReg(instreg.rB, cpu.state.valE)
 	default:
-		return
+		x := extensionOf(instreg)
+		if x == nil {
+			return
+		}
+		if dst := x.DstE.index(instreg); dst != rnone {
+			cpu.writeReg(dst, cpu.state.valE)
+		}
+		if dst := x.DstM.index(instreg); dst != rnone {
+			cpu.writeReg(dst, cpu.state.valM)
+		}
 	}
 }
 
@@ -478,10 +716,9 @@ func (cpu *CPU) updatePC() {
 
 // Use the ALU to compute valE and return it. Set the Status to Dz if division by 0 is attempted.
 func (cpu *CPU) alu(fcode byte, aluA int64, aluB int64) int64 {
-	if fcode == div && aluA == 0 {
-		cpu.state.status = dz
-		return aluB
+	valE, status := aluOp(fcode, aluA, aluB)
+	if status != aok {
+		cpu.state.status = status
 	}
-	op := alu[fcode]
-	return op(aluA, aluB)
+	return valE
 }
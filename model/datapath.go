@@ -0,0 +1,98 @@
+package model
+
+import (
+	"math"
+)
+
+/*
+ * This file contains the state and combinational logic shared by the sequential (SEQ) and
+ * pipelined (PIPE) processor models.
+ */
+
+// Register file.
+type registerFile [numReg]int64
+
+// Fetch the instruction at an address with a function that reads memory. Returns ADR if the
+// address is invalid and INS if the instruction isn't in an instruction set.
+func fetch(read func(addr int, size int) ([]byte, error), addr int, isa *ISA) (instReg, byte) {
+	first, err := read(addr, 1)
+	if err != nil {
+		return instReg{}, adr
+	}
+
+	opcode, fcode := splitCode(first[0])
+	size := instructionSize(opcode)
+	if size == 0 || !isa.hasCode(opcode<<4|fcode) {
+		return instReg{}, ins
+	}
+
+	bytes, err := read(addr, size)
+	if err != nil {
+		return instReg{}, adr
+	}
+	return createInstReg(bytes), aok
+}
+
+// Split an instruction byte into its opcode and fcode. The fcode of the Y86-64 instructions
+// other than rrmovq, opq and jxx is ignored like in yis, so it's returned as 0.
+func splitCode(code byte) (byte, byte) {
+	opcode, fcode := code>>4, code&0xf
+	if opcode <= popq && opcode != rrmovq && opcode != opq && opcode != jxx {
+		fcode = 0
+	}
+	return opcode, fcode
+}
+
+// Update the condition codes after an ALU operation that computed valE = valB op valA. ZF and
+// SF are set from the result and OF is set if the signed result overflowed. Logical operations
+// and modq never overflow.
+func (c *cc) update(fcode byte, valA int64, valB int64, valE int64) {
+	c.z = valE == 0
+	c.s = valE < 0
+
+	switch fcode {
+	case add:
+		c.of = (valA < 0) == (valB < 0) && (valE < 0) != (valA < 0)
+	case sub:
+		c.of = (valA < 0) != (valB < 0) && (valE < 0) != (valB < 0)
+	case mul:
+		// dividing by -1 overflows too, so MinInt64 * -1 needs its own check
+		c.of = valA != 0 && (valE/valA != valB || valA == -1 && valB == math.MinInt64)
+	case div:
+		c.of = valA == -1 && valB == math.MinInt64
+	default:
+		c.of = false
+	}
+}
+
+// Return true if the condition of a jump with an fcode holds. Returns false for the second
+// value if the fcode is invalid.
+func (c cc) cond(fcode byte) (bool, bool) {
+	switch fcode {
+	case 0:
+		return true, true
+	case le:
+		return c.s != c.of || c.z, true
+	case l:
+		return c.s != c.of, true
+	case e:
+		return c.z, true
+	case ne:
+		return !c.z, true
+	case ge:
+		return c.s == c.of, true
+	case g:
+		return c.s == c.of && !c.z, true
+	default:
+		return false, false
+	}
+}
+
+// Compute valE from the ALU inputs. Returns DZ if divq or modq divides by zero.
+func aluOp(fcode byte, aluA int64, aluB int64) (int64, byte) {
+	if (fcode == div || fcode == mod) && aluA == 0 {
+		return aluB, dz
+	}
+	op := alu[fcode]
+	return op(aluA, aluB), aok
+}
@@ -0,0 +1,167 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+)
+
+/*
+ * The address space of the CPU is a map of regions. Each region is mapped either to the
+ * memory of the CPU or to a device. By default memory is the only region and covers the whole
+ * address space. Devices are mapped on top of memory, which splits the region of memory, but
+ * they can't overlap each other.
+ */
+
+// A device mapped into the address space of the CPU. Quads that instructions read from or
+// write to the addresses of a device are passed to it instead of memory.
+type Device interface {
+	// Return the number of bytes of the address space used by the device.
+	Size() int
+	// Read the quad at an offset from the first address of the device.
+	Read(offset int) (int64, error)
+	// Write a quad at an offset from the first address of the device.
+	Write(offset int, val int64) error
+}
+
+// Implemented by devices whose bytes can be read and written without side effects, such as a
+// ROM or a framebuffer. Instructions can be fetched from these devices, and programs can be
+// loaded into them and inspected with ReadMem and WriteMem. The other devices are only
+// accessed by the quad reads and writes of instructions.
+type ByteDevice interface {
+	Device
+	// Read a sequence of bytes that starts at an offset from the first address of the device.
+	ReadBytes(offset int, size int) ([]byte, error)
+	// Write a sequence of bytes at an offset from the first address of the device.
+	WriteBytes(offset int, bytes []byte) error
+}
+
+// A range of addresses mapped to memory or a device.
+type region struct {
+	addr int    // first address
+	size int    // number of bytes
+	dev  Device // the device, nil for memory
+}
+
+// The regions of the address space of the CPU.
+type addressMap struct {
+	size    int      // number of addresses, 0 for MemSize
+	regions []region // sorted by address and not overlapping, nil if memory is the only region
+}
+
+// Return the number of addresses.
+func (a *addressMap) limit() int {
+	if a.size == 0 {
+		return MemSize
+	}
+	return a.size
+}
+
+// Return the regions of the address space.
+func (a *addressMap) list() []region {
+	if a.regions == nil {
+		return []region{{0, a.limit(), nil}}
+	}
+	return a.regions
+}
+
+// Map a device at an address. Returns an error if the device is outside of memory or overlaps
+// another device.
+func (a *addressMap) attach(addr int, dev Device) error {
+	size := dev.Size()
+	if size <= 0 || !inBounds(addr, size, a.limit()) {
+		return fmt.Errorf("error: device at %#x with %d bytes is outside of memory", addr, size)
+	}
+
+	end := addr + size
+	regions := []region{}
+	for _, r := range a.list() {
+		if r.addr >= end || r.addr+r.size <= addr {
+			regions = append(regions, r)
+			continue
+		}
+		if r.dev != nil {
+			return fmt.Errorf("error: device at %#x-%#x overlaps the device at %#x-%#x", addr, end,
+				r.addr, r.addr+r.size)
+		}
+
+		// keep the memory before and after the device
+		if r.addr < addr {
+			regions = append(regions, region{r.addr, addr - r.addr, nil})
+		}
+		if r.addr+r.size > end {
+			regions = append(regions, region{end, r.addr + r.size - end, nil})
+		}
+	}
+	regions = append(regions, region{addr, size, dev})
+	sort.Slice(regions, func(i, j int) bool { return regions[i].addr < regions[j].addr })
+	a.regions = regions
+	return nil
+}
+
+// Return the region that holds a range of addresses, or false if the range isn't inside a
+// single region.
+func (a *addressMap) find(addr int, size int) (region, bool) {
+	for _, r := range a.list() {
+		if addr >= r.addr && inBounds(addr-r.addr, size, r.size) {
+			return r, true
+		}
+	}
+	return region{}, false
+}
+
+// Call a function with each region that a range of addresses overlaps and the part of the
+// range inside it. Returns an error if part of the range isn't mapped or the function fails.
+func (a *addressMap) each(addr int, size int, f func(r region, addr int, size int) error) error {
+	if !inBounds(addr, size, a.limit()) {
+		return fmt.Errorf("error: address %#x is invalid", addr)
+	}
+	end := addr + size
+
+	for _, r := range a.list() {
+		start, stop := addr, end
+		if start < r.addr {
+			start = r.addr
+		}
+		if stop > r.addr+r.size {
+			stop = r.addr + r.size
+		}
+		if start < stop {
+			if err := f(r, start, stop-start); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Return the byte device of a region, or an error if the device can't be accessed byte by byte.
+func (r region) byteDevice(addr int) (ByteDevice, error) {
+	if dev, ok := r.dev.(ByteDevice); ok {
+		return dev, nil
+	}
+	return nil, fmt.Errorf("error: address %#x is mapped to a device that can't be accessed byte by byte", addr)
+}
+
+// Map a device at an address. Instructions that access its addresses read from and write to
+// the device instead of memory. Devices can't overlap each other and are kept when the CPU is
+// reset. Returns an error if the device is outside of memory or overlaps another device.
+func (cpu *CPU) AttachDevice(addr int, dev Device) error {
+	return cpu.addrMap.attach(addr, dev)
+}
+
+// A device and the address it's mapped at.
+type MappedDevice struct {
+	Addr   int    // first address
+	Device Device // the device
+}
+
+// Return the devices mapped into the address space of the CPU in the order of their addresses.
+func (cpu *CPU) Devices() []MappedDevice {
+	devices := []MappedDevice{}
+	for _, r := range cpu.addrMap.list() {
+		if r.dev != nil {
+			devices = append(devices, MappedDevice{r.addr, r.dev})
+		}
+	}
+	return devices
+}
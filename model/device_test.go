@@ -0,0 +1,179 @@
+package model
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const consoleSource = `
+	irmovq 0xff00, %rdi
+	mrmovq 8(%rdi), %rax
+	mrmovq 8(%rdi), %rbx
+	addq %rax, %rbx
+	rmmovq %rbx, 8(%rdi)
+loop:	mrmovq 0(%rdi), %rcx
+	andq %rcx, %rcx
+	jl done
+	rmmovq %rcx, 0(%rdi)
+	jmp loop
+done:	halt
+`
+
+func TestConsole(t *testing.T) {
+	var out bytes.Buffer
+	cpu := &CPU{}
+	if err := cpu.AttachDevice(ConsoleAddr, NewConsole(strings.NewReader(" 3\n-0x10 ok\n"), &out)); err != nil {
+		t.Fatal(err)
+	}
+	assembler := NewAssembler(consoleSource)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	assembler.Load(cpu)
+
+	if err := cpu.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "-13ok\n" {
+		t.Errorf("expected -13ok but got %q", out.String())
+	}
+	if _, err := cpu.ReadMem(ConsoleAddr, 16); err == nil {
+		t.Error("expected the console registers not to be readable with ReadMem")
+	}
+
+	// reading an integer at the end of the input fails
+	cpu.Load(assembler.Image())
+	cpu.Execute()
+	if cpu.Status() != adr || cpu.Instructions() != 2 {
+		t.Errorf("expected ADR after 2 instructions but got %s after %d", StatusName(cpu.Status()),
+			cpu.Instructions())
+	}
+
+	// printing fails without output
+	cpu = &CPU{}
+	cpu.AttachDevice(ConsoleAddr, NewConsole(strings.NewReader("1 2"), nil))
+	assembler.Load(cpu)
+	cpu.Execute()
+	if cpu.Status() != adr || cpu.Instructions() != 5 {
+		t.Errorf("expected ADR after 5 instructions but got %s after %d", StatusName(cpu.Status()),
+			cpu.Instructions())
+	}
+}
+
+func TestConsoleRegisters(t *testing.T) {
+	c := NewConsole(nil, &bytes.Buffer{})
+	if val, err := c.Read(ConsoleChar); val != -1 || err != nil {
+		t.Errorf("expected -1 without input but got %d, %v", val, err)
+	}
+	if _, err := c.Read(ConsoleInt); err == nil {
+		t.Error("expected reading an integer without input to fail")
+	}
+	if _, err := NewConsole(strings.NewReader("12x"), nil).Read(ConsoleInt); err == nil {
+		t.Error("expected reading an invalid integer to fail")
+	}
+	if err := c.Write(4, 1); err == nil {
+		t.Error("expected an invalid register to be rejected")
+	}
+	if err := (&CPU{}).AttachDevice(MemSize-8, c); err == nil {
+		t.Error("expected a device outside of memory to be rejected")
+	}
+}
+
+// A device that counts its accesses and stores bytes, like a ROM that can be written.
+type testDevice struct {
+	data          []byte
+	reads, writes int
+}
+
+func (d *testDevice) Size() int {
+	return len(d.data)
+}
+
+func (d *testDevice) Read(offset int) (int64, error) {
+	d.reads++
+	return bytesToInt(d.data[offset : offset+8]), nil
+}
+
+func (d *testDevice) Write(offset int, val int64) error {
+	d.writes++
+	copy(d.data[offset:], intToBytes(val))
+	return nil
+}
+
+func (d *testDevice) ReadBytes(offset int, size int) ([]byte, error) {
+	return append([]byte{}, d.data[offset:offset+size]...), nil
+}
+
+func (d *testDevice) WriteBytes(offset int, bytes []byte) error {
+	copy(d.data[offset:], bytes)
+	return nil
+}
+
+func TestAddressMap(t *testing.T) {
+	cpu := &CPU{}
+	rom := &testDevice{data: make([]byte, 0x100)}
+	console := NewConsole(nil, &bytes.Buffer{})
+	if err := cpu.AttachDevice(0x1000, rom); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.AttachDevice(ConsoleAddr, console); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []int{0x0f00, 0x10f8, ConsoleAddr + 8} {
+		if err := cpu.AttachDevice(addr, &testDevice{data: make([]byte, 0x101)}); err == nil {
+			t.Errorf("expected a device at %#x to overlap", addr)
+		}
+	}
+	if devices := cpu.Devices(); len(devices) != 2 || devices[0].Device != rom || devices[1].Addr != ConsoleAddr {
+		t.Errorf("expected the ROM and the console but got %+v", devices)
+	}
+	expected := []region{{0, 0x1000, nil}, {0x1000, 0x100, rom}, {0x1100, ConsoleAddr - 0x1100, nil},
+		{ConsoleAddr, 16, console}, {ConsoleAddr + 16, MemSize - ConsoleAddr - 16, nil}}
+	if regions := cpu.addrMap.list(); len(regions) != len(expected) {
+		t.Fatalf("expected %+v but got %+v", expected, regions)
+	}
+	for i, r := range cpu.addrMap.list() {
+		if r != expected[i] {
+			t.Errorf("expected region %+v but got %+v", expected[i], r)
+		}
+	}
+
+	// the program is loaded into the ROM, which the CPU fetches from, and writes to memory
+	// before the ROM and to the ROM
+	assembler := NewAssembler(`
+	.pos 0x1000
+	irmovq $7, %rax
+	irmovq 0x1000, %rbx
+	rmmovq %rax, -8(%rbx)
+	rmmovq %rax, 0xf8(%rbx)
+	mrmovq 0xf8(%rbx), %rcx
+	halt
+`)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	if err := assembler.Load(cpu); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	ram, _ := cpu.mem.readLong(0x10f8)
+	if rom.writes != 1 || rom.reads != 1 || cpu.Reg(1) != 7 || ram != 0 {
+		t.Errorf("expected one read and write of the ROM but got %d reads and %d writes", rom.reads, rom.writes)
+	}
+	if code, err := cpu.ReadMem(0xff8, 0x10); err != nil || code[0] != 7 || code[8] != 0x30 {
+		t.Errorf("expected to read memory and the ROM but got %x, %v", code, err)
+	}
+
+	// a quad that is partly in the ROM is invalid
+	cpu.Load(&Image{Segments: []Segment{{0, EncodeInst(mrmovq, 0, 0, 0xf, 0xffc)}}})
+	if cpu.Tick(); cpu.Status() != adr {
+		t.Errorf("expected ADR but got %s", StatusName(cpu.Status()))
+	}
+	if err := cpu.WriteMem(ConsoleAddr-4, make([]byte, 8)); err == nil {
+		t.Error("expected a write to the console with WriteMem to fail")
+	}
+}
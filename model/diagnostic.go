@@ -0,0 +1,168 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The severity of a diagnostic.
+type Severity uint8
+
+const (
+	SeverityError   Severity = iota // The program cannot be assembled
+	SeverityWarning                 // The program can be assembled but is probably wrong
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityError:
+		return "error"
+	case SeverityWarning:
+		return "warning"
+	default:
+		return "unknown"
+	}
+}
+
+// A problem found in the source code by the scanner or the parser.
+type Diagnostic struct {
+	File     string   // name of the source file
+	Line     uint     // line of the problem
+	Col      uint     // column of the problem
+	Severity Severity // error or warning
+	Message  string   // description of the problem
+	Source   string   // the source line that contains the problem
+}
+
+// Format the diagnostic as file:line:col: severity: message, followed by the source line
+// and a caret that points at the column of the problem.
+func (d Diagnostic) String() string {
+	file := d.File
+	if file == "" {
+		file = "<input>"
+	}
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s:%d:%d: %s: %s", file, d.Line, d.Col, d.Severity, d.Message)
+	if d.Source != "" {
+		fmt.Fprintf(&sb, "\n    %s\n    %s^", d.Source, caretIndent(d.Source, d.Col))
+	}
+	return sb.String()
+}
+
+// Return the whitespace that lines a caret up with a column of the source line. Tabs are
+// copied so that the caret lines up regardless of the tab width of the terminal.
+func caretIndent(source string, col uint) string {
+	var sb strings.Builder
+	for i := 0; i < int(col)-1 && i < len(source); i++ {
+		if source[i] == '\t' {
+			sb.WriteByte('\t')
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+	return sb.String()
+}
+
+// A list of diagnostics. A list that contains at least one error can be returned as an error.
+type Diagnostics []Diagnostic
+
+func (d Diagnostics) Error() string {
+	lines := make([]string, len(d))
+	for i, diag := range d {
+		lines[i] = diag.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Returns true if the list contains at least one error and false otherwise.
+func (d Diagnostics) HasErrors() bool {
+	for _, diag := range d {
+		if diag.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// An error at a position in the source code. The parse functions return it so that the
+// parser can report where the problem is.
+type syntaxError struct {
+	line uint
+	col  uint
+	msg  string
+}
+
+func (e *syntaxError) Error() string {
+	return fmt.Sprintf("%s at [%d:%d]", e.msg, e.line, e.col)
+}
+
+// Create a syntax error at the position of a token.
+func errorAt(token Token, format string, args ...interface{}) error {
+	return &syntaxError{token.line, token.col, fmt.Sprintf(format, args...)}
+}
+
+// Collects the diagnostics for a single source file.
+type reporter struct {
+	file  string      // name of the source file
+	lines []string    // the source split into lines
+	diags Diagnostics // the diagnostics reported so far
+}
+
+// Create a new reporter for a source file.
+func newReporter(file string, src string) *reporter {
+	return &reporter{
+		file:  file,
+		lines: strings.Split(src, "\n"),
+	}
+}
+
+// Add a diagnostic at a line and column of the source file.
+func (r *reporter) report(severity Severity, line uint, col uint, format string, args ...interface{}) {
+	var source string
+	if line > 0 && int(line) <= len(r.lines) {
+		source = strings.TrimRight(r.lines[line-1], "\r")
+	}
+
+	r.diags = append(r.diags, Diagnostic{
+		File:     r.file,
+		Line:     line,
+		Col:      col,
+		Severity: severity,
+		Message:  fmt.Sprintf(format, args...),
+		Source:   source,
+	})
+}
+
+// Add an error at a line and column of the source file.
+func (r *reporter) errorf(line uint, col uint, format string, args ...interface{}) {
+	r.report(SeverityError, line, col, format, args...)
+}
+
+// Add a warning at a line and column of the source file.
+func (r *reporter) warnf(line uint, col uint, format string, args ...interface{}) {
+	r.report(SeverityWarning, line, col, format, args...)
+}
+
+// Add an error returned by a parse function. Errors without a position are reported at the token.
+func (r *reporter) reportError(token Token, err error) {
+	if se, ok := err.(*syntaxError); ok {
+		r.errorf(se.line, se.col, "%s", se.msg)
+	} else {
+		r.errorf(token.line, token.col, "%s", err.Error())
+	}
+}
+
+// Return the diagnostics in the order they appear in the source file.
+func (r *reporter) diagnostics() Diagnostics {
+	diags := make(Diagnostics, len(r.diags))
+	copy(diags, r.diags)
+	sort.SliceStable(diags, func(i, j int) bool {
+		if diags[i].Line != diags[j].Line {
+			return diags[i].Line < diags[j].Line
+		}
+		return diags[i].Col < diags[j].Col
+	})
+	return diags
+}
@@ -0,0 +1,217 @@
+package model
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"sort"
+	"y86/object"
+)
+
+// An instruction decoded from memory, or a byte that isn't the start of a valid instruction.
+type DisasmLine struct {
+	Address  int      // address of the first byte
+	Bytes    []byte   // machine code
+	Mnemonic string   // name of the instruction or directive, empty if the bytes are invalid
+	Text     string   // assembly syntax of the instruction
+	Labels   []string // labels defined at the address
+	Valid    bool     // false if the bytes aren't a valid instruction
+}
+
+// Maps an instruction byte (opcode and fcode) to the name of the instruction.
+var mnemonicTable = func() map[byte]string {
+	table := make(map[byte]string)
+	for name, info := range instructionTable {
+		table[info[0]<<4|info[1]] = name
+	}
+	return table
+}()
+
+// Maps a register number to the name of the register.
+var registerNames = func() map[byte]string {
+	table := make(map[byte]string)
+	for name, index := range registerTable {
+		table[index] = name
+	}
+	return table
+}()
+
+// Return the name of a register or %none for register 0xf.
+func registerName(index byte) string {
+	if name, ok := registerNames[index]; ok {
+		return name
+	}
+	return "%none"
+}
+
+// Disassemble a block of machine code that starts at a base address. Symbols maps addresses
+// to labels; jump and call destinations with a label are written as the label. Bytes that
+// aren't the start of a valid instruction are written as .byte and disassembly continues with
+// the next byte.
+func Disassemble(code []byte, base int, symbols map[int][]string) []DisasmLine {
+	lines := []DisasmLine{}
+	for offset := 0; offset < len(code); {
+		line := decodeLine(code[offset:], base+offset, symbols)
+		line.Labels = symbols[line.Address]
+		lines = append(lines, line)
+		offset += len(line.Bytes)
+	}
+	return lines
+}
+
+// Disassemble the memory of a processor from the start address up to but not including the
+// end address.
+func DisassembleMem(p Processor, start int, end int, symbols map[int][]string) ([]DisasmLine, error) {
+	if !inBounds(start, end-start, p.MemorySize()) {
+		return nil, fmt.Errorf("error: invalid address range %#x-%#x", start, end)
+	}
+	code, err := p.ReadMem(start, end-start)
+	if err != nil {
+		return nil, err
+	}
+	return Disassemble(code, start, symbols), nil
+}
+
+// Disassemble the instruction at an address in the memory of a processor.
+func InstructionAt(p Processor, addr int, symbols map[int][]string) DisasmLine {
+	if !inBounds(addr, 1, p.MemorySize()) {
+		return DisasmLine{Address: addr, Text: "<invalid address>"}
+	}
+
+	end := addr + 10
+	if end > p.MemorySize() {
+		end = p.MemorySize()
+	}
+	// the bytes after the instruction may be mapped to a device that can't be read
+	code, err := p.ReadMem(addr, end-addr)
+	for err != nil && end > addr+1 {
+		end--
+		code, err = p.ReadMem(addr, end-addr)
+	}
+	if err != nil {
+		return DisasmLine{Address: addr, Text: "<invalid address>"}
+	}
+	return decodeLine(code, addr, symbols)
+}
+
+// Disassemble the memory of the CPU from the start address up to but not including the end address.
+func (cpu *CPU) Disassemble(start int, end int, symbols map[int][]string) ([]DisasmLine, error) {
+	return DisassembleMem(cpu, start, end, symbols)
+}
+
+// Disassemble the instruction at the program counter.
+func (cpu *CPU) CurrentInst(symbols map[int][]string) DisasmLine {
+	return InstructionAt(cpu, cpu.state.pc, symbols)
+}
+
+// Disassemble the code sections of an object file and write its data sections as .quad
+// directives. Jump and call destinations are written as labels using the symbol table.
+func DisassembleObject(f *object.File) []DisasmLine {
+	symbols := SymbolsByAddress(f)
+	lines := []DisasmLine{}
+
+	sections := make([]object.Section, len(f.Sections))
+	copy(sections, f.Sections)
+	sort.SliceStable(sections, func(i, j int) bool { return sections[i].Addr < sections[j].Addr })
+
+	for _, s := range sections {
+		if s.Kind == object.Code {
+			lines = append(lines, Disassemble(s.Data, int(s.Addr), symbols)...)
+			continue
+		}
+
+		for offset := 0; offset < len(s.Data); offset += 8 {
+			end := offset + 8
+			if end > len(s.Data) {
+				end = len(s.Data)
+			}
+			address := int(s.Addr) + offset
+			lines = append(lines, DisasmLine{
+				Address:  address,
+				Bytes:    s.Data[offset:end],
+				Mnemonic: ".quad",
+				Text:     fmt.Sprintf(".quad %#x", bytesToInt(s.Data[offset:end])),
+				Labels:   symbols[address],
+				Valid:    true,
+			})
+		}
+	}
+	return lines
+}
+
+// Return the labels of an object file grouped by address.
+func SymbolsByAddress(f *object.File) map[int][]string {
+	symbols := make(map[int][]string)
+	for _, sym := range f.Symbols {
+		if sym.Defined() {
+			symbols[int(sym.Value)] = append(symbols[int(sym.Value)], sym.Name)
+		}
+	}
+	return symbols
+}
+
+// Decode the instruction at the start of a byte slice.
+func decodeLine(code []byte, address int, symbols map[int][]string) DisasmLine {
+	invalid := DisasmLine{
+		Address: address,
+		Bytes:   code[:1],
+		Text:    fmt.Sprintf(".byte 0x%02x", code[0]),
+	}
+
+	// the bytes that fetch executes are valid, including ignored fcodes
+	opcode, fcode := splitCode(code[0])
+	name, ok := mnemonicTable[opcode<<4|fcode]
+	size := instructionSize(opcode)
+	if !ok || size == 0 || size > len(code) {
+		return invalid
+	}
+
+	bytes := code[:size]
+	inst := createInstReg(bytes)
+	rA := registerName(inst.rA)
+	rB := registerName(inst.rB)
+
+	var operands string
+	switch formats[inst.opcode] {
+	case FormatRegReg:
+		operands = fmt.Sprintf("%s, %s", rA, rB)
+	case FormatImmReg:
+		operands = fmt.Sprintf("$%d, %s", inst.valC, rB)
+	case FormatRegMem:
+		operands = fmt.Sprintf("%s, %d(%s)", rA, inst.valC, rB)
+	case FormatMemReg:
+		operands = fmt.Sprintf("%d(%s), %s", inst.valC, rB, rA)
+	case FormatDest:
+		operands = fmt.Sprintf("%#x", inst.valC)
+		if labels, ok := symbols[int(inst.valC)]; ok {
+			operands = labels[0]
+		}
+	case FormatReg:
+		operands = rA
+	}
+
+	text := name
+	if operands != "" {
+		text += " " + operands
+	}
+	return DisasmLine{Address: address, Bytes: bytes, Mnemonic: name, Text: text, Valid: true}
+}
+
+// Write disassembled lines in the .yo listing format, with each label on a line of its own.
+// Invalid instructions are marked with a comment.
+func WriteDisassembly(w io.Writer, lines []DisasmLine) error {
+	bw := bufio.NewWriter(w)
+	for _, line := range lines {
+		for _, label := range line.Labels {
+			fmt.Fprintf(bw, "0x%03x:                      | %s:\n", line.Address, label)
+		}
+
+		text := line.Text
+		if !line.Valid {
+			text += "  # invalid instruction"
+		}
+		fmt.Fprintf(bw, "0x%03x: %-20s |     %s\n", line.Address, hex.EncodeToString(line.Bytes), text)
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,181 @@
+package model
+
+import (
+	"fmt"
+)
+
+/*
+ * Extensions are instructions that aren't part of Y86-64, such as the iaddq and leave
+ * instructions of the CS:APP homework problems. An extension is described by the control
+ * signals of the SEQ and PIPE designs: the registers it reads and writes, the inputs and
+ * function of the ALU and its memory access. Registering an extension adds it to the opcode
+ * tables, so the assembler, disassembler and both processors support it. Extensions are only
+ * executed when they are in the instruction set of a processor.
+ */
+
+// A register read or written by an extension.
+type RegSel byte
+
+const (
+	RegNone RegSel = iota // no register
+	RegA                  // register rA of the instruction
+	RegB                  // register rB of the instruction
+)
+
+// Select a fixed register such as %rsp.
+func FixedReg(index byte) RegSel {
+	return RegSel(0x10 + index)
+}
+
+// A value used as an ALU input or memory address by an extension.
+type Value byte
+
+const (
+	ValZero   Value = iota // 0
+	ValA                   // the value read from srcA
+	ValB                   // the value read from srcB
+	ValC                   // the constant of the instruction
+	ValE                   // the output of the ALU
+	ValPlus8               // 8
+	ValMinus8              // -8
+)
+
+// An instruction added to the processor. The instruction computes valE = ALU(aluA, aluB), reads
+// valM from or writes valA to memory, writes valE to dstE and then valM to dstM and continues
+// with the next instruction.
+type Extension struct {
+	Name       string                       // mnemonic
+	Code       byte                         // instruction byte, the opcode followed by the fcode
+	Format     Format                       // operands of the instruction
+	SrcA, SrcB RegSel                       // registers read into valA and valB
+	ALUA, ALUB Value                        // inputs of the ALU
+	ALU        func(aluA, aluB int64) int64 // function of the ALU, nil to add the inputs
+	SetCC      bool                         // true if the condition codes are set from valE
+	MemRead    bool                         // true if valM is read from memory
+	MemWrite   bool                         // true if valA is written to memory
+	MemAddr    Value                        // address of the memory access, ValE or ValA
+	DstE, DstM RegSel                       // registers written with valE and valM
+}
+
+// Add integer constant to register, CS:APP problem 4.51.
+var IAddq = Extension{
+	Name:   "iaddq",
+	Code:   0xc0,
+	Format: FormatImmReg,
+	SrcB:   RegB,
+	ALUA:   ValC,
+	ALUB:   ValB,
+	SetCC:  true,
+	DstE:   RegB,
+}
+
+// Restore the stack frame of the caller like leave in x86-64. It sets %rsp to %rbp + 8 and
+// pops %rbp from the stack.
+var Leave = Extension{
+	Name:    "leave",
+	Code:    0xd0,
+	Format:  FormatNone,
+	SrcA:    FixedReg(5),
+	SrcB:    FixedReg(5),
+	ALUA:    ValPlus8,
+	ALUB:    ValB,
+	MemRead: true,
+	MemAddr: ValA,
+	DstE:    FixedReg(stackPtrReg),
+	DstM:    FixedReg(5),
+}
+
+// Maps instruction bytes to the extensions registered with them.
+var extensions = map[byte]*Extension{}
+
+func init() {
+	for _, x := range []Extension{IAddq, Leave} {
+		if err := RegisterExtension(x); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Add an instruction to the opcode tables. Extensions can only use opcodes after popq other
+// than the opcode of the system instructions, and extensions that share an opcode must have
+// the same format. Returns an error if the name or instruction byte is taken.
+func RegisterExtension(x Extension) error {
+	opcode := x.Code >> 4
+	if _, ok := lexemeTable[x.Name]; ok || x.Name == "" {
+		return fmt.Errorf("error: instruction name %q is already taken", x.Name)
+	}
+	if _, ok := mnemonicTable[x.Code]; ok || opcode <= popq || opcode == system {
+		return fmt.Errorf("error: instruction byte %#02x of %s is already taken", x.Code, x.Name)
+	}
+	if format, ok := formats[opcode]; ok && format != x.Format {
+		return fmt.Errorf("error: %s has a different format than the other instructions with opcode %#x",
+			x.Name, opcode)
+	}
+	if x.Format > FormatDest {
+		return fmt.Errorf("error: %s has an invalid format", x.Name)
+	}
+
+	lexemeTable[x.Name] = instruction
+	instructionTable[x.Name] = []byte{opcode, x.Code & 0xf, byte(x.Format.Size())}
+	mnemonicTable[x.Code] = x.Name
+	formats[opcode] = x.Format
+	extensions[x.Code] = &x
+	return nil
+}
+
+// Return the extension of an instruction, or nil if it isn't an extension.
+func extensionOf(inst instReg) *Extension {
+	return extensions[inst.opcode<<4|inst.fcode]
+}
+
+// Return the index of the selected register of an instruction, or rnone for no register.
+func (sel RegSel) index(inst instReg) byte {
+	switch {
+	case sel == RegA:
+		return inst.rA
+	case sel == RegB:
+		return inst.rB
+	case sel >= 0x10 && sel < 0x10+numReg:
+		return byte(sel - 0x10)
+	default:
+		return rnone
+	}
+}
+
+// Return an ALU input or memory address.
+func (v Value) of(valA int64, valB int64, valC int64, valE int64) int64 {
+	switch v {
+	case ValA:
+		return valA
+	case ValB:
+		return valB
+	case ValC:
+		return valC
+	case ValE:
+		return valE
+	case ValPlus8:
+		return 8
+	case ValMinus8:
+		return -8
+	default:
+		return 0
+	}
+}
+
+// Compute valE from the ALU inputs.
+func (x *Extension) alu(aluA int64, aluB int64) int64 {
+	if x.ALU == nil {
+		return aluB + aluA
+	}
+	return x.ALU(aluA, aluB)
+}
+
+// Update the condition codes after the ALU computed valE. Additions set OF like addq and other
+// functions never overflow.
+func (x *Extension) updateCC(c *cc, aluA int64, aluB int64, valE int64) {
+	if x.ALU == nil {
+		c.update(add, aluA, aluB, valE)
+	} else {
+		*c = cc{z: valE == 0, s: valE < 0}
+	}
+}
@@ -0,0 +1,142 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+const extensionSource = `
+	irmovq stack, %rsp
+	irmovq $0x77, %rbp
+	call f
+	halt
+f:	pushq %rbp
+	rrmovq %rsp, %rbp
+	iaddq $-16, %rsp
+	irmovq $5, %rax
+	iaddq $10, %rax
+	leave
+	rrmovq %rbp, %rdx
+	ret
+	.pos 0x200
+stack:
+`
+
+func TestExtensions(t *testing.T) {
+	isa, err := ParseISA("default,iaddq,leave")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the rrmovq after leave reads %rbp from memory in the cycle before, which PIPE stalls for
+	cpu, pipe := loadBothISA(t, extensionSource, isa)
+	for _, p := range []Processor{cpu, pipe} {
+		if err := p.Execute(); err != nil {
+			t.Fatalf("%T: %v", p, err)
+		}
+		expected := map[byte]int64{0: 15, 2: 0x77, 4: 0x200, 5: 0x77}
+		for index, val := range expected {
+			if p.Reg(index) != val {
+				t.Errorf("%T: expected %s to be %#x but got %#x", p, registerName(index), val, p.Reg(index))
+			}
+		}
+		if p.Flags() != (Flags{}) {
+			t.Errorf("%T: expected the flags of iaddq $10 to be clear but got %+v", p, p.Flags())
+		}
+	}
+
+	cpu, pipe = loadBothISA(t, "irmovq $0x7fffffffffffffff, %rax\niaddq $1, %rax\nhalt\n", isa)
+	for _, p := range []Processor{cpu, pipe} {
+		p.Execute()
+		if flags := (Flags{SF: true, OF: true}); p.Flags() != flags {
+			t.Errorf("%T: expected iaddq to overflow with %+v but got %+v", p, flags, p.Flags())
+		}
+	}
+}
+
+func TestExtensionsNotInISA(t *testing.T) {
+	assembler := NewAssembler(extensionSource)
+	err := assembler.Assemble()
+	if err == nil || !strings.Contains(err.Error(), "instruction iaddq is not in the extended instruction set") {
+		t.Errorf("expected iaddq to be rejected but got %v", err)
+	}
+
+	// the processors raise INS when they fetch an instruction that isn't in their ISA
+	assembler = NewAssembler("iaddq $1, %rax\nhalt\n")
+	assembler.SetISA(&ISA{name: "iaddq", codes: map[byte]bool{0xc0: true, 0x00: true}})
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []Processor{&CPU{}, NewPipe()} {
+		assembler.Load(p)
+		p.Execute()
+		if p.Status() != ins || p.Reg(0) != 0 {
+			t.Errorf("%T: expected status INS but got %s", p, StatusName(p.Status()))
+		}
+	}
+
+	if _, err := ParseISA("default,pushq,shlq"); err == nil {
+		t.Error("expected an unknown instruction to be rejected")
+	}
+}
+
+func TestDisassembleExtensions(t *testing.T) {
+	code := []byte{0xc0, 0xf3, 0xf0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xd0}
+	lines := Disassemble(code, 0, nil)
+	if len(lines) != 2 || lines[0].Text != "iaddq $-16, %rbx" || lines[1].Text != "leave" {
+		t.Errorf("expected iaddq and leave but got %+v", lines)
+	}
+}
+
+func TestRegisterExtension(t *testing.T) {
+	shlq := Extension{
+		Name:   "shlq",
+		Code:   0xf0,
+		Format: FormatRegReg,
+		SrcA:   RegA,
+		SrcB:   RegB,
+		ALUA:   ValA,
+		ALUB:   ValB,
+		ALU:    func(aluA, aluB int64) int64 { return aluB << uint64(aluA) },
+		SetCC:  true,
+		DstE:   RegB,
+	}
+	if err := RegisterExtension(shlq); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		delete(lexemeTable, shlq.Name)
+		delete(instructionTable, shlq.Name)
+		delete(mnemonicTable, shlq.Code)
+		delete(formats, shlq.Code>>4)
+		delete(extensions, shlq.Code)
+	})
+	if err := RegisterExtension(shlq); err == nil {
+		t.Error("expected an extension to be registered only once")
+	}
+	if err := RegisterExtension(Extension{Name: "sarq", Code: 0xf1, Format: FormatReg}); err == nil {
+		t.Error("expected an extension with a different format than its opcode to be rejected")
+	}
+	if err := RegisterExtension(Extension{Name: "sarq", Code: 0x67, Format: FormatRegReg}); err == nil {
+		t.Error("expected an extension with the opcode of opq to be rejected")
+	}
+	if err := RegisterExtension(Extension{Name: "sarq", Code: 0xe8, Format: FormatNone}); err == nil {
+		t.Error("expected an extension with the opcode of the system instructions to be rejected")
+	}
+
+	isa, err := ParseISA("default,shlq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu, pipe := loadBothISA(t, "irmovq $3, %rax\nirmovq $-1, %rbx\nshlq %rax, %rbx\nhalt\n", isa)
+	for _, p := range []Processor{cpu, pipe} {
+		p.Execute()
+		if p.Reg(3) != -8 || p.Flags() != (Flags{SF: true}) {
+			t.Errorf("%T: expected -8 with SF but got %d with %+v", p, p.Reg(3), p.Flags())
+		}
+	}
+
+	if lines := Disassemble([]byte{0xf0, 0x03}, 0, nil); lines[0].Text != "shlq %rax, %rbx" {
+		t.Errorf("expected shlq %%rax, %%rbx but got %s", lines[0].Text)
+	}
+}
@@ -0,0 +1,238 @@
+package model
+
+import (
+	"fmt"
+)
+
+// Implemented by processors that can execute backwards.
+type Rewinder interface {
+	SetHistory(size int)
+	HistorySize() int
+	History() (first int, last int)
+	StepBack() bool
+	GoToCycle(cycle int) error
+}
+
+// A register written by an instruction and its value before.
+type regUndo struct {
+	index byte
+	old   int64
+}
+
+// Bytes of memory written by an instruction and their values before.
+type memUndo struct {
+	addr int
+	old  []byte
+}
+
+// A timer and its registers before an instruction.
+type timerUndo struct {
+	timer *Timer
+	old   Timer
+}
+
+// Everything needed to undo an instruction.
+type undoEntry struct {
+	state        CpuState    // state before the instruction
+	cycles       int         // cycles executed before the instruction
+	instructions int         // instructions executed before the instruction
+	regs         []regUndo   // registers written, in order
+	mem          []memUndo   // memory written, in order
+	reads        []int       // addresses of the quads read
+	traps        trapUnit    // registers of the trap controller before the instruction
+	timers       []timerUndo // timers before the instruction
+	brk          int         // first address of free heap memory before the instruction
+	exitCode     int         // exit code before the instruction
+}
+
+// Undo log of the last instructions executed, kept in a ring buffer.
+type history struct {
+	size    int         // most instructions that can be undone, 0 to disable the log
+	entries []undoEntry // ring buffer
+	start   int         // index of the oldest entry
+	count   int         // number of entries in use
+}
+
+// Add an entry for an instruction about to be executed, replacing the oldest one if the log
+// is full.
+func (h *history) push(state CpuState, cycles int, instructions int) {
+	var e *undoEntry
+	switch {
+	case h.count < len(h.entries):
+		e = &h.entries[(h.start+h.count)%len(h.entries)]
+		h.count++
+	case len(h.entries) < h.size:
+		h.entries = append(h.entries, undoEntry{})
+		e = &h.entries[len(h.entries)-1]
+		h.count++
+	default:
+		e = &h.entries[h.start]
+		h.start = (h.start + 1) % len(h.entries)
+	}
+	// the slices of a replaced entry are reused
+	*e = undoEntry{state: state, cycles: cycles, instructions: instructions, regs: e.regs[:0], mem: e.mem[:0],
+		reads: e.reads[:0], timers: e.timers[:0]}
+}
+
+// Return the newest entry, or nil if the log is empty.
+func (h *history) last() *undoEntry {
+	if h.count == 0 {
+		return nil
+	}
+	return &h.entries[(h.start+h.count-1)%len(h.entries)]
+}
+
+// Remove the newest entry and return it. Returns false if the log is empty.
+func (h *history) pop() (undoEntry, bool) {
+	e := h.last()
+	if e == nil {
+		return undoEntry{}, false
+	}
+	h.count--
+	return *e, true
+}
+
+// Keep at most the last size instructions. A size of 0 disables the log.
+func (h *history) resize(size int) {
+	if size < 0 {
+		size = 0
+	}
+	keep := h.count
+	if keep > size {
+		keep = size
+	}
+	entries := make([]undoEntry, keep)
+	for i := range entries {
+		entries[i] = h.entries[(h.start+h.count-keep+i)%len(h.entries)]
+	}
+	*h = history{size: size, entries: entries, count: keep}
+}
+
+// Keep an undo log of the last size instructions executed so that the CPU can step backwards.
+// A size of 0 disables the log. The log is disabled by default.
+func (cpu *CPU) SetHistory(size int) {
+	cpu.history.resize(size)
+}
+
+// Return the number of instructions kept in the undo log.
+func (cpu *CPU) HistorySize() int {
+	return cpu.history.size
+}
+
+// Return the range of cycles that the CPU can go back to. The last cycle is the current one.
+func (cpu *CPU) History() (first int, last int) {
+	return cpu.cycles - cpu.history.count, cpu.cycles
+}
+
+// Undo the last cycle. Changes made to registers and memory with SetReg and WriteMem since
+// then are undone too. The trap controller and timers are restored, but reads and writes of
+// other devices are not undone. Returns false if the undo log is empty.
+//
+// The watchpoints that the undone instruction would hit are returned by WatchHits, so that
+// execution can run backwards to a watchpoint. The status is not changed to WCH.
+func (cpu *CPU) StepBack() bool {
+	e, ok := cpu.history.pop()
+	if !ok {
+		return false
+	}
+	cpu.state, cpu.cycles, cpu.instructions = e.state, e.cycles, e.instructions
+	if cpu.traps != nil {
+		*cpu.traps = e.traps
+	}
+	for _, t := range e.timers {
+		*t.timer = t.old
+	}
+	cpu.sys.brk, cpu.sys.exitCode = e.brk, e.exitCode
+	cpu.watch.hits = nil
+	watching := len(cpu.watch.points) > 0
+
+	for i := len(e.mem) - 1; i >= 0; i-- {
+		m := e.mem[i]
+		new, _ := cpu.mem.readLong(m.addr)
+		cpu.mem.writeBytes(m.addr, m.old)
+		if old, ok := cpu.mem.readLong(m.addr); watching && ok && len(m.old) == 8 {
+			cpu.checkMemWatch(m.addr, true, old, new)
+		}
+	}
+	for i := len(e.regs) - 1; i >= 0; i-- {
+		r := e.regs[i]
+		new := cpu.reg[r.index]
+		cpu.reg[r.index] = r.old
+		if watching {
+			cpu.checkRegWatch(r.index, r.old, new)
+		}
+	}
+	if watching {
+		for _, addr := range e.reads {
+			val, _ := cpu.mem.readLong(addr)
+			cpu.checkMemWatch(addr, false, val, val)
+		}
+	}
+	return true
+}
+
+// Go backwards or forwards until the CPU has executed a number of cycles. Watchpoints are
+// ignored. Returns an error if the cycle is older than the undo log or the program stops
+// before reaching it.
+func (cpu *CPU) GoToCycle(cycle int) error {
+	if first, _ := cpu.History(); cycle < first {
+		return fmt.Errorf("error: cycle %d is not in the history, the oldest cycle is %d", cycle, first)
+	}
+
+	for cpu.cycles > cycle {
+		cpu.StepBack()
+	}
+	for cpu.cycles < cycle {
+		cpu.Resume()
+		if status := cpu.Tick(); status != aok && status != wch {
+			cpu.watch.hits = nil
+			return fmt.Errorf("error: status %s at cycle %d", StatusName(status), cpu.cycles)
+		}
+	}
+	cpu.Resume()
+	return nil
+}
+
+// Start the undo log entry of the instruction about to be executed. The trap controller and
+// timers are saved since interrupts change them between instructions, and the heap and exit
+// code since the syscall instruction changes them.
+func (cpu *CPU) logTick() {
+	if cpu.history.size == 0 {
+		return
+	}
+	cpu.history.push(cpu.state, cpu.cycles, cpu.instructions)
+	e := cpu.history.last()
+	e.brk, e.exitCode = cpu.sys.brk, cpu.sys.exitCode
+	if cpu.traps != nil {
+		e.traps = *cpu.traps
+	}
+	for _, m := range cpu.Devices() {
+		if t, ok := m.Device.(*Timer); ok {
+			e.timers = append(e.timers, timerUndo{t, *t})
+		}
+	}
+}
+
+// Log the old value of a register about to be written.
+func (cpu *CPU) logReg(index byte) {
+	if e := cpu.history.last(); e != nil {
+		e.regs = append(e.regs, regUndo{index, cpu.reg[index]})
+	}
+}
+
+// Log the old contents of memory about to be written. Invalid addresses aren't logged since
+// the write fails.
+func (cpu *CPU) logMem(addr int, size int) {
+	if e := cpu.history.last(); e != nil {
+		if old, err := cpu.mem.readBytes(addr, size); err == nil {
+			e.mem = append(e.mem, memUndo{addr, old})
+		}
+	}
+}
+
+// Log the address of a quad read from memory.
+func (cpu *CPU) logRead(addr int) {
+	if e := cpu.history.last(); e != nil {
+		e.reads = append(e.reads, addr)
+	}
+}
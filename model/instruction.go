@@ -3,7 +3,7 @@ package model
 const (
 	halt   byte = iota // Halt cpu
 	nop                // Do nothing
-	rrmovq             // Move values between registers
+	rrmovq             // Move values between registers (cmovXX if the fcode is a condition)
 	irmovq             // Move a constant immediately to a register
 	rmmovq             // Move data from register to memory
 	mrmovq             // Move data from memory to register
@@ -15,6 +15,15 @@ const (
 	popq               // Pop from call stack
 )
 
+// System instructions, such as iret, which returns from a trap handler
+const system byte = 0xe
+
+// Fcodes of the system instructions
+const (
+	iret    byte = iota // Return from a trap handler
+	syscall             // Call a service of the host
+)
+
 // Alu flags
 const (
 	add byte = iota
@@ -26,7 +35,7 @@ const (
 	mod
 )
 
-// Conditional check flags
+// Conditional check flags of jXX and cmovXX
 const (
 	le = sub
 	l  = and
@@ -36,6 +45,51 @@ const (
 	g  = mod
 )
 
+// The operands of an instruction, which determine its size, how its bytes are laid out and
+// its assembly syntax.
+type Format byte
+
+const (
+	FormatNone   Format = iota // no operands, such as halt
+	FormatReg                  // one register stored in rA, such as pushq %rax
+	FormatRegReg               // two registers, such as addq %rax, %rbx
+	FormatImmReg               // a constant and register rB, such as irmovq $1, %rax
+	FormatRegMem               // register rA and a memory operand, such as rmmovq %rax, 8(%rbx)
+	FormatMemReg               // a memory operand and register rA, such as mrmovq 8(%rbx), %rax
+	FormatDest                 // a destination address, such as jmp loop
+)
+
+// Return the size in bytes of the instructions with a format.
+func (f Format) Size() int {
+	switch f {
+	case FormatNone:
+		return 1
+	case FormatReg, FormatRegReg:
+		return 2
+	case FormatDest:
+		return 9
+	default:
+		return 10
+	}
+}
+
+// Maps opcodes to the format of their instructions. Extensions add their opcodes to it.
+var formats = map[byte]Format{
+	halt:   FormatNone,
+	nop:    FormatNone,
+	rrmovq: FormatRegReg,
+	irmovq: FormatImmReg,
+	rmmovq: FormatRegMem,
+	mrmovq: FormatMemReg,
+	opq:    FormatRegReg,
+	jxx:    FormatDest,
+	call:   FormatDest,
+	ret:    FormatNone,
+	pushq:  FormatReg,
+	popq:   FormatReg,
+	system: FormatNone,
+}
+
 // Convert an 8 byte integer to a byte slice in little endiann format.
 func intToBytes(val int64) []byte {
 	const mask byte = 0xff
@@ -58,92 +112,53 @@ func bytesToInt(bytes []byte) int64 {
 	return res
 }
 
-// Create an instruction register from a byte slice.
+// Create an instruction register from a byte slice. The layout of the bytes depends on the
+// format of the opcode.
 func createInstReg(bytes []byte) instReg {
-	opcode := (bytes[0] & 0xf0) >> 4
-	fcode := bytes[0] & 0x0f
-
-	switch opcode {
-	case halt:
-		fallthrough
-	case nop:
-		fallthrough
-	case ret:
-		return instReg{
-			opcode: opcode,
-			fcode:  fcode,
-		}
-	case jxx:
-		fallthrough
-	case call:
-		return instReg{
-			opcode: opcode,
-			fcode:  fcode,
-			valC:   bytesToInt(bytes[1:8]),
-		}
-	case irmovq:
-		fallthrough
-	case rmmovq:
-		fallthrough
-	case mrmovq:
-		return instReg{
-			opcode: opcode,
-			fcode:  fcode,
-			rA:     (bytes[1] & 0xf0) >> 4,
-			rB:     bytes[1] & 0x0f,
-			valC:   bytesToInt(bytes[2:8]),
-		}
-	default:
-		return instReg{
-			opcode: opcode,
-			fcode:  fcode,
-			rA:     (bytes[1] & 0xf0) >> 4,
-			rB:     bytes[1] & 0x0f,
-		}
+	inst := instReg{
+		opcode: (bytes[0] & 0xf0) >> 4,
+		fcode:  bytes[0] & 0x0f,
+	}
+
+	switch formats[inst.opcode] {
+	case FormatDest:
+		inst.valC = bytesToInt(bytes[1:9])
+	case FormatImmReg, FormatRegMem, FormatMemReg:
+		inst.rA, inst.rB = (bytes[1]&0xf0)>>4, bytes[1]&0x0f
+		inst.valC = bytesToInt(bytes[2:10])
+	case FormatReg, FormatRegReg:
+		inst.rA, inst.rB = (bytes[1]&0xf0)>>4, bytes[1]&0x0f
 	}
+	return inst
 }
 
 // Construct a byte slice representation of the instruction using the instruction register paramters. Panics
 // if the parameters do not encode a valid instruction.
 func EncodeInst(opcode byte, fcode byte, rA byte, rB byte, constant int64) []byte {
-	if fcode > 6 {
+	format, ok := formats[opcode]
+	if !ok || fcode > 0xf || opcode <= popq && fcode > 6 {
 		panic("invalid instruction")
 	}
 
 	iByte := opcode<<4 | fcode
 	regByte := rA<<4 | rB
 
-	justIByte := []byte{iByte}
-	iByteAndReg := []byte{iByte, regByte}
-	iByteAndConst := append([]byte{iByte}, intToBytes(constant)...)
-	everything := append([]byte{iByte, regByte}, intToBytes(constant)...)
-
-	switch opcode {
-	case halt:
-		return justIByte
-	case nop:
-		return justIByte
-	case rrmovq:
-		return iByteAndReg
-	case irmovq:
-		return everything
-	case rmmovq:
-		return everything
-	case mrmovq:
-		return everything
-	case opq:
-		return iByteAndReg
-	case jxx:
-		return iByteAndConst
-	case call:
-		return iByteAndConst
-	case ret:
-		return justIByte
-	case pushq:
-		return iByteAndReg
-	case popq:
-		return iByteAndReg
+	switch format {
+	case FormatNone:
+		return []byte{iByte}
+	case FormatReg, FormatRegReg:
+		return []byte{iByte, regByte}
+	case FormatDest:
+		return append([]byte{iByte}, intToBytes(constant)...)
 	default:
-		panic("invalid instruction")
+		return append([]byte{iByte, regByte}, intToBytes(constant)...)
+	}
+}
+
+// Return the size in bytes of the instructions with an opcode or 0 if the opcode is invalid.
+func instructionSize(opcode byte) int {
+	if format, ok := formats[opcode]; ok {
+		return format.Size()
 	}
+	return 0
 }
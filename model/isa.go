@@ -0,0 +1,139 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// An instruction set: the instructions that the assembler accepts and the processors execute.
+// Processors raise INS when they fetch an instruction that isn't in their instruction set. A
+// nil ISA is the default instruction set.
+type ISA struct {
+	name  string        // name of the profile the instruction set was built from
+	codes map[byte]bool // instruction bytes (opcode and fcode) of the instructions
+}
+
+// The Y86-64 instruction set of CS:APP.
+var StrictISA = newISA("strict", baseCodes(func(info []byte) bool {
+	return info[0] != opq || info[1] <= xor
+}))
+
+// Y86-64 with the mulq, divq and modq instructions.
+var ExtendedISA = newISA("extended", baseCodes(func(info []byte) bool { return true }))
+
+// The instruction set used when none is selected, Y86-64 with mulq, divq and modq.
+var DefaultISA = ExtendedISA
+
+// Named instruction sets that ParseISA accepts.
+var profiles = map[string]*ISA{
+	"strict":   StrictISA,
+	"extended": ExtendedISA,
+	"default":  DefaultISA,
+}
+
+// Return the instruction bytes of the instructions of Y86-64 and its arithmetic extensions
+// that are selected by a function of their instructionTable entry.
+func baseCodes(selected func(info []byte) bool) []byte {
+	codes := []byte{}
+	for _, info := range instructionTable {
+		if info[0] <= popq && selected(info) {
+			codes = append(codes, info[0]<<4|info[1])
+		}
+	}
+	return codes
+}
+
+func newISA(name string, codes []byte) *ISA {
+	isa := &ISA{name, make(map[byte]bool)}
+	for _, code := range codes {
+		isa.codes[code] = true
+	}
+	return isa
+}
+
+// Create a custom instruction set with a name from a list of profiles and instructions. The
+// instruction set has the instructions of every profile and every instruction in the list,
+// except those preceded by a minus sign, which are removed. Returns an error if a name is
+// neither a profile nor an instruction.
+func NewISA(name string, instructions ...string) (*ISA, error) {
+	isa := newISA(name, nil)
+	for _, item := range instructions {
+		item = strings.TrimSpace(item)
+		remove := strings.HasPrefix(item, "-")
+		item = strings.TrimPrefix(item, "-")
+
+		var codes []byte
+		if profile, ok := profiles[item]; ok {
+			for code := range profile.codes {
+				codes = append(codes, code)
+			}
+		} else if info, ok := instructionTable[item]; ok {
+			codes = append(codes, info[0]<<4|info[1])
+		} else {
+			return nil, fmt.Errorf("error: unknown instruction set or instruction %s", item)
+		}
+
+		for _, code := range codes {
+			if remove {
+				delete(isa.codes, code)
+			} else {
+				isa.codes[code] = true
+			}
+		}
+	}
+	return isa, nil
+}
+
+// Parse an instruction set such as "strict", or a custom instruction set given as a comma
+// separated list of profiles and instructions such as "strict,iaddq,leave" or "extended,-modq".
+// Instructions preceded by a minus sign are removed.
+func ParseISA(spec string) (*ISA, error) {
+	if profile, ok := profiles[spec]; ok {
+		return profile, nil
+	}
+	return NewISA(spec, strings.Split(spec, ",")...)
+}
+
+// Return the name of the instruction set.
+func (isa *ISA) Name() string {
+	return isa.get().name
+}
+
+func (isa *ISA) String() string {
+	return isa.Name()
+}
+
+// Return true if an instruction such as addq is in the instruction set.
+func (isa *ISA) Has(name string) bool {
+	info, ok := instructionTable[name]
+	return ok && isa.hasCode(info[0]<<4|info[1])
+}
+
+// Return the names of the instructions in the instruction set in the order of their encoding.
+func (isa *ISA) Instructions() []string {
+	codes := []int{}
+	for code := range isa.get().codes {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	names := make([]string, len(codes))
+	for i, code := range codes {
+		names[i] = mnemonicTable[byte(code)]
+	}
+	return names
+}
+
+// Return true if the instruction with an instruction byte is in the instruction set.
+func (isa *ISA) hasCode(code byte) bool {
+	return isa.get().codes[code]
+}
+
+// Return the instruction set, or the default instruction set if it's nil.
+func (isa *ISA) get() *ISA {
+	if isa == nil {
+		return DefaultISA
+	}
+	return isa
+}
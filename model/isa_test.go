@@ -0,0 +1,78 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestISAProfiles(t *testing.T) {
+	testcases := []struct {
+		spec     string
+		size     int      // number of instructions
+		has      []string // instructions in the instruction set
+		hasNot   []string // instructions not in the instruction set
+		expected string   // name of the instruction set
+	}{
+		{"strict", 27, []string{"addq", "xorq", "cmovg", "popq"}, []string{"mulq", "divq", "modq", "iaddq"}, "strict"},
+		{"extended", 30, []string{"addq", "mulq", "divq", "modq"}, []string{"iaddq", "leave"}, "extended"},
+		{"default", 30, []string{"mulq"}, []string{"iaddq"}, "extended"},
+		{"strict,mulq,iaddq", 29, []string{"mulq", "iaddq"}, []string{"divq", "leave"}, "strict,mulq,iaddq"},
+		{"extended, -modq, leave", 30, []string{"divq", "leave"}, []string{"modq"}, "extended, -modq, leave"},
+	}
+
+	for _, tc := range testcases {
+		isa, err := ParseISA(tc.spec)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.spec, err)
+		}
+		if isa.Name() != tc.expected || len(isa.Instructions()) != tc.size {
+			t.Errorf("%s: expected %s with %d instructions but got %s with %v", tc.spec, tc.expected, tc.size,
+				isa.Name(), isa.Instructions())
+		}
+		for _, name := range tc.has {
+			if !isa.Has(name) {
+				t.Errorf("%s: expected %s to be in the instruction set", tc.spec, name)
+			}
+		}
+		for _, name := range tc.hasNot {
+			if isa.Has(name) {
+				t.Errorf("%s: expected %s not to be in the instruction set", tc.spec, name)
+			}
+		}
+	}
+
+	for _, spec := range []string{"", "textbook", "strict,-foo", "strict,,iaddq"} {
+		if _, err := ParseISA(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+}
+
+func TestStrictISA(t *testing.T) {
+	source := "irmovq $6, %rax\nirmovq $7, %rbx\nmulq %rax, %rbx\nhalt\n"
+	assembler := NewAssembler(source)
+	assembler.SetISA(StrictISA)
+	err := assembler.Assemble()
+	if err == nil || !strings.Contains(err.Error(), "3:1: error: instruction mulq is not in the strict instruction set") {
+		t.Errorf("expected mulq to be rejected but got %v", err)
+	}
+
+	// a program assembled for the extended instruction set stops with INS on a strict processor
+	cpu, pipe := loadBoth(t, source)
+	for _, p := range []Processor{cpu, pipe} {
+		p.Execute()
+		if p.Status() != hlt || p.Reg(3) != 42 {
+			t.Errorf("%T: expected mulq to compute 42 but got %d with status %s", p, p.Reg(3),
+				StatusName(p.Status()))
+		}
+
+		p.(interface{ SetISA(*ISA) }).SetISA(StrictISA)
+		assembler := NewAssembler(source)
+		assembler.Assemble()
+		assembler.Load(p)
+		p.Execute()
+		if p.Status() != ins || p.PC() != 20 || p.Reg(3) != 7 {
+			t.Errorf("%T: expected INS at 0x14 but got %s at %#x", p, StatusName(p.Status()), p.PC())
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package model
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+/*
+ * This file reads and writes .yo listing files, the output format of the yas assembler
+ * from CS:APP. Each line of a listing contains the address and the machine code of a
+ * line of source code followed by the source line itself:
+ *
+ *     0x000: 30f20a00000000000000 | irmovq $10,%rdx
+ */
+
+const listingBytesPerLine = 10                      // the machine code column holds the longest instruction
+const listingBlank = "                            " // a listing prefix without an address or machine code
+
+// Write the .yo listing of the assembled program. Source lines that did not generate an
+// address are written with a blank prefix.
+func (a *Assembler) WriteListing(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	lines := a.reporter.lines
+
+	// a trailing newline in the source does not start another line
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	for i, source := range lines {
+		source = strings.TrimRight(source, "\r")
+		entry, ok := a.parser.listing[uint(i+1)]
+		if !ok {
+			fmt.Fprintf(bw, "%s| %s\n", listingBlank, source)
+			continue
+		}
+
+		bytes := entry.bytes
+		address := entry.address
+		for {
+			n := len(bytes)
+			if n > listingBytesPerLine {
+				n = listingBytesPerLine
+			}
+			fmt.Fprintf(bw, "0x%03x: %-20s | %s\n", address, hex.EncodeToString(bytes[:n]), source)
+
+			bytes = bytes[n:]
+			address += n
+			source = ""
+			if len(bytes) == 0 {
+				break
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+// Read a .yo listing and copy its machine code into the memory of a processor. Execution
+// starts at address 0 as it does in the yis simulator. Returns an error that contains the line
+// number if the listing is malformed.
+func LoadListing(r io.Reader, p Processor) error {
+	image, err := ReadListing(r)
+	if err != nil {
+		return err
+	}
+	return p.Load(image)
+}
+
+// Read the machine code of a .yo listing into an image with a segment for each line.
+func ReadListing(r io.Reader) (*Image, error) {
+	scanner := bufio.NewScanner(r)
+	image := &Image{}
+	lineNum := 0
+
+	for scanner.Scan() {
+		lineNum++
+		address, bytes, err := parseListingLine(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		if len(bytes) == 0 {
+			continue
+		}
+		if !inBounds(address, len(bytes), MaxMemSize) {
+			return nil, fmt.Errorf("line %d: cannot write %d bytes to address %#x", lineNum, len(bytes), address)
+		}
+		image.Segments = append(image.Segments, Segment{address, bytes})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return image, nil
+}
+
+// Parse the address and machine code of a line in a .yo listing. Lines without machine
+// code return an empty byte slice.
+func parseListingLine(line string) (int, []byte, error) {
+	if bar := strings.IndexByte(line, '|'); bar >= 0 {
+		line = line[:bar]
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return 0, nil, nil
+	}
+
+	colon := strings.IndexByte(line, ':')
+	if colon < 0 {
+		return 0, nil, fmt.Errorf("expected address, got %q", line)
+	}
+
+	address, err := strconv.ParseInt(line[:colon], 0, 64)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid address %q", line[:colon])
+	}
+
+	bytes, err := hex.DecodeString(strings.TrimSpace(line[colon+1:]))
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid machine code %q", strings.TrimSpace(line[colon+1:]))
+	}
+	return int(address), bytes, nil
+}
@@ -0,0 +1,180 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+/*
+ * Memory is split into pages that are only allocated when a byte other than 0 is written to
+ * them, so a processor can have a large memory, such as one with the stack at 0x100000, and
+ * only use space for the pages that programs write. Pages that were never written read as 0.
+ */
+
+// Size of a page of memory in bytes.
+const pageSize = 4096
+
+// Largest memory of a processor: the 48-bit address space of x86-64 on 64-bit platforms and
+// 16 MiB on 32-bit platforms, where an int can't hold larger addresses.
+const MaxMemSize = 1 << (strconv.IntSize * 3 / 4)
+
+// Main memory.
+type memory struct {
+	size  int                     // number of bytes, 0 for MemSize
+	pages map[int]*[pageSize]byte // pages that have been written, by address / pageSize
+}
+
+// Return true if a range of addresses is inside a memory of a size. The check can't overflow
+// even if the address or size comes from a register.
+func inBounds(addr int, size int, limit int) bool {
+	return addr >= 0 && size >= 0 && addr <= limit && size <= limit-addr
+}
+
+// Return a memory of a size, or an error if the size is invalid.
+func newMemory(size int) (memory, error) {
+	if size <= 0 || size > MaxMemSize {
+		return memory{}, fmt.Errorf("error: invalid memory size %#x, the largest is %#x", size, MaxMemSize)
+	}
+	return memory{size: size}, nil
+}
+
+// Return the number of bytes of memory.
+func (m *memory) limit() int {
+	if m.size == 0 {
+		return MemSize
+	}
+	return m.size
+}
+
+// Return true if a range of addresses is inside memory.
+func (m *memory) valid(addr int, size int) bool {
+	return inBounds(addr, size, m.limit())
+}
+
+// Call a function with each page that a valid range of addresses overlaps, the first and last
+// offsets in the page of the part inside the range and the offset of that part in the range.
+func (m *memory) eachPage(addr int, size int, f func(n int, start int, end int, offset int)) {
+	for offset := 0; offset < size; {
+		n, start := (addr+offset)/pageSize, (addr+offset)%pageSize
+		end := start + size - offset
+		if end > pageSize {
+			end = pageSize
+		}
+		f(n, start, end, offset)
+		offset += end - start
+	}
+}
+
+// Return a page, allocating it if it was never written.
+func (m *memory) page(n int) *[pageSize]byte {
+	if m.pages == nil {
+		m.pages = make(map[int]*[pageSize]byte)
+	}
+	p, ok := m.pages[n]
+	if !ok {
+		p = &[pageSize]byte{}
+		m.pages[n] = p
+	}
+	return p
+}
+
+// Return the little endiann 8-byte int at an address, or false if the address is invalid.
+func (m *memory) readLong(addr int) (int64, bool) {
+	bytes, err := m.readBytes(addr, 8)
+	if err != nil {
+		return 0, false
+	}
+	return bytesToInt(bytes), true
+}
+
+// Write a little endiann 8-byte int to memory at an address. Returns false if the address is invalid.
+func (m *memory) writeLong(addr int, val int64) bool {
+	return m.writeBytes(addr, intToBytes(val)) == nil
+}
+
+// Read a sequence of bytes from memory.
+func (m *memory) readBytes(addr int, size int) ([]byte, error) {
+	if !m.valid(addr, size) {
+		return nil, fmt.Errorf("error: address %#x is invalid", addr)
+	}
+
+	bytes := make([]byte, size)
+	m.eachPage(addr, size, func(n int, start int, end int, offset int) {
+		if p, ok := m.pages[n]; ok {
+			copy(bytes[offset:], p[start:end])
+		}
+	})
+	return bytes, nil
+}
+
+// Write a sequence of bytes to memory. Writing zeros to pages that were never written doesn't
+// allocate them.
+func (m *memory) writeBytes(addr int, bytes []byte) error {
+	if !m.valid(addr, len(bytes)) {
+		return fmt.Errorf("error: cannot write %d bytes to address %#x", len(bytes), addr)
+	}
+
+	m.eachPage(addr, len(bytes), func(n int, start int, end int, offset int) {
+		part := bytes[offset : offset+end-start]
+		if _, ok := m.pages[n]; ok || !isZero(part) {
+			copy(m.page(n)[start:end], part)
+		}
+	})
+	return nil
+}
+
+// A page of memory that has been written.
+type MemPage struct {
+	Addr int    // address of the first byte
+	Data []byte // contents, shorter than a page at the end of memory
+}
+
+// Return copies of the pages that have been written, sorted by address.
+func (m *memory) written() []MemPage {
+	ns := make([]int, 0, len(m.pages))
+	for n := range m.pages {
+		ns = append(ns, n)
+	}
+	sort.Ints(ns)
+
+	pages := make([]MemPage, len(ns))
+	for i, n := range ns {
+		addr, size := n*pageSize, pageSize
+		if addr+size > m.limit() {
+			size = m.limit() - addr
+		}
+		pages[i] = MemPage{addr, append([]byte{}, m.pages[n][:size]...)}
+	}
+	return pages
+}
+
+// Return the first address after the last byte other than 0, or 0 if every byte is 0.
+func (m *memory) used() int {
+	end := 0
+	for n, p := range m.pages {
+		for i := pageSize - 1; i >= 0 && n*pageSize+i >= end; i-- {
+			if p[i] != 0 {
+				end = n*pageSize + i + 1
+				break
+			}
+		}
+	}
+	return end
+}
+
+// Return a copy of the whole memory.
+func (m *memory) bytes() []byte {
+	bytes, _ := m.readBytes(0, m.limit())
+	return bytes
+}
+
+// Return true if every byte is 0.
+func isZero(bytes []byte) bool {
+	for _, b := range bytes {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
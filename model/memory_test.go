@@ -0,0 +1,102 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestMemoryBounds(t *testing.T) {
+	cpu := &CPU{}
+	if err := cpu.CopyBuf(MemSize-2, []byte{1, 2}); err != nil {
+		t.Errorf("expected the last byte of memory to be writable, got %v", err)
+	}
+	if b, err := cpu.ReadMem(MemSize-1, 1); err != nil || b[0] != 2 {
+		t.Errorf("expected to read the last byte of memory, got %v, %v", b, err)
+	}
+
+	maxInt := int(^uint(0) >> 1)
+	for _, tc := range []struct{ addr, size int }{
+		{MemSize - 1, 2}, {-1, 1}, {0, -1}, {maxInt - 3, 8}, {8, maxInt},
+	} {
+		if _, err := cpu.ReadMem(tc.addr, tc.size); err == nil {
+			t.Errorf("expected reading %d bytes at %#x to fail", tc.size, tc.addr)
+		}
+	}
+	for _, addr := range []int{MemSize - 1, -1} {
+		if err := cpu.CopyBuf(addr, []byte{1, 2}); err == nil {
+			t.Errorf("expected CopyBuf at %#x to fail", addr)
+		}
+	}
+	for _, addr := range []int{MemSize - 7, -1, maxInt - 3} {
+		cpu.state.status = aok
+		if cpu.readMem(addr); cpu.state.status != adr {
+			t.Errorf("expected reading a quad at %#x to raise ADR", addr)
+		}
+	}
+}
+
+func TestMemorySize(t *testing.T) {
+	source := `
+	irmovq 0x100000, %rsp
+	irmovq $3, %rax
+	call f
+	halt
+f:	pushq %rax
+	popq %rbx
+	ret
+`
+	cpu, pipe := loadBoth(t, source)
+	if cpu.Execute(); cpu.Status() != adr {
+		t.Errorf("expected ADR with the default memory but got %s", StatusName(cpu.Status()))
+	}
+
+	for _, p := range []interface {
+		Processor
+		SetMemSize(size int) error
+	}{cpu, pipe} {
+		if err := p.SetMemSize(0x200000); err != nil {
+			t.Fatal(err)
+		}
+		assembler := NewAssembler(source)
+		assembler.Assemble()
+		assembler.Load(p)
+		if err := p.Execute(); err != nil || p.Reg(3) != 3 || p.MemorySize() != 0x200000 {
+			t.Errorf("%T: expected the stack at 0x100000 to work, got %v", p, err)
+		}
+		for _, size := range []int{0, -1, MaxMemSize + 1} {
+			if err := p.SetMemSize(size); err == nil {
+				t.Errorf("%T: expected size %#x to be rejected", p, size)
+			}
+		}
+	}
+
+	// only the pages that were written are allocated
+	if len(cpu.mem.pages) != 2 {
+		t.Errorf("expected 2 pages but got %d", len(cpu.mem.pages))
+	}
+	cpu.WriteMem(0x10000, make([]byte, 3*pageSize))
+	if len(cpu.mem.pages) != 2 {
+		t.Errorf("expected writing zeros not to allocate pages but got %d", len(cpu.mem.pages))
+	}
+	if pages := cpu.MemPages(); len(pages) != 2 || pages[0].Addr != 0 || pages[1].Addr != 0xff000 ||
+		len(pages[1].Data) != pageSize || pages[1].Data[pageSize-16] != 3 {
+		t.Errorf("expected copies of the pages at 0 and 0xff000 but got %d pages", len(pages))
+	}
+	if err := cpu.SetMemSize(MaxMemSize); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.WriteMem(MaxMemSize-8, []byte{1, 2, 3, 4, 5, 6, 7, 8}); err != nil ||
+		cpu.readMem(MaxMemSize-8) != 0x0807060504030201 {
+		t.Errorf("expected the end of the largest memory to be writable, got %v", err)
+	}
+
+	// shrinking memory keeps devices unless they would be outside of it
+	if err := cpu.AttachDevice(0x8000, NewConsole(nil, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.SetMemSize(0x8000); err == nil {
+		t.Error("expected the console to be outside of memory")
+	}
+	if err := cpu.SetMemSize(0x9000); err != nil || len(cpu.Devices()) != 1 || cpu.MemorySize() != 0x9000 {
+		t.Errorf("expected the console to be kept, got %v", err)
+	}
+}
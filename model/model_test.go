@@ -3,12 +3,17 @@ package model
 import (
 	"bytes"
 	"math"
+	"reflect"
+	"strings"
 	"testing"
+	"y86/object"
+	"y86/snapshot"
+	"y86/trace"
 )
 
 var haltState CpuState = CpuState{
 	valP:   1,
-	pc:     1,
+	pc:     0,
 	status: hlt,
 }
 
@@ -155,9 +160,9 @@ func TestWriteMem(t *testing.T) {
 	cpu.writeLongToMem(addr, val)
 
 	var readVal int64 = 0
+	bytes, _ := cpu.mem.readBytes(addr, 8)
 	for i := 7; i >= 0; i-- {
-		byte := cpu.mem[addr+i]
-		readVal += int64(byte)
+		readVal += int64(bytes[i])
 		readVal = readVal << 8
 	}
 	readVal = readVal >> 8
@@ -166,9 +171,10 @@ func TestWriteMem(t *testing.T) {
 		t.Errorf("expected %#x but got %#x\n", val, readVal)
 	}
 
-	for i := 8; uint16(i) < maxMem; i++ {
-		if cpu.mem[i] != 0 {
-			t.Errorf("memory at %#x has a val %#x when it should be 0\n", uint16(i), cpu.mem[i])
+	mem := cpu.GetMem()
+	for i := 8; i < len(mem); i++ {
+		if mem[i] != 0 {
+			t.Errorf("memory at %#x has a val %#x when it should be 0\n", i, mem[i])
 		}
 	}
 
@@ -176,7 +182,7 @@ func TestWriteMem(t *testing.T) {
 
 func TestWriteMemBadAddr(t *testing.T) {
 	cpu := CPU{}
-	addr := maxMem + 1
+	addr := MemSize + 1
 	cpu.writeLongToMem(addr, 0)
 
 	if cpu.state.status != adr {
@@ -200,7 +206,7 @@ func TestReadMem(t *testing.T) {
 
 func TestReadMemBadAddr(t *testing.T) {
 	cpu := CPU{}
-	addr := maxMem - 3
+	addr := MemSize - 3
 	cpu.readMem(addr)
 
 	if cpu.state.status != adr {
@@ -305,3 +311,736 @@ func TestTick(t *testing.T) {
 		})
 	}
 }
+
+func TestAssembleAllInstructions(t *testing.T) {
+	src := `.pos 0x100
+main:
+	halt
+	nop
+	rrmovq %rax, %rcx
+	irmovq 16, %rsp
+	rmmovq %rdx, 8(%rbx)
+	mrmovq (%rbp), %rsi
+	subq %rdi, %r8
+	jne main
+	call end
+	ret
+	pushq %r9
+	popq %r10
+end:
+	jmp main
+`
+	expected := [][]byte{
+		EncodeInst(halt, 0, 0, 0, 0),
+		EncodeInst(nop, 0, 0, 0, 0),
+		EncodeInst(rrmovq, 0, 0, 1, 0),
+		EncodeInst(irmovq, 0, 0xf, 4, 16),
+		EncodeInst(rmmovq, 0, 2, 3, 8),
+		EncodeInst(mrmovq, 0, 6, 5, 0),
+		EncodeInst(opq, sub, 7, 8, 0),
+		EncodeInst(jxx, ne, 0, 0, 0x100),
+		EncodeInst(call, 0, 0, 0, 0x13b),
+		EncodeInst(ret, 0, 0, 0, 0),
+		EncodeInst(pushq, 0, 9, 0xf, 0),
+		EncodeInst(popq, 0, 10, 0xf, 0),
+		EncodeInst(jxx, 0, 0, 0, 0x100),
+	}
+
+	assembler := NewAssembler(src)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+
+	if start := assembler.parser.GetStart(); start != 0x100 {
+		t.Errorf("expected entry point %#x but got %#x\n", 0x100, start)
+	}
+
+	instructions := assembler.parser.GetInstructionBuffer()
+	locations := assembler.parser.GetLocations()
+	if len(instructions) != len(expected) {
+		t.Fatalf("expected %d instructions but got %d\n", len(expected), len(instructions))
+	}
+
+	address := 0x100
+	for i, inst := range instructions {
+		if !bytes.Equal(inst, expected[i]) {
+			t.Errorf("instruction %d: expected %x but got %x\n", i, expected[i], inst)
+		}
+		if locations[i] != address {
+			t.Errorf("instruction %d: expected address %#x but got %#x\n", i, address, locations[i])
+		}
+		address += len(expected[i])
+	}
+}
+
+func TestAssembleReportsAllDiagnostics(t *testing.T) {
+	src := `.pos 0x100
+	addq %rax
+	jmp nowhere
+	halt
+	.pos 0x10
+	nop
+`
+	expected := []struct {
+		line     uint
+		col      uint
+		severity Severity
+	}{
+		{2, 2, SeverityError},
+		{3, 6, SeverityError},
+		{5, 2, SeverityWarning},
+	}
+
+	assembler := NewAssembler(src)
+	assembler.SetFilename("test.asm")
+	err := assembler.Assemble()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	diags := assembler.Diagnostics()
+	if len(diags) != len(expected) {
+		t.Fatalf("expected %d diagnostics but got %d:\n%v\n", len(expected), len(diags), diags)
+	}
+
+	for i, diag := range diags {
+		if diag.Line != expected[i].line || diag.Col != expected[i].col || diag.Severity != expected[i].severity {
+			t.Errorf("expected %+v but got %+v\n", expected[i], diag)
+		}
+	}
+
+	// the valid instructions after the errors are still assembled
+	if n := len(assembler.parser.GetInstructionBuffer()); n != 2 {
+		t.Errorf("expected 2 instructions but got %d\n", n)
+	}
+}
+
+func TestDirectiveMissingOperand(t *testing.T) {
+	// the operand must be on the line of the directive, so the instructions after are kept
+	assembler := NewAssembler("\t.pos\n\thalt\n\t.quad\n\t.global\n\tnop\n")
+	if err := assembler.Assemble(); err == nil {
+		t.Fatal("expected an error")
+	}
+	diags := assembler.Diagnostics()
+	if len(diags) != 3 {
+		t.Fatalf("expected 3 diagnostics but got %d:\n%v\n", len(diags), diags)
+	}
+	for i, line := range []uint{1, 3, 4} {
+		if diags[i].Line != line || diags[i].Col != 2 || diags[i].Severity != SeverityError {
+			t.Errorf("expected an error at line %d but got %+v\n", line, diags[i])
+		}
+	}
+	if n := len(assembler.parser.GetInstructionBuffer()); n != 2 {
+		t.Errorf("expected 2 instructions but got %d\n", n)
+	}
+}
+
+// The asum.ys example from chapter 4 of CS:APP.
+const asumSource = `# Execution begins at address 0
+	.pos 0
+	irmovq stack, %rsp  	# Set up stack pointer
+	call main		# Execute main program
+	halt			# Terminate program
+
+# Array of 4 elements
+	.align 8
+array:	.quad 0x000d000d000d
+	.quad 0x00c000c000c0
+	.quad 0x0b000b000b00
+	.quad 0xa000a000a000
+
+main:	irmovq array,%rdi
+	irmovq $4,%rsi
+	call sum		# sum(array, 4)
+	ret
+
+/* long sum(long *start, long count)
+ * start in %rdi, count in %rsi */
+sum:	irmovq $8,%r8        # Constant 8
+	irmovq $1,%r9	     # Constant 1
+	xorq %rax,%rax	     # sum = 0
+	andq %rsi,%rsi	     # Set CC
+	jmp     test         # Goto test
+loop:	mrmovq (%rdi),%r10   // Get *start
+	addq %r10,%rax       # Add to sum
+	addq %r8,%rdi        # start++
+	subq %r9,%rsi        # count--.  Set CC
+test:	jne    loop          # Stop when 0
+	ret                  # Return
+
+# Stack starts here and grows to lower addresses
+	.pos 0x200
+stack:
+`
+
+func TestAssembleTextbookSource(t *testing.T) {
+	assembler := NewAssembler(asumSource)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+
+	symbols := map[string]int{
+		"array": 0x18,
+		"main":  0x38,
+		"sum":   0x56,
+		"loop":  0x77,
+		"test":  0x87,
+		"stack": 0x200,
+	}
+	for name, address := range symbols {
+		if actual := assembler.parser.symbolTable[name]; actual != address {
+			t.Errorf("expected %s at %#x but got %#x\n", name, address, actual)
+		}
+	}
+
+	if val := assembler.parser.dataTable[0x30]; val != 0xa000a000a000 {
+		t.Errorf("expected %#x but got %#x\n", 0xa000a000a000, val)
+	}
+}
+
+func TestScanComments(t *testing.T) {
+	src := "halt # comment\n/* block\n comment */ nop // comment\n\tret"
+	expected := []Token{
+		NewToken(instruction, "halt", 1, 1),
+		NewToken(instruction, "nop", 3, 13),
+		NewToken(instruction, "ret", 4, 2),
+		NewToken(eof, "", 4, 5),
+	}
+
+	scanner := NewScanner(src)
+	if err := scanner.scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(scanner.tokens) != len(expected) {
+		t.Fatalf("expected %v but got %v\n", expected, scanner.tokens)
+	}
+	for i, token := range scanner.tokens {
+		if token != expected[i] {
+			t.Errorf("expected %+v but got %+v\n", expected[i], token)
+		}
+	}
+}
+
+func TestScanUnterminatedComment(t *testing.T) {
+	scanner := NewScanner("halt\n  /* never closed\n")
+	err := scanner.scan()
+	diags, ok := err.(Diagnostics)
+	if !ok || len(diags) != 1 || diags[0].Line != 2 || diags[0].Col != 3 {
+		t.Errorf("expected an unterminated comment error at [2:3] but got %v\n", err)
+	}
+}
+
+func TestWriteListing(t *testing.T) {
+	assembler := NewAssembler(asumSource)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := assembler.WriteListing(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(buf.String(), "\n")
+	expected := map[int]string{
+		0:  "                            | # Execution begins at address 0",
+		1:  "0x000:                      | \t.pos 0",
+		2:  "0x000: 30f40002000000000000 | \tirmovq stack, %rsp  \t# Set up stack pointer",
+		3:  "0x00a: 803800000000000000   | \tcall main\t\t# Execute main program",
+		4:  "0x013: 00                   | \thalt\t\t\t# Terminate program",
+		7:  "0x018:                      | \t.align 8",
+		8:  "0x018: 0d000d000d000000     | array:\t.quad 0x000d000d000d",
+		34: "0x200:                      | stack:",
+	}
+	for i, line := range expected {
+		if lines[i] != line {
+			t.Errorf("line %d: expected %q but got %q\n", i+1, line, lines[i])
+		}
+	}
+}
+
+func TestLoadListing(t *testing.T) {
+	assembler := NewAssembler(asumSource)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	assembler.WriteListing(&buf)
+
+	expected := CPU{}
+	assembler.Load(&expected)
+
+	cpu := CPU{}
+	if err := LoadListing(&buf, &cpu); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cpu.GetMem(), expected.GetMem()) {
+		t.Error("memory loaded from the listing differs from the assembled program")
+	}
+}
+
+func TestLoadListingMalformed(t *testing.T) {
+	src := "0x000: 00 | halt\n0x001: zz | nop\n"
+	if err := LoadListing(strings.NewReader(src), &CPU{}); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("expected an error on line 2 but got %v\n", err)
+	}
+}
+
+func TestObjectFile(t *testing.T) {
+	assembler := NewAssembler(asumSource)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+
+	f := assembler.Object()
+	sections := []struct {
+		kind object.SectionKind
+		addr uint64
+		size int
+	}{
+		{object.Code, 0x0, 0x14},
+		{object.Data, 0x18, 0x20},
+		{object.Code, 0x38, 0x59},
+	}
+	if len(f.Sections) != len(sections) {
+		t.Fatalf("expected %d sections but got %d\n", len(sections), len(f.Sections))
+	}
+	for i, s := range sections {
+		actual := f.Sections[i]
+		if actual.Kind != s.kind || actual.Addr != s.addr || len(actual.Data) != s.size {
+			t.Errorf("section %d: expected %+v but got %v %#x %#x\n", i, s, actual.Kind, actual.Addr, len(actual.Data))
+		}
+	}
+
+	// irmovq stack, call main, irmovq array, call sum, jmp test, jne loop
+	if len(f.Relocations) != 6 {
+		t.Errorf("expected 6 relocations but got %d\n", len(f.Relocations))
+	}
+	if i := f.Lookup("stack"); i < 0 || f.Symbols[i].Section != object.Absolute {
+		t.Errorf("expected stack to be an absolute symbol")
+	}
+	if line, _ := f.LineAt(0x77); line != 26 {
+		t.Errorf("expected address 0x77 to be on line 26 but got %d\n", line)
+	}
+
+	var buf bytes.Buffer
+	if err := object.Encode(&buf, f); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := object.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := CPU{}
+	assembler.Load(&expected)
+	cpu := CPU{}
+	if err := LoadObject(decoded, &cpu); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(cpu.GetMem(), expected.GetMem()) || cpu.state.pc != expected.state.pc {
+		t.Error("the loaded object file differs from the assembled program")
+	}
+}
+
+func TestAssembleLinkageDirectives(t *testing.T) {
+	src := `.global main, missing
+.extern print, main
+main:
+	call print
+	halt
+`
+	assembler := NewAssembler(src)
+	assembler.Assemble()
+
+	diags := assembler.Diagnostics()
+	if len(diags) != 2 || diags[0].Line != 1 || diags[1].Line != 2 {
+		t.Fatalf("expected errors on lines 1 and 2 but got:\n%v\n", diags)
+	}
+
+	f := assembler.Object()
+	if i := f.Lookup("print"); i < 0 || f.Symbols[i].Defined() {
+		t.Error("expected print to be an undefined symbol")
+	}
+	if i := f.Lookup("main"); i < 0 || !f.Symbols[i].Global {
+		t.Error("expected main to be a global symbol")
+	}
+	if err := assembler.Load(&CPU{}); err == nil {
+		t.Error("expected an error when loading a program with undefined symbols")
+	}
+}
+
+func TestDisassemble(t *testing.T) {
+	code := append(EncodeInst(irmovq, 0, 0xf, 4, 0x200), EncodeInst(call, 0, 0, 0, 0x20)...)
+	code = append(code, 0xff)
+	code = append(code, EncodeInst(rmmovq, 0, 0, 3, -8)...)
+	code = append(code, 0x6f)
+	// register 0xf is no register, and fetch ignores the fcode of pushq and irmovq
+	code = append(code, EncodeInst(pushq, 0, 0xf, 0xf, 0)...)
+	code = append(code, 0xa5, 0x0f)
+	code = append(code, EncodeInst(irmovq, 0, 0xf, 0xf, 1)...)
+	code[len(code)-10] = 0x31
+
+	expected := []struct {
+		address int
+		text    string
+		valid   bool
+	}{
+		{0x10, "irmovq $512, %rsp", true},
+		{0x1a, "call sum", true},
+		{0x23, ".byte 0xff", false},
+		{0x24, "rmmovq %rax, -8(%rbx)", true},
+		{0x2e, ".byte 0x6f", false},
+		{0x2f, "pushq %none", true},
+		{0x31, "pushq %rax", true},
+		{0x33, "irmovq $1, %none", true},
+	}
+
+	lines := Disassemble(code, 0x10, map[int][]string{0x20: {"sum"}})
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %d lines but got %d: %+v\n", len(expected), len(lines), lines)
+	}
+	for i, line := range lines {
+		if line.Address != expected[i].address || line.Text != expected[i].text || line.Valid != expected[i].valid {
+			t.Errorf("expected %+v but got %+v\n", expected[i], line)
+		}
+	}
+
+	// the assembler doesn't name register 0xf either
+	if err := NewAssembler("pushq %r15\n").Assemble(); err == nil {
+		t.Error("expected %r15 to be rejected")
+	}
+}
+
+func TestDisassembleObject(t *testing.T) {
+	assembler := NewAssembler(asumSource)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := DisassembleObject(assembler.Object())
+	var buf bytes.Buffer
+	WriteDisassembly(&buf, lines)
+	listing := buf.String()
+
+	expected := []string{
+		"0x00a: 803800000000000000   |     call main\n",
+		"0x018:                      | array:\n",
+		"0x018: 0d000d000d000000     |     .quad 0xd000d000d\n",
+		"0x077: 50a70000000000000000 |     mrmovq 0(%rdi), %r10\n",
+		"0x087: 747700000000000000   |     jne loop\n",
+	}
+	for _, line := range expected {
+		if !strings.Contains(listing, line) {
+			t.Errorf("expected the disassembly to contain %q:\n%s", line, listing)
+		}
+	}
+}
+
+func TestDisassembleBadRange(t *testing.T) {
+	cpu := CPU{}
+	if _, err := cpu.Disassemble(0x10, MemSize+1, nil); err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestWatchpoints(t *testing.T) {
+	source := `	irmovq $5, %rax
+	rmmovq %rax, 0x100(%rbx)
+	mrmovq 0x100(%rbx), %rcx
+	irmovq $6, %rax
+	irmovq $7, %rax
+	halt
+`
+	assembler := NewAssembler(source)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	cpu := CPU{}
+	assembler.Load(&cpu)
+
+	watches := []Watchpoint{
+		{Kind: WatchWrite, Addr: 0x100, Size: 8},
+		{Kind: WatchRead, Addr: 0x104, Size: 1},
+		{Kind: WatchReg, Reg: 0, Cond: true, Value: 7},
+	}
+	for _, w := range watches {
+		if _, err := cpu.AddWatch(w); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []WatchHit{
+		{PC: 0x0a, Addr: 0x100, Write: true, Old: 0, New: 5},
+		{PC: 0x14, Addr: 0x100, Write: false, Old: 5, New: 5},
+		{PC: 0x28, Addr: 0, Write: true, Old: 6, New: 7},
+	}
+	for i, hit := range expected {
+		if err := cpu.Execute(); err == nil || cpu.Status() != StatusWCH {
+			t.Fatalf("expected watchpoint %d to stop execution but got status %s", i+1, StatusName(cpu.Status()))
+		}
+		hits := cpu.WatchHits()
+		hit.Watch = watches[i]
+		hit.Watch.ID = i + 1
+		if len(hits) != 1 || hits[0] != hit {
+			t.Errorf("expected %v but got %v", hit, hits)
+		}
+		cpu.Resume()
+	}
+
+	if err := cpu.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if !cpu.RemoveWatch(2) || cpu.RemoveWatch(2) || len(cpu.Watches()) != 2 {
+		t.Error("expected watchpoint 2 to be removed once")
+	}
+	if _, err := cpu.AddWatch(Watchpoint{Kind: WatchWrite, Addr: MemSize - 4, Size: 8}); err == nil {
+		t.Error("expected an error for a watchpoint out of range")
+	}
+}
+
+// Collects trace records.
+type traceRecorder []trace.Record
+
+func (r *traceRecorder) Trace(rec *trace.Record) {
+	*r = append(*r, *rec)
+}
+
+func TestTrace(t *testing.T) {
+	assembler := NewAssembler(`
+	irmovq $0x100, %rsp
+	irmovq $5, %rax
+	pushq %rax
+	halt
+`)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	cpu := CPU{}
+	var records traceRecorder
+	cpu.SetTracer(&records)
+	assembler.Load(&cpu)
+	cpu.Execute()
+
+	expected := []trace.Record{
+		{Cycle: 1, PC: 0, Inst: "irmovq $256, %rsp", Icode: irmovq, RA: 0xf, RB: 4, ValC: 0x100, ValE: 0x100,
+			Regs: []trace.RegWrite{{Reg: 4, Value: 0x100}}, ZF: true},
+		{Cycle: 2, PC: 0xa, Inst: "irmovq $5, %rax", Icode: irmovq, RA: 0xf, RB: 0, ValC: 5, ValE: 5,
+			Regs: []trace.RegWrite{{Reg: 0, Value: 5}}, ZF: true},
+		{Cycle: 3, PC: 0x14, Inst: "pushq %rax", Icode: pushq, RA: 0, RB: 0xf, ValA: 5, ValB: 0x100, ValE: 0xf8,
+			Regs: []trace.RegWrite{{Reg: 4, Value: 0xf8}}, Mem: []trace.MemWrite{{Addr: 0xf8, Value: 5}}, ZF: true},
+		{Cycle: 4, PC: 0x16, Inst: "halt", Icode: halt, ZF: true, Status: hlt},
+	}
+	if !reflect.DeepEqual([]trace.Record(records), expected) {
+		t.Errorf("expected\n%+v\nbut got\n%+v", expected, records)
+	}
+}
+
+// State of a CPU compared when stepping backwards.
+type cpuSnapshot struct {
+	mem          string
+	reg          registerFile
+	state        CpuState
+	cycles       int
+	instructions int
+}
+
+func takeSnapshot(cpu *CPU) cpuSnapshot {
+	return cpuSnapshot{string(cpu.GetMem()), cpu.reg, cpu.state, cpu.cycles, cpu.instructions}
+}
+
+func TestStepBack(t *testing.T) {
+	assembler := NewAssembler(asumSource)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	cpu := CPU{}
+	cpu.SetHistory(1000)
+	assembler.Load(&cpu)
+
+	snapshots := []cpuSnapshot{takeSnapshot(&cpu)}
+	for cpu.Tick() == aok {
+		snapshots = append(snapshots, takeSnapshot(&cpu))
+	}
+	snapshots = append(snapshots, takeSnapshot(&cpu))
+	if first, last := cpu.History(); first != 0 || last != len(snapshots)-1 {
+		t.Fatalf("expected cycles 0 to %d in the history but got %d to %d", len(snapshots)-1, first, last)
+	}
+
+	for i := len(snapshots) - 2; i >= 0; i-- {
+		if !cpu.StepBack() {
+			t.Fatalf("expected to step back to cycle %d", i)
+		}
+		if takeSnapshot(&cpu) != snapshots[i] {
+			t.Fatalf("state after stepping back to cycle %d differs", i)
+		}
+	}
+	if cpu.StepBack() {
+		t.Error("expected stepping back past cycle 0 to fail")
+	}
+
+	if err := cpu.GoToCycle(10); err != nil || takeSnapshot(&cpu) != snapshots[10] {
+		t.Errorf("expected to go forward to cycle 10, got %v", err)
+	}
+	cpu.SetReg(0, 42)
+	if err := cpu.GoToCycle(5); err != nil || takeSnapshot(&cpu) != snapshots[5] {
+		t.Errorf("expected to go back to cycle 5 and undo SetReg, got %v", err)
+	}
+	if err := cpu.GoToCycle(len(snapshots)); err == nil {
+		t.Error("expected an error for a cycle after the program halts")
+	}
+}
+
+func TestHistorySize(t *testing.T) {
+	assembler := NewAssembler(asumSource)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	cpu := CPU{}
+	assembler.Load(&cpu)
+	cpu.Tick()
+	if cpu.StepBack() {
+		t.Error("expected the history to be disabled by default")
+	}
+
+	cpu.SetHistory(5)
+	cpu.Execute()
+	_, last := cpu.History()
+	if first, _ := cpu.History(); first != last-5 {
+		t.Errorf("expected 5 cycles of history but got %d", last-first)
+	}
+	if err := cpu.GoToCycle(last - 6); err == nil {
+		t.Error("expected an error for a cycle older than the history")
+	}
+
+	cpu.SetHistory(2)
+	if first, _ := cpu.History(); first != last-2 {
+		t.Errorf("expected the history to shrink to 2 cycles but got %d", last-first)
+	}
+	assembler.Load(&cpu)
+	if first, last := cpu.History(); first != 0 || last != 0 || cpu.HistorySize() != 2 {
+		t.Error("expected Load to clear the history and keep its size")
+	}
+}
+
+func TestStepBackToWatchpoint(t *testing.T) {
+	assembler := NewAssembler(`
+	irmovq $5, %rax
+	rmmovq %rax, 0x100(%rbx)
+	irmovq $6, %rax
+	mrmovq 0x100(%rbx), %rcx
+	halt
+`)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	cpu := CPU{}
+	cpu.SetHistory(100)
+	assembler.Load(&cpu)
+	cpu.Execute()
+	cpu.AddWatch(Watchpoint{Kind: WatchAccess, Addr: 0x100, Size: 8})
+
+	expected := []WatchHit{
+		{PC: 0x1e, Addr: 0x100, Write: false, Old: 5, New: 5},
+		{PC: 0x0a, Addr: 0x100, Write: true, Old: 0, New: 5},
+	}
+	for _, hit := range expected {
+		for cpu.StepBack() && len(cpu.WatchHits()) == 0 {
+		}
+		hit.Watch = cpu.Watches()[0]
+		if hits := cpu.WatchHits(); len(hits) != 1 || hits[0] != hit {
+			t.Errorf("expected %v but got %v", hit, hits)
+		}
+		if cpu.PC() != hit.PC || cpu.Status() != aok {
+			t.Errorf("expected to stop at %#x with status AOK but got %#x %s", hit.PC, cpu.PC(), StatusName(cpu.Status()))
+		}
+	}
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	assembler := NewAssembler(asumSource)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	cpu := CPU{}
+	assembler.Load(&cpu)
+	for i := 0; i < 6; i++ {
+		cpu.Tick()
+	}
+
+	saved, err := cpu.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := snapshot.Encode(&buf, saved); err != nil {
+		t.Fatal(err)
+	}
+	s, err := snapshot.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored := CPU{}
+	if err := restored.Restore(s); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := restored.Snapshot(); !reflect.DeepEqual(got, saved) || restored.sys.brk == 0 {
+		t.Fatal("restored CPU differs from the one saved")
+	}
+
+	cpu.Execute()
+	restored.Execute()
+	if takeSnapshot(&restored) != takeSnapshot(&cpu) {
+		t.Error("restored CPU finished in a different state")
+	}
+
+	// the heap of older snapshots starts after the last byte in use
+	s.Brk = 0
+	if err := restored.Restore(s); err != nil || restored.sys.brk != (restored.mem.used()+7)&^7 ||
+		restored.sys.brk < cpu.sys.brk {
+		t.Errorf("expected the heap to start after the program but got %#x, %v", restored.sys.brk, err)
+	}
+
+	s.Mem = s.Mem[:100]
+	if err := restored.Restore(s); err == nil {
+		t.Error("expected an error for a snapshot with the wrong memory size")
+	}
+	if err := cpu.SetMemSize(snapshot.MaxMem * 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cpu.Snapshot(); err == nil {
+		t.Error("expected an error for a memory too large for a snapshot")
+	}
+}
+
+func TestAssembleConditionalMoves(t *testing.T) {
+	assembler := NewAssembler(`
+	cmovle %rax, %rcx
+	cmovl %rdx, %rbx
+	cmove %rsp, %rbp
+	cmovne %rsi, %rdi
+	cmovge %r8, %r9
+	cmovg %r10, %r11
+`)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{0x21, 0x01, 0x22, 0x23, 0x23, 0x45, 0x24, 0x67, 0x25, 0x89, 0x26, 0xab}
+	code := bytes.Join(assembler.parser.GetInstructionBuffer(), nil)
+	if !bytes.Equal(code, expected) {
+		t.Errorf("expected %x but got %x", expected, code)
+	}
+
+	lines := Disassemble(code, 0, nil)
+	if len(lines) != 6 || lines[0].Text != "cmovle %rax, %rcx" || lines[5].Text != "cmovg %r10, %r11" {
+		t.Errorf("expected the conditional moves to be disassembled but got %+v", lines)
+	}
+	mem := &memory{}
+	mem.writeBytes(0, []byte{0x27})
+	if _, status := fetch(mem.readBytes, 0, nil); status != ins {
+		t.Error("expected rrmovq with an invalid condition to be rejected")
+	}
+}
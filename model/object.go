@@ -0,0 +1,119 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"y86/object"
+)
+
+// A piece of machine code or data generated by the parser.
+type chunk struct {
+	address int
+	bytes   []byte
+	kind    object.SectionKind
+}
+
+// Create an object file from the assembled program. Contiguous instructions and data are
+// grouped into code and data sections, every label and .extern declaration becomes a symbol
+// and every place where the value of a label is stored becomes a relocation.
+func (a *Assembler) Object() *object.File {
+	p := &a.parser
+	f := &object.File{
+		Entry:  uint64(p.start),
+		Source: a.reporter.file,
+	}
+
+	chunks := make([]chunk, 0, len(p.instructions)+len(p.dataTable))
+	for i, inst := range p.instructions {
+		chunks = append(chunks, chunk{p.locations[i], inst, object.Code})
+	}
+	for address, val := range p.dataTable {
+		chunks = append(chunks, chunk{address, intToBytes(val), object.Data})
+	}
+	sort.SliceStable(chunks, func(i, j int) bool { return chunks[i].address < chunks[j].address })
+
+	for _, c := range chunks {
+		last := len(f.Sections) - 1
+		if last >= 0 && f.Sections[last].Kind == c.kind &&
+			f.Sections[last].Addr+uint64(len(f.Sections[last].Data)) == uint64(c.address) {
+			f.Sections[last].Data = append(f.Sections[last].Data, c.bytes...)
+			continue
+		}
+
+		name := ".text"
+		if c.kind == object.Data {
+			name = ".data"
+		}
+		data := make([]byte, len(c.bytes))
+		copy(data, c.bytes)
+		f.Sections = append(f.Sections, object.Section{Name: name, Kind: c.kind, Addr: uint64(c.address), Data: data})
+	}
+
+	names := make([]string, 0, len(p.symbolTable))
+	for name := range p.symbolTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		address := uint64(p.symbolTable[name])
+		section := int32(f.SectionAt(address))
+		if section < 0 {
+			section = object.Absolute
+		}
+		_, global := p.globals[name]
+		f.Symbols = append(f.Symbols, object.Symbol{Name: name, Section: section, Value: address, Global: global})
+	}
+
+	externs := make([]string, 0, len(p.externs))
+	for name := range p.externs {
+		externs = append(externs, name)
+	}
+	sort.Strings(externs)
+
+	for _, name := range externs {
+		f.Symbols = append(f.Symbols, object.Symbol{Name: name, Section: object.Undefined})
+	}
+
+	for _, ref := range p.references {
+		section := f.SectionAt(uint64(ref.address))
+		if section < 0 {
+			continue
+		}
+		f.Relocations = append(f.Relocations, object.Relocation{
+			Section: uint32(section),
+			Offset:  uint64(ref.address) - f.Sections[section].Addr,
+			Symbol:  uint32(f.Lookup(ref.symbol)),
+			Kind:    object.Abs64,
+		})
+	}
+
+	for line, entry := range p.listing {
+		if len(entry.bytes) > 0 {
+			f.Lines = append(f.Lines, object.LineEntry{Addr: uint64(entry.address), Line: uint32(line)})
+		}
+	}
+	sort.Slice(f.Lines, func(i, j int) bool { return f.Lines[i].Addr < f.Lines[j].Addr })
+
+	return f
+}
+
+// Copy the sections of an object file into the memory of a processor and set the program
+// counter to the entry point. Returns an error if a relocation refers to an undefined symbol.
+func LoadObject(f *object.File, p Processor) error {
+	for _, r := range f.Relocations {
+		if sym := f.Symbols[r.Symbol]; !sym.Defined() {
+			return fmt.Errorf("error: undefined symbol %s", sym.Name)
+		}
+	}
+	return p.Load(ObjectImage(f))
+}
+
+// Return the image of an object file with a segment for each section.
+func ObjectImage(f *object.File) *Image {
+	image := &Image{Entry: int(f.Entry)}
+	for _, s := range f.Sections {
+		image.Segments = append(image.Segments, Segment{int(s.Addr), s.Data})
+	}
+	return image
+}
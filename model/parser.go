@@ -5,24 +5,47 @@ import (
 	"strconv"
 )
 
-// Contains functions for parsing an instruction and converting it into a byte representation.
-var parseDispatchTable = map[byte]func(token Token, opcode byte, fcode byte, size byte, parser *Parser) error{
-	halt:   parse1Byte,
-	nop:    parse1Byte,
-	opq:    parse2Byte,
-	irmovq: parseIrmovq,
-	mrmovq: parseMrmovq,
+// Contains functions for parsing an instruction and converting it into a byte representation,
+// keyed by the format of the instruction.
+var parseDispatchTable = map[Format]func(token Token, opcode byte, fcode byte, size byte, parser *Parser) error{
+	FormatNone:   parse1Byte,
+	FormatReg:    parse1Reg,
+	FormatRegReg: parse2Byte,
+	FormatImmReg: parseIrmovq,
+	FormatRegMem: parseRmmovq,
+	FormatMemReg: parseMrmovq,
+	FormatDest:   parseDest,
 }
 
 // Object that converts a list of tokens to a set of machine instructions which it can save on the disk.
 type Parser struct {
-	tokens       []Token        // list of tokens
-	curr         int            // the current token index
-	symbolTable  map[string]int // contains all of the labels and their addresses
-	dataTable    map[int]int64  // contains all of the data to be stored in memory
-	instructions [][]byte       // translated machine code
-	start        int            // the starting address of the program
-	lc           int            // location counter
+	tokens       []Token                // list of tokens
+	curr         int                    // the current token index
+	symbolTable  map[string]int         // contains all of the labels and their addresses
+	dataTable    map[int]int64          // contains all of the data to be stored in memory
+	instructions [][]byte               // translated machine code
+	locations    []int                  // the address of each instruction in the instruction buffer
+	start        int                    // the starting address of the program
+	lc           int                    // location counter
+	reporter     *reporter              // collects the errors and warnings found in the source code
+	emitting     bool                   // true during the second pass, when the machine code is generated
+	listing      map[uint]*listingEntry // the address and machine code of each source line
+	references   []reference            // the addresses where the values of labels are stored
+	globals      map[string]Token       // labels exported with .global and where they were exported
+	externs      map[string]Token       // labels imported with .extern and where they were imported
+	isa          *ISA                   // instructions accepted by the parser, nil for the default ISA
+}
+
+// An address in the program that holds the value of a label.
+type reference struct {
+	address int    // the address of the 8-byte value
+	symbol  string // the label
+}
+
+// The address and machine code generated for a line of source code.
+type listingEntry struct {
+	address int    // address of the first byte generated by the line
+	bytes   []byte // machine code or data generated by the line
 }
 
 func NewParser(tokens []Token) *Parser {
@@ -31,6 +54,11 @@ func NewParser(tokens []Token) *Parser {
 		symbolTable:  make(map[string]int),
 		dataTable:    make(map[int]int64),
 		instructions: make([][]byte, 0),
+		locations:    make([]int, 0),
+		reporter:     newReporter("", ""),
+		listing:      make(map[uint]*listingEntry),
+		globals:      make(map[string]Token),
+		externs:      make(map[string]Token),
 	}
 }
 
@@ -46,6 +74,11 @@ func (p *Parser) GetInstructionBuffer() [][]byte {
 	return p.instructions
 }
 
+// Return the address of each instruction in the instruction buffer.
+func (p *Parser) GetLocations() []int {
+	return p.locations
+}
+
 // Print the symbol table to the console.
 func (p *Parser) PrintSymbolTable() {
 	fmt.Println(p.symbolTable)
@@ -66,72 +99,102 @@ func (p *Parser) GetStart() int {
 	return p.start
 }
 
-// Create the machine code translation of the assembly code.
+// Create the machine code translation of the assembly code. Parsing continues after an
+// invalid statement so that every error is reported. Returns the diagnostics if any errors were found.
 func (p *Parser) parse() error {
-	err1 := p.firstPass()
-	err2 := p.secondPass()
-
-	if err1 != nil {
-		return err1
-	}
+	p.firstPass()
+	p.secondPass()
 
-	if err2 != nil {
-		return err2
+	if diags := p.reporter.diagnostics(); diags.HasErrors() {
+		return diags
 	}
-
 	return nil
 }
 
 // The first pass through the token list will construct the symbol and data tables. The reason
 // a first pass is necessary is because in code where the instructions are laid out before
-// the label declarations, there's no way to figure out what address of those labels.
-func (p *Parser) firstPass() error {
+// the label declarations, there's no way to figure out what address of those labels. Errors
+// in directives are reported by the second pass.
+func (p *Parser) firstPass() {
 	for !p.isAtEnd() {
 		currToken := p.advance()
 
 		switch currToken.tokenType {
 		case dir:
-			err := p.parseDirective(currToken)
-			if err != nil {
-				return err
-			}
+			p.parseDirective(currToken)
 		case instruction:
 			p.lc += int(instructionTable[currToken.lex][2])
 		case label:
 			if next := p.peek(); next.tokenType == colon {
-				p.symbolTable[currToken.lex] = p.lc
+				if _, exists := p.symbolTable[currToken.lex]; exists {
+					p.reporter.errorf(currToken.line, currToken.col, "label %s is already defined", currToken.lex)
+				} else {
+					p.symbolTable[currToken.lex] = p.lc
+				}
 			}
 		}
 	}
 	p.curr = 0
-	return nil
+	p.lc = 0
 }
 
 // The second pass through the token list will generate the obj file containing the
-// machine code for the instructions.
-func (p *Parser) secondPass() error {
+// machine code for the instructions. When a statement is invalid, the error is reported and
+// the parser skips to the next line.
+func (p *Parser) secondPass() {
+	p.emitting = true
 	for !p.isAtEnd() {
 		currToken := p.advance()
 
 		switch currToken.tokenType {
 		case dir:
-			p.parseDirective(currToken)
+			p.recover(currToken, p.parseDirective(currToken))
 		case instruction:
-			p.parseInstruction(currToken)
+			p.recover(currToken, p.parseInstruction(currToken))
+		case label:
+			if p.peek().tokenType != colon {
+				p.reporter.errorf(currToken.line, currToken.col, "unknown instruction %s", currToken.lex)
+				p.synchronize(currToken)
+			} else {
+				p.advance()
+			}
+		default:
+			p.reporter.errorf(currToken.line, currToken.col, "unexpected %s", currToken.describe())
+			p.synchronize(currToken)
 		}
+		p.record(currToken.line, p.lc, nil)
 	}
-	return nil
+	p.checkGlobals()
 }
 
-// Set the program counter to the first instruction in memory.
-func (l *Parser) setEntryPoint(cpu *CPU) {
-	cpu.state.pc = l.start
+// Add machine code generated at an address to the listing of a source line. The address of
+// a line is the address it was first recorded at.
+func (p *Parser) record(line uint, address int, bytes []byte) {
+	entry, ok := p.listing[line]
+	if !ok {
+		entry = &listingEntry{address: address}
+		p.listing[line] = entry
+	}
+	entry.bytes = append(entry.bytes, bytes...)
+}
+
+// Report the error returned by the statement that starts at a token and skip to the next line.
+func (p *Parser) recover(token Token, err error) {
+	if err == nil {
+		return
+	}
+	p.reporter.reportError(token, err)
+	p.synchronize(token)
 }
 
-// Load the data into memory.
-func (l *Parser) loadData(cpu *CPU) {
-	for address, data := range l.dataTable {
-		cpu.writeLongToMem(address, data)
+// Skip the remaining tokens on the line of a statement. The parse functions may have consumed
+// tokens from the next line, so the parser rewinds to the token after the start of the statement first.
+func (p *Parser) synchronize(token Token) {
+	for p.curr > 0 && p.tokens[p.curr-1] != token {
+		p.curr--
+	}
+	for !p.isAtEnd() && p.peek().line == token.line {
+		p.advance()
 	}
 }
 
@@ -140,11 +203,13 @@ func (p *Parser) isAtEnd() bool {
 	return p.tokens[p.curr].tokenType == eof
 }
 
-// Return the current token and then advance the parser.
+// Return the current token and then advance the parser. Returns the eof token once the
+// parser is at the end.
 func (p *Parser) advance() Token {
-	if !p.isAtEnd() {
-		p.curr++
+	if p.isAtEnd() {
+		return p.tokens[p.curr]
 	}
+	p.curr++
 	return p.tokens[p.curr-1]
 }
 
@@ -157,30 +222,99 @@ func (p *Parser) peek() Token {
 // kind of directive it is and what the assembler should do in response.
 func (p *Parser) parseDirective(token Token) error {
 	/*
-		The two directives in the y86 assembly language are .pos and .quad.
-		Both of these directives require a number as the next token.
-		The .pos directive updates the location counter whereas the .quad
-		directive tells the assembler to store something in memory.
+		The .pos, .align and .quad directives require a number as the next token.
+		The .pos directive updates the location counter, the .align directive
+		rounds it up to a multiple of the number, and the .quad directive tells
+		the assembler to store something in memory. The .quad directive also
+		accepts a label, in which case the address of the label is stored.
+		The .global and .extern directives take a list of labels instead.
 	*/
+	if token.lex == ".global" || token.lex == ".extern" {
+		return p.parseLinkage(token)
+	}
+
+	if p.peek().line != token.line {
+		return errorAt(token, "invalid directive: %s is missing its operand", token.lex)
+	}
 	next := p.advance()
-	if next.tokenType != num {
-		return fmt.Errorf("invalid directive at [%d:%d]: expected number, got %s", next.line, next.col, next.lex)
+	if next.tokenType != num && !(token.lex == ".quad" && next.tokenType == label) {
+		return errorAt(next, "invalid directive: expected number, got %s", next.describe())
+	}
+
+	at := -1
+	if token.lex == ".quad" {
+		at = p.lc
 	}
+	val, err := p.parseConst(next, at)
 
 	switch token.lex {
 	case ".pos":
-		address, _ := strconv.ParseInt(next.lex, 0, 0)
-		// this sets the starting address of the program if it hasn't been set yet.
-		if p.start == 0 && p.peek().tokenType == instruction {
-			p.start = int(address)
+		if err != nil {
+			return err
+		}
+		if p.emitting && int(val) < p.lc {
+			p.reporter.warnf(token.line, token.col, "location counter moves backwards from %#x to %#x", p.lc, val)
+		}
+		p.lc = int(val)
+	case ".align":
+		if err != nil {
+			return err
+		}
+		if val <= 0 {
+			return errorAt(next, "invalid alignment %d", val)
+		}
+		if rem := p.lc % int(val); rem != 0 {
+			p.lc += int(val) - rem
 		}
-		p.lc = int(address)
 	case ".quad":
-		val, _ := strconv.ParseInt(next.lex, 0, 0)
-		p.dataTable[p.lc] = val
+		// labels may be defined after the directive, so the location counter is always advanced
+		if err == nil {
+			p.dataTable[p.lc] = val
+			if p.emitting {
+				p.record(token.line, p.lc, intToBytes(val))
+			}
+		}
 		p.lc += 8
 	}
-	return nil
+	return err
+}
+
+// Parse a .global or .extern directive. A .global directive makes labels defined in this file
+// visible to other object files and an .extern directive declares labels that are defined in
+// another object file. Both directives take a comma separated list of labels.
+func (p *Parser) parseLinkage(token Token) error {
+	for {
+		if p.peek().line != token.line {
+			return errorAt(token, "invalid directive: %s is missing a label", token.lex)
+		}
+		name := p.advance()
+		if name.tokenType != label {
+			return errorAt(name, "invalid directive: expected label, got %s", name.describe())
+		}
+
+		if token.lex == ".global" {
+			p.globals[name.lex] = name
+		} else {
+			if _, defined := p.symbolTable[name.lex]; defined && p.emitting {
+				return errorAt(name, "label %s is declared extern but defined in this file", name.lex)
+			}
+			p.externs[name.lex] = name
+		}
+
+		if p.peek().tokenType != comma {
+			return nil
+		}
+		p.advance()
+	}
+}
+
+// Report the labels that are declared global but never defined.
+func (p *Parser) checkGlobals() {
+	for name, token := range p.globals {
+		if _, defined := p.symbolTable[name]; !defined {
+			p.reporter.errorf(token.line, token.col, "global label %s is not defined", name)
+		}
+	}
 }
 
 // Assuming that the token is an instruction, this function will figure out what
@@ -190,116 +324,243 @@ func (p *Parser) parseInstruction(token Token) error {
 	opcode := instructionInfo[0]
 	fcode := instructionInfo[1]
 	size := instructionInfo[2]
-	err := parseDispatchTable[opcode](token, opcode, fcode, size, p)
+	if !p.isa.Has(token.lex) {
+		p.lc += int(size)
+		return errorAt(token, "instruction %s is not in the %s instruction set", token.lex, p.isa.Name())
+	}
+	err := parseDispatchTable[formats[opcode]](token, opcode, fcode, size, p)
+
+	// The location counter is advanced even when the instruction is invalid so that
+	// the addresses of the instructions that follow agree with the symbol table.
 	if err != nil {
+		p.lc += int(size)
 		return err
 	}
 	return nil
 }
 
+// Append the instruction that starts at a token to the instruction buffer at the current
+// location and advance the location counter past it. The first instruction is the entry
+// point of the program.
+func (p *Parser) emit(token Token, instruction []byte) {
+	if len(p.instructions) == 0 {
+		p.start = p.lc
+	}
+	p.record(token.line, p.lc, instruction)
+	p.instructions = append(p.instructions, instruction)
+	p.locations = append(p.locations, p.lc)
+	p.lc += len(instruction)
+}
+
+// Return the value of a constant operand. The operand is either a number or a label
+// that was declared in the first pass. The value of a label is stored at an address in the
+// program, which is recorded so that the program can be relocated. Pass -1 for labels whose
+// value isn't stored.
+func (p *Parser) parseConst(token Token, at int) (int64, error) {
+	switch token.tokenType {
+	case num:
+		val, err := strconv.ParseInt(token.lex, 0, 64)
+		if err != nil {
+			// large hexadecimal constants such as 0xffffffffffffffff are stored as their bit pattern
+			uval, uerr := strconv.ParseUint(token.lex, 0, 64)
+			if uerr != nil {
+				return 0, errorAt(token, "invalid number %s", token.lex)
+			}
+			val = int64(uval)
+		}
+		return val, nil
+	case label:
+		address, ok := p.symbolTable[token.lex]
+		if _, extern := p.externs[token.lex]; !ok && extern {
+			// the linker fills in the address of an external label
+			address, ok = 0, true
+		}
+		if !ok {
+			return 0, errorAt(token, "undefined label %s", token.lex)
+		}
+		if p.emitting && at >= 0 {
+			p.references = append(p.references, reference{at, token.lex})
+		}
+		return int64(address), nil
+	default:
+		return 0, errorAt(token, "expected constant, got %s", token.describe())
+	}
+}
+
+// Parse a memory operand of the form D(rB) where the displacement D is optional. Returns
+// the displacement and the base register. The displacement is stored at the address after
+// the register byte of the instruction.
+func (p *Parser) parseMemOperand(token Token) (int64, byte, error) {
+	var valC int64
+
+	first := p.advance()
+	switch first.tokenType {
+	case lparen:
+	case num, label:
+		val, err := p.parseConst(first, p.lc+2)
+		if err != nil {
+			return 0, 0, err
+		}
+		valC = val
+		first = p.advance()
+	case eof:
+		return 0, 0, errorAt(token, "unexpected end of file")
+	default:
+		return 0, 0, errorAt(token, "invalid arguments for %s", token.lex)
+	}
+
+	args := []Token{first, p.advance(), p.advance()}
+	if IsEof(args) {
+		return 0, 0, errorAt(token, "unexpected end of file")
+	} else if !IsValidArgs(args, lparen, reg, rparen) {
+		return 0, 0, errorAt(token, "invalid arguments for %s", token.lex)
+	}
+	return valC, registerTable[args[1].lex], nil
+}
+
 // Parses a 1 byte instruction such as halt, nop, ret
 var parse1Byte = func(token Token, opcode byte, fcode byte, size byte, p *Parser) error {
 	instruction := make([]byte, size)
 	instruction[0] = opcode<<4 | fcode
-	p.instructions = append(p.instructions, instruction)
+	p.emit(token, instruction)
 	return nil
 }
 
-// Parses a 2 bytes instruction such as opq, pushq, popq. They have the form Command-Reg-Reg
+// Parses a 2 bytes instruction such as rrmovq and opq. They have the form Command-Reg-Reg
 var parse2Byte = func(token Token, opcode byte, fcode byte, size byte, p *Parser) error {
 	instruction := make([]byte, size)
 	args := []Token{p.advance(), p.advance(), p.advance()}
 
 	if IsEof(args) {
-		return fmt.Errorf("unexpected eof at [%d:%d]", token.line, token.col)
+		return errorAt(token, "unexpected end of file")
 	} else if !IsValidArgs(args, reg, comma, reg) {
-		return fmt.Errorf("invalid arguments at [%d:%d]", token.line, token.col)
+		return errorAt(token, "invalid arguments for %s", token.lex)
 	}
 	rA, rAExists := registerTable[args[0].lex]
 	rB, rBExists := registerTable[args[2].lex]
 
 	if !rAExists {
-		return fmt.Errorf("invalid register at [%d:%d]", args[0].line, args[0].col)
+		return errorAt(args[0], "invalid register")
 	} else if !rBExists {
-		return fmt.Errorf("invalid register at [%d:%d]", args[2].line, args[2].col)
+		return errorAt(args[2], "invalid register")
 	}
 	instruction[0] = opcode<<4 | fcode
 	instruction[1] = rA<<4 | rB
-	p.instructions = append(p.instructions, instruction)
+	p.emit(token, instruction)
+	return nil
+}
+
+// Parses a 2 byte instruction with a single register operand such as pushq and popq. The
+// register is stored in rA and rB is set to 0xf.
+var parse1Reg = func(token Token, opcode byte, fcode byte, size byte, p *Parser) error {
+	instruction := make([]byte, size)
+	arg := p.advance()
+
+	if arg.tokenType == eof {
+		return errorAt(token, "unexpected end of file")
+	} else if arg.tokenType != reg {
+		return errorAt(token, "invalid arguments for %s", token.lex)
+	}
+	rA, ok := registerTable[arg.lex]
+	if !ok {
+		return errorAt(arg, "invalid register")
+	}
+	instruction[0] = opcode<<4 | fcode
+	instruction[1] = rA<<4 | 0xf
+	p.emit(token, instruction)
 	return nil
 }
 
-// Parse the irmovq instruction and increment the location counter of the parser.
+// Parses a jump or call instruction. The destination is either a label or an address.
+var parseDest = func(token Token, opcode byte, fcode byte, size byte, p *Parser) error {
+	instruction := make([]byte, size)
+	arg := p.advance()
+
+	if arg.tokenType == eof {
+		return errorAt(token, "unexpected end of file")
+	}
+	dest, err := p.parseConst(arg, p.lc+1)
+	if err != nil {
+		return err
+	}
+	instruction[0] = opcode<<4 | fcode
+	copy(instruction[1:], intToBytes(dest))
+	p.emit(token, instruction)
+	return nil
+}
+
+// Parse an instruction with a constant and a register such as irmovq. It has the form irmovq V, rB.
 var parseIrmovq = func(token Token, opcode byte, fcode byte, size byte, p *Parser) error {
 	var args = []Token{p.advance(), p.advance(), p.advance()}
 	bytes := make([]byte, size)
 
 	if IsEof(args) {
-		return fmt.Errorf("unexpected eof at [%d:%d]", token.line, token.col)
+		return errorAt(token, "unexpected end of file")
 	} else if !IsValidArgs(args, label, comma, reg) && !IsValidArgs(args, num, comma, reg) {
-		return fmt.Errorf("invalid arguments at [%d:%d]", token.line, token.col)
+		return errorAt(token, "invalid arguments for %s", token.lex)
 	}
 	bytes[0] = byte(opcode<<4 | fcode)
 	var rA byte = 0xf
 	rB, ok := registerTable[args[2].lex]
 	if !ok {
-		return fmt.Errorf("invalid register at [%d:%d]", args[2].line, args[2].col)
+		return errorAt(args[2], "invalid register")
 	}
 
 	bytes[1] = byte(rA<<4 | rB)
 
-	switch args[0].tokenType {
-	case num:
-		val, _ := strconv.ParseInt(args[0].lex, 0, 0)
-		copy(bytes[2:], intToBytes(val))
-	case label:
-		val := p.symbolTable[args[0].lex]
-		copy(bytes[2:], intToBytes(int64(val)))
+	val, err := p.parseConst(args[0], p.lc+2)
+	if err != nil {
+		return err
 	}
-	p.instructions = append(p.instructions, bytes)
-	p.lc += int(size)
+	copy(bytes[2:], intToBytes(val))
+	p.emit(token, bytes)
 	return nil
 }
 
-var parseMrmovq = func(token Token, opcode byte, fcode byte, size byte, p *Parser) error {
-	var args = make([]Token, 5)
-	var valC int64
-	var rA byte
-	var rB byte
+// Parse an instruction that stores a register such as rmmovq. It has the form rmmovq rA, D(rB).
+var parseRmmovq = func(token Token, opcode byte, fcode byte, size byte, p *Parser) error {
 	var bytes = make([]byte, size)
+	var args = []Token{p.advance(), p.advance()}
 
-	bytes[0] = byte(opcode<<4 | fcode)
-
-	args[0] = p.advance()
-	switch args[0].tokenType {
-	case lparen:
-		valC = 0
-	case num:
-		valC, _ = strconv.ParseInt(args[0].lex, 0, 0)
-		args[0] = p.advance() // We advance the parser to account for the offset present in the instruction.
-	case eof:
-		return fmt.Errorf("unexpected eof at [%d:%d]", token.line, token.col)
-	default:
-		return fmt.Errorf("invalid arguments at [%d:%d]", token.line, token.col)
+	if IsEof(args) {
+		return errorAt(token, "unexpected end of file")
+	} else if !IsValidArgs(args, reg, comma) {
+		return errorAt(token, "invalid arguments for %s", token.lex)
 	}
 
-	for i := 1; i < len(args); i++ {
-		args[i] = p.advance()
+	valC, rB, err := p.parseMemOperand(token)
+	if err != nil {
+		return err
 	}
 
-	if IsEof(args) {
-		return fmt.Errorf("unexpected eof at [%d:%d]", token.line, token.col)
+	rA := registerTable[args[0].lex]
+	bytes[0] = byte(opcode<<4 | fcode)
+	bytes[1] = byte(rA<<4 | rB)
+	copy(bytes[2:], intToBytes(valC))
+	p.emit(token, bytes)
+	return nil
+}
+
+// Parse an instruction that loads a register such as mrmovq. It has the form mrmovq D(rB), rA.
+var parseMrmovq = func(token Token, opcode byte, fcode byte, size byte, p *Parser) error {
+	var bytes = make([]byte, size)
+
+	valC, rB, err := p.parseMemOperand(token)
+	if err != nil {
+		return err
 	}
 
-	if !IsValidArgs(args, lparen, reg, rparen, comma, reg) {
-		return fmt.Errorf("invalid arguments at [%d:%d]", token.line, token.col)
+	var args = []Token{p.advance(), p.advance()}
+	if IsEof(args) {
+		return errorAt(token, "unexpected end of file")
+	} else if !IsValidArgs(args, comma, reg) {
+		return errorAt(token, "invalid arguments for %s", token.lex)
 	}
 
-	rB = registerTable[args[1].lex]
-	rA = registerTable[args[4].lex]
+	rA := registerTable[args[1].lex]
+	bytes[0] = byte(opcode<<4 | fcode)
 	bytes[1] = byte(rA<<4 | rB)
 	copy(bytes[2:], intToBytes(valC))
-	p.instructions = append(p.instructions, bytes)
-	p.lc += int(size)
+	p.emit(token, bytes)
 	return nil
 }
@@ -0,0 +1,467 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Register ID used by instructions that don't read or write a register. The encoding uses 0xf
+// for this, but the register file has an entry for 0xf that machine code can still name.
+const rnone byte = 0xff
+
+// Contents of a pipeline register. Fields that aren't used by a stage are zero.
+type PipeReg struct {
+	Bubble bool  // true if the stage holds a bubble
+	Stat   byte  // status of the instruction
+	PC     int   // address of the instruction
+	Icode  byte  // opcode
+	Ifun   byte  // fcode
+	RA     byte  // register A of the instruction
+	RB     byte  // register B of the instruction
+	ValC   int64 // constant
+	ValP   int   // address of the next instruction
+	ValA   int64 // value of srcA, or valP for call and jumps
+	ValB   int64 // value of srcB
+	ValE   int64 // ALU output
+	ValM   int64 // value read from memory
+	SrcA   byte  // register read into valA, 0xff for none
+	SrcB   byte  // register read into valB, 0xff for none
+	DstE   byte  // register written with valE, 0xff for none
+	DstM   byte  // register written with valM, 0xff for none
+	Cnd    bool  // true if a jump is taken
+}
+
+// Return the name of the instruction in the stage, or bubble.
+func (r PipeReg) Name() string {
+	if r.Bubble {
+		return "bubble"
+	}
+	if r.Stat != aok && r.Stat != hlt {
+		return StatusName(r.Stat)
+	}
+	if name, ok := mnemonicTable[r.Icode<<4|r.Ifun]; ok {
+		return name
+	}
+	return fmt.Sprintf("%x:%x", r.Icode, r.Ifun)
+}
+
+// The pipeline registers of a pipelined processor at the start of a cycle.
+type PipeState struct {
+	Cycle  int     // number of cycles completed
+	PredPC int     // predicted program counter in the F register
+	D      PipeReg // decode stage
+	E      PipeReg // execute stage
+	M      PipeReg // memory stage
+	W      PipeReg // write back stage
+}
+
+func (s PipeState) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "cycle %d: F %#x", s.Cycle, s.PredPC)
+	for _, stage := range []struct {
+		name string
+		reg  PipeReg
+	}{{"D", s.D}, {"E", s.E}, {"M", s.M}, {"W", s.W}} {
+		if stage.reg.Bubble {
+			fmt.Fprintf(&b, " | %s bubble", stage.name)
+		} else {
+			fmt.Fprintf(&b, " | %s %#x %s", stage.name, stage.reg.PC, stage.reg.Name())
+		}
+	}
+	return b.String()
+}
+
+// y86 processor implementing the five stage PIPE design of CS:APP. It shares the memory,
+// register file, condition codes and ALU with the sequential CPU, resolves data hazards by
+// forwarding, stalls for one cycle on load/use hazards, predicts that jumps are taken and
+// stalls fetching while a ret is in the pipeline. It has no devices, so programs that use the
+// console or traps must run on the CPU.
+type Pipe struct {
+	mem          memory       // memory
+	reg          registerFile // registers
+	cc           cc           // condition codes
+	status       byte         // status of the processor
+	predPC       int          // F register
+	d, e, m, w   PipeReg      // pipeline registers
+	cycles       int          // number of cycles executed
+	instructions int          // number of instructions that reached the write back stage
+	isa          *ISA         // instructions the processor executes, nil for the default ISA
+}
+
+// Create a pipelined processor with an empty pipeline that starts fetching at address 0.
+func NewPipe() *Pipe {
+	p := &Pipe{}
+	p.Reset()
+	return p
+}
+
+// Reset the processor and load a program.
+func (p *Pipe) Load(image *Image) error {
+	return loadImage(p, image)
+}
+
+// Clear the memory, registers, status and counters, reset the condition codes and empty the
+// pipeline. The instruction set and the size of memory are kept.
+func (p *Pipe) Reset() {
+	*p = Pipe{mem: memory{size: p.mem.size}, cc: initialCC, isa: p.isa}
+	p.SetPC(0)
+}
+
+// Set the instructions that the processor executes. Other instructions raise INS.
+func (p *Pipe) SetISA(isa *ISA) {
+	p.isa = isa
+}
+
+// Return the instructions that the processor executes.
+func (p *Pipe) ISA() *ISA {
+	return p.isa.get()
+}
+
+// A pipeline register that holds a bubble.
+var bubble = PipeReg{Bubble: true, Icode: nop, SrcA: rnone, SrcB: rnone, DstE: rnone, DstM: rnone}
+
+// Return the address of the oldest instruction in the pipeline, or the address of the next
+// instruction to fetch if the pipeline is empty. When the processor stops this is the
+// address of the instruction that stopped it.
+func (p *Pipe) PC() int {
+	for _, r := range []*PipeReg{&p.w, &p.m, &p.e, &p.d} {
+		if !r.Bubble {
+			return r.PC
+		}
+	}
+	return p.predPC
+}
+
+// Empty the pipeline and start fetching at an address.
+func (p *Pipe) SetPC(pc int) {
+	p.predPC = pc
+	p.d, p.e, p.m, p.w = bubble, bubble, bubble, bubble
+	p.status = aok
+}
+
+// Return the status code.
+func (p *Pipe) Status() byte {
+	return p.status
+}
+
+// Return the pipeline registers.
+func (p *Pipe) State() PipeState {
+	return PipeState{p.cycles, p.predPC, p.d, p.e, p.m, p.w}
+}
+
+// Return the number of cycles executed.
+func (p *Pipe) Cycles() int {
+	return p.cycles
+}
+
+// Return the number of instructions executed, including the instruction that stopped the processor.
+func (p *Pipe) Instructions() int {
+	return p.instructions
+}
+
+// Return a copy of the whole memory. The copy is as large as memory, so MemPages is better
+// suited to large memories.
+func (p *Pipe) GetMem() []byte {
+	return p.mem.bytes()
+}
+
+// Return copies of the pages of memory that have been written, sorted by address. Every other
+// address reads as 0.
+func (p *Pipe) MemPages() []MemPage {
+	return p.mem.written()
+}
+
+// Return the size of memory in bytes.
+func (p *Pipe) MemorySize() int {
+	return p.mem.limit()
+}
+
+// Set the size of memory, which can be up to MaxMemSize, and clear it. Returns an error if
+// the size is invalid.
+func (p *Pipe) SetMemSize(size int) error {
+	mem, err := newMemory(size)
+	if err != nil {
+		return err
+	}
+	p.mem = mem
+	return nil
+}
+
+func (p *Pipe) PrintRegisterFile() {
+	PrintRegisterFile(p)
+}
+
+// Return the value of a register. Returns 0 for invalid registers.
+func (p *Pipe) Reg(index byte) int64 {
+	if index >= numReg {
+		return 0
+	}
+	return p.reg[index]
+}
+
+// Set the value of a register. Returns an error if the register is invalid.
+func (p *Pipe) SetReg(index byte, val int64) error {
+	if index >= numReg {
+		return fmt.Errorf("error: invalid register %d", index)
+	}
+	p.reg[index] = val
+	return nil
+}
+
+// Return the condition codes.
+func (p *Pipe) Flags() Flags {
+	return Flags{p.cc.z, p.cc.s, p.cc.of}
+}
+
+// Set the condition codes.
+func (p *Pipe) SetFlags(flags Flags) {
+	p.cc = cc{of: flags.OF, z: flags.ZF, s: flags.SF}
+}
+
+// Read a sequence of bytes from memory.
+func (p *Pipe) ReadMem(addr int, size int) ([]byte, error) {
+	return p.mem.readBytes(addr, size)
+}
+
+// Write a sequence of bytes to memory.
+func (p *Pipe) WriteMem(addr int, bytes []byte) error {
+	return p.mem.writeBytes(addr, bytes)
+}
+
+// Run the processor until it stops. Returns an error unless a halt instruction stopped it.
+func (p *Pipe) Execute() error {
+	status := p.status
+	for status == aok {
+		status = p.Tick()
+	}
+
+	if status != hlt {
+		return fmt.Errorf("error: status %s at %#x", StatusName(status), p.PC())
+	}
+	return nil
+}
+
+// Advance the clock by one cycle and return the status. The processor stops when an
+// instruction with a status other than AOK reaches the write back stage.
+func (p *Pipe) Tick() byte {
+	if p.status != aok {
+		return p.status
+	}
+	p.cycles++
+
+	// Write back
+	w := p.w
+	if !w.Bubble {
+		p.instructions++
+		if w.Stat != aok {
+			p.status = w.Stat
+			return p.status
+		}
+	}
+
+	// Memory
+	m := p.m
+	memWrite := false
+	var memAddr int
+	if !m.Bubble && m.Stat == aok {
+		var ok bool
+		switch m.Icode {
+		case rmmovq, pushq, call:
+			memAddr, memWrite = int(m.ValE), true
+			ok = p.mem.valid(memAddr, 8)
+		case mrmovq:
+			m.ValM, ok = p.mem.readLong(int(m.ValE))
+		case popq, ret:
+			m.ValM, ok = p.mem.readLong(int(m.ValA))
+		default:
+			ok = true
+			if x := extensions[m.Icode<<4|m.Ifun]; x != nil && (x.MemRead || x.MemWrite) {
+				memAddr = int(x.MemAddr.of(m.ValA, m.ValB, m.ValC, m.ValE))
+				if x.MemRead {
+					m.ValM, ok = p.mem.readLong(memAddr)
+				} else {
+					memWrite = true
+					ok = p.mem.valid(memAddr, 8)
+				}
+			}
+		}
+		if !ok {
+			m.Stat, memWrite = adr, false
+		}
+	}
+
+	// Execute
+	e := p.e
+	setCC := false
+	var aluA, aluB int64
+	ext := extensions[e.Icode<<4|e.Ifun]
+	if !e.Bubble && e.Stat == aok {
+		fun := add
+		switch e.Icode {
+		case rrmovq:
+			aluA = e.ValA
+		case irmovq:
+			aluA = e.ValC
+		case rmmovq, mrmovq:
+			aluA, aluB = e.ValC, e.ValB
+		case opq:
+			aluA, aluB, fun = e.ValA, e.ValB, e.Ifun
+		case call, pushq:
+			aluA, aluB = -8, e.ValB
+		case ret, popq:
+			aluA, aluB = 8, e.ValB
+		}
+		if ext != nil {
+			aluA = ext.ALUA.of(e.ValA, e.ValB, e.ValC, 0)
+			aluB = ext.ALUB.of(e.ValA, e.ValB, e.ValC, 0)
+			e.ValE = ext.alu(aluA, aluB)
+		} else {
+			e.ValE, e.Stat = aluOp(fun, aluA, aluB)
+		}
+
+		e.Cnd = true
+		if e.Icode == jxx || e.Icode == rrmovq {
+			e.Cnd, _ = p.cc.cond(e.Ifun)
+		}
+		if e.Icode == rrmovq && !e.Cnd {
+			e.DstE = rnone
+		}
+		setCC = (e.Icode == opq || ext != nil && ext.SetCC) && e.Stat == aok && (m.Bubble || m.Stat == aok)
+	}
+
+	// Decode
+	d := p.d
+	if !d.Bubble {
+		d.SrcA, d.SrcB, d.DstE, d.DstM = rnone, rnone, rnone, rnone
+		switch d.Icode {
+		case rrmovq:
+			d.SrcA, d.DstE = d.RA, d.RB
+		case irmovq:
+			d.DstE = d.RB
+		case rmmovq:
+			d.SrcA, d.SrcB = d.RA, d.RB
+		case mrmovq:
+			d.SrcB, d.DstM = d.RB, d.RA
+		case opq:
+			d.SrcA, d.SrcB, d.DstE = d.RA, d.RB, d.RB
+		case call:
+			d.SrcB, d.DstE = stackPtrReg, stackPtrReg
+		case ret:
+			d.SrcA, d.SrcB, d.DstE = stackPtrReg, stackPtrReg, stackPtrReg
+		case pushq:
+			d.SrcA, d.SrcB, d.DstE = d.RA, stackPtrReg, stackPtrReg
+		case popq:
+			d.SrcA, d.SrcB, d.DstE, d.DstM = stackPtrReg, stackPtrReg, stackPtrReg, d.RA
+		default:
+			if x := extensions[d.Icode<<4|d.Ifun]; x != nil {
+				inst := instReg{rA: d.RA, rB: d.RB}
+				d.SrcA, d.SrcB = x.SrcA.index(inst), x.SrcB.index(inst)
+				d.DstE, d.DstM = x.DstE.index(inst), x.DstM.index(inst)
+			}
+		}
+
+		if d.Icode == call || d.Icode == jxx {
+			d.ValA = int64(d.ValP)
+		} else {
+			d.ValA = p.forward(d.SrcA, &e, &m)
+		}
+		d.ValB = p.forward(d.SrcB, &e, &m)
+	}
+
+	// Fetch
+	pc := p.predPC
+	if !m.Bubble && m.Icode == jxx && !m.Cnd {
+		pc = int(m.ValA)
+	} else if !w.Bubble && w.Icode == ret {
+		pc = int(w.ValM)
+	}
+	inst, stat := fetch(p.mem.readBytes, pc, p.isa)
+	f := PipeReg{Stat: stat, PC: pc, Icode: nop, SrcA: rnone, SrcB: rnone, DstE: rnone, DstM: rnone}
+	predPC := pc
+	if stat == aok {
+		f.Icode, f.Ifun, f.RA, f.RB, f.ValC = inst.opcode, inst.fcode, inst.rA, inst.rB, inst.valC
+		f.ValP = pc + instructionSize(inst.opcode)
+		predPC = f.ValP
+		if f.Icode == jxx || f.Icode == call {
+			predPC = int(f.ValC)
+		}
+		if f.Icode == halt {
+			f.Stat = hlt
+		} else if f.Icode == system {
+			f.Stat = ins // traps are only supported by the sequential processor
+		}
+	}
+
+	// Pipeline control
+	loadUse := !e.Bubble && e.DstM != rnone && (e.DstM == d.SrcA || e.DstM == d.SrcB)
+	retInPipe := isRet(d) || isRet(e) || isRet(m)
+	mispredicted := !e.Bubble && e.Icode == jxx && !e.Cnd
+	exception := !m.Bubble && m.Stat != aok
+
+	// Clock the pipeline registers and the state that is written at the end of the cycle
+	if !w.Bubble {
+		if w.DstE != rnone {
+			p.reg[w.DstE] = w.ValE
+		}
+		if w.DstM != rnone {
+			p.reg[w.DstM] = w.ValM
+		}
+	}
+	if memWrite {
+		p.mem.writeLong(memAddr, m.ValA)
+	}
+	if setCC && ext != nil {
+		ext.updateCC(&p.cc, aluA, aluB, e.ValE)
+	} else if setCC {
+		p.cc.update(e.Ifun, aluA, aluB, e.ValE)
+	}
+
+	p.w = m
+	if exception {
+		p.m = bubble
+	} else {
+		p.m = e
+	}
+	if mispredicted || loadUse {
+		p.e = bubble
+	} else {
+		p.e = d
+	}
+	if !loadUse {
+		if mispredicted || retInPipe {
+			p.d = bubble
+		} else {
+			p.d = f
+		}
+		if !retInPipe {
+			p.predPC = predPC
+		}
+	}
+	return p.status
+}
+
+// Return the value of a source register, forwarding values computed by the later stages in the
+// current cycle that haven't been written to the register file yet.
+func (p *Pipe) forward(src byte, e *PipeReg, m *PipeReg) int64 {
+	switch {
+	case src == rnone:
+		return 0
+	case src == e.DstE:
+		return e.ValE
+	case src == m.DstM:
+		return m.ValM
+	case src == m.DstE:
+		return m.ValE
+	case src == p.w.DstM:
+		return p.w.ValM
+	case src == p.w.DstE:
+		return p.w.ValE
+	default:
+		return p.reg[src]
+	}
+}
+
+// Returns true if a stage holds a ret instruction.
+func isRet(r PipeReg) bool {
+	return !r.Bubble && r.Icode == ret
+}
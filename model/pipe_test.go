@@ -0,0 +1,216 @@
+package model
+
+import (
+	"bytes"
+	"testing"
+)
+
+// Assemble a program and load it into both the sequential and the pipelined processor.
+func loadBoth(t *testing.T, source string) (*CPU, *Pipe) {
+	return loadBothISA(t, source, nil)
+}
+
+// Assemble a program for an instruction set and load it into both processors.
+func loadBothISA(t *testing.T, source string, isa *ISA) (*CPU, *Pipe) {
+	assembler := NewAssembler(source)
+	assembler.SetISA(isa)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	cpu := &CPU{}
+	cpu.SetISA(isa)
+	if err := assembler.Load(cpu); err != nil {
+		t.Fatal(err)
+	}
+
+	pipe := NewPipe()
+	pipe.SetISA(isa)
+	if err := assembler.Load(pipe); err != nil {
+		t.Fatal(err)
+	}
+	return cpu, pipe
+}
+
+func TestPipeMatchesSequentialCPU(t *testing.T) {
+	cpu, pipe := loadBoth(t, asumSource)
+	if err := cpu.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	if pipe.reg != cpu.reg {
+		t.Errorf("expected registers %v but got %v", cpu.reg, pipe.reg)
+	}
+	if !bytes.Equal(pipe.GetMem(), cpu.GetMem()) {
+		t.Error("memory of the pipelined processor differs from the sequential CPU")
+	}
+	if pipe.Flags() != cpu.Flags() {
+		t.Errorf("expected condition codes %v but got %v", cpu.Flags(), pipe.Flags())
+	}
+}
+
+func TestPipeHazards(t *testing.T) {
+	tests := []struct {
+		name         string
+		source       string
+		instructions int
+		cycles       int
+		reg          byte
+		val          int64
+	}{
+		{"no hazards", `
+	irmovq $1, %rax
+	irmovq $2, %rbx
+	nop
+	halt`, 4, 8, 3, 2},
+		{"forwarding", `
+	irmovq $1, %rax
+	irmovq $2, %rbx
+	addq %rax, %rbx
+	addq %rbx, %rbx
+	halt`, 5, 9, 3, 6},
+		{"load/use", `
+	irmovq $0x100, %rdx
+	irmovq $5, %rax
+	rmmovq %rax, (%rdx)
+	mrmovq (%rdx), %rbx
+	addq %rbx, %rbx
+	halt`, 6, 11, 3, 10},
+		{"mispredicted branch", `
+	xorq %rax, %rax
+	jne target
+	irmovq $1, %rcx
+	halt
+target:	irmovq $2, %rcx
+	halt`, 4, 10, 1, 1},
+		{"ret", `
+	irmovq $0x200, %rsp
+	call f
+	irmovq $1, %rcx
+	halt
+f:	ret`, 5, 12, 1, 1},
+	}
+
+	for _, test := range tests {
+		_, pipe := loadBoth(t, test.source)
+		if err := pipe.Execute(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if pipe.Instructions() != test.instructions || pipe.Cycles() != test.cycles {
+			t.Errorf("%s: expected %d instructions in %d cycles but got %d in %d", test.name,
+				test.instructions, test.cycles, pipe.Instructions(), pipe.Cycles())
+		}
+		if val := pipe.Reg(test.reg); val != test.val {
+			t.Errorf("%s: expected %s to be %d but got %d", test.name, RegisterName(test.reg), test.val, val)
+		}
+	}
+}
+
+func TestPipeState(t *testing.T) {
+	_, pipe := loadBoth(t, `
+	irmovq $0x100, %rdx
+	mrmovq (%rdx), %rax
+	addq %rax, %rax
+	halt`)
+
+	expected := []string{
+		"cycle 0: F 0x0 | D bubble | E bubble | M bubble | W bubble",
+		"cycle 1: F 0xa | D 0x0 irmovq | E bubble | M bubble | W bubble",
+		"cycle 2: F 0x14 | D 0xa mrmovq | E 0x0 irmovq | M bubble | W bubble",
+		"cycle 3: F 0x16 | D 0x14 addq | E 0xa mrmovq | M 0x0 irmovq | W bubble",
+		"cycle 4: F 0x16 | D 0x14 addq | E bubble | M 0xa mrmovq | W 0x0 irmovq",
+		"cycle 5: F 0x17 | D 0x16 halt | E 0x14 addq | M bubble | W 0xa mrmovq",
+	}
+	for i, s := range expected {
+		if state := pipe.State().String(); state != s {
+			t.Errorf("cycle %d: expected\n%s\nbut got\n%s", i, s, state)
+		}
+		pipe.Tick()
+	}
+}
+
+func TestPipeExceptions(t *testing.T) {
+	_, pipe := loadBoth(t, `
+	irmovq $1, %rax
+	irmovq $-8, %rdx
+	mrmovq (%rdx), %rbx
+	irmovq $2, %rax
+	rmmovq %rax, 0x100(%rdx)
+	halt`)
+	if err := pipe.Execute(); err == nil || pipe.Status() != StatusADR {
+		t.Fatalf("expected status ADR but got %s", StatusName(pipe.Status()))
+	}
+	if pc := pipe.PC(); pc != 0x14 {
+		t.Errorf("expected the exception at 0x14 but got %#x", pc)
+	}
+	if rax := pipe.Reg(0); rax != 1 {
+		t.Errorf("expected the instructions after the exception to be cancelled but %%rax is %d", rax)
+	}
+	if mem, _ := pipe.ReadMem(0xf8, 8); mem[0] != 0 {
+		t.Error("expected the write after the exception to be cancelled")
+	}
+}
+
+func TestPipeHasNoDevices(t *testing.T) {
+	// the address of the console is memory for the pipelined processor
+	cpu, pipe := loadBoth(t, `
+	irmovq 0xff00, %rdi
+	irmovq $42, %rax
+	rmmovq %rax, 8(%rdi)
+	mrmovq 8(%rdi), %rbx
+	halt`)
+	if _, ok := Processor(pipe).(interface{ AttachDevice(int, Device) error }); ok {
+		t.Fatal("expected the pipelined processor not to map devices")
+	}
+	var out bytes.Buffer
+	if err := cpu.AttachDevice(ConsoleAddr, NewConsole(nil, &out)); err != nil {
+		t.Fatal(err)
+	}
+	if err := pipe.Execute(); err != nil || pipe.Reg(3) != 42 {
+		t.Errorf("expected %%rbx to be read back from memory but got %d, %v", pipe.Reg(3), err)
+	}
+	if cpu.Execute(); out.String() != "42" || cpu.Status() != adr {
+		t.Errorf("expected the CPU to print 42 and fail to read it back but got %q", out.String())
+	}
+}
+
+func TestIgnoredFcodes(t *testing.T) {
+	// both processors ignore the fcode of the instructions other than cmovXX, opq and jXX
+	var code []byte
+	for _, inst := range []struct {
+		code   byte
+		opcode byte
+		rA, rB byte
+		valC   int64
+	}{
+		{0x37, irmovq, 0xf, 4, 0x200},
+		{0x39, irmovq, 0xf, 0, 5},
+		{0xa9, pushq, 0, 0xf, 0},
+		{0xbf, popq, 3, 0xf, 0},
+		{0x47, rmmovq, 3, 4, 8},
+		{0x55, mrmovq, 1, 4, 8},
+		{0x8f, call, 0, 0, 0x50},
+		{0x00, halt, 0, 0, 0},
+	} {
+		bytes := EncodeInst(inst.opcode, 0, inst.rA, inst.rB, inst.valC)
+		bytes[0] = inst.code
+		code = append(code, bytes...)
+	}
+	image := &Image{Segments: []Segment{{0, code}, {0x50, []byte{0x9f}}}}
+
+	cpu, pipe := &CPU{}, NewPipe()
+	for _, p := range []Processor{cpu, pipe} {
+		if err := p.Load(image); err != nil {
+			t.Fatal(err)
+		}
+		if err := p.Execute(); err != nil || p.Reg(1) != 5 || p.Reg(3) != 5 {
+			t.Errorf("%T: expected %%rcx and %%rbx to be 5 but got %d and %d, %v", p, p.Reg(1), p.Reg(3), err)
+		}
+	}
+	if pipe.reg != cpu.reg || !bytes.Equal(pipe.GetMem(), cpu.GetMem()) {
+		t.Error("the pipelined processor differs from the sequential CPU")
+	}
+}
@@ -0,0 +1,100 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Default size of the memory of a processor in bytes. SetMemSize changes it.
+const MemSize = 0x10000
+
+// A y86 processor. CPU implements the sequential SEQ design and Pipe the pipelined PIPE
+// design; loaders, the debugger and tests drive either through this interface. Only CPU maps
+// devices into its address space: every address of a Pipe is memory.
+type Processor interface {
+	// Reset the processor and load a program.
+	Load(image *Image) error
+	// Clear the memory, registers, status and counters and reset the condition codes.
+	Reset()
+	// Advance the clock by one cycle and return the status.
+	Tick() byte
+	// Run until the processor stops. Returns an error unless a halt instruction stopped it.
+	Execute() error
+
+	PC() int
+	SetPC(pc int)
+	Status() byte
+	Reg(index byte) int64
+	SetReg(index byte, val int64) error
+	Flags() Flags
+	SetFlags(flags Flags)
+	ReadMem(addr int, size int) ([]byte, error)
+	WriteMem(addr int, bytes []byte) error
+	// Return the size of memory in bytes.
+	MemorySize() int
+
+	// Return the number of cycles executed.
+	Cycles() int
+	// Return the number of instructions executed.
+	Instructions() int
+}
+
+// A block of bytes loaded at an address.
+type Segment struct {
+	Addr int    // address of the first byte
+	Data []byte // contents
+}
+
+// A program ready to be loaded into memory.
+type Image struct {
+	Entry    int       // address of the first instruction to execute
+	Segments []Segment // loaded in order, so later segments overwrite earlier ones
+}
+
+// Reset a processor, copy the segments of an image into its memory and set the program counter
+// to the entry point.
+func loadImage(p Processor, image *Image) error {
+	p.Reset()
+	for _, s := range image.Segments {
+		if err := p.WriteMem(s.Addr, s.Data); err != nil {
+			return err
+		}
+	}
+	p.SetPC(image.Entry)
+	return nil
+}
+
+// Return the image of an assembled program. Data is loaded before instructions.
+func (a *Assembler) Image() *Image {
+	image := &Image{Entry: a.parser.start}
+
+	addrs := make([]int, 0, len(a.parser.dataTable))
+	for addr := range a.parser.dataTable {
+		addrs = append(addrs, addr)
+	}
+	sort.Ints(addrs)
+	for _, addr := range addrs {
+		image.Segments = append(image.Segments, Segment{addr, intToBytes(a.parser.dataTable[addr])})
+	}
+
+	for i, bytes := range a.parser.instructions {
+		image.Segments = append(image.Segments, Segment{a.parser.locations[i], bytes})
+	}
+	return image
+}
+
+// Print the registers of a processor.
+func PrintRegisterFile(p Processor) {
+	fmt.Println("Register file:")
+	for i := 0; i < 4; i++ {
+		for j := i; j < 16; j += 4 {
+			fmt.Printf("r%d: %d\t", j, p.Reg(byte(j)))
+		}
+		fmt.Println()
+	}
+	fmt.Println()
+}
+
+// Check that both processor models implement the interface.
+var _ Processor = &CPU{}
+var _ Processor = &Pipe{}
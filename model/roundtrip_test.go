@@ -0,0 +1,207 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// An instruction generated by the round trip tests along with its source code.
+type randomInst struct {
+	src  string
+	inst instReg
+}
+
+// Constants that are likely to expose encoding bugs.
+var edgeConstants = []int64{0, 1, -1, 0xff, 0x100, 1 << 47, 1 << 48, -1 << 48, math.MaxInt64, math.MinInt64}
+
+// Return a random constant, preferring the edge cases.
+func randomConst(r *rand.Rand) int64 {
+	if r.Intn(2) == 0 {
+		return edgeConstants[r.Intn(len(edgeConstants))]
+	}
+	return r.Int63() - r.Int63()
+}
+
+// Return the names of the instructions of the default ISA in a fixed order so that the tests
+// are reproducible.
+func instructionNames() []string {
+	names := make([]string, 0, len(instructionTable))
+	for name := range instructionTable {
+		if DefaultISA.Has(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Generate a random valid instruction. Jump and call destinations are plain addresses.
+func generateInst(r *rand.Rand, names []string) randomInst {
+	name := names[r.Intn(len(names))]
+	info := instructionTable[name]
+	inst := instReg{opcode: info[0], fcode: info[1], rA: 0xf, rB: 0xf}
+	// register 0xf means no register and has no name, which TestRegisterNames checks
+	rA := byte(r.Intn(15))
+	rB := byte(r.Intn(15))
+	valC := randomConst(r)
+
+	var operands string
+	switch inst.opcode {
+	case rrmovq, opq:
+		inst.rA, inst.rB = rA, rB
+		operands = fmt.Sprintf("%s, %s", registerName(rA), registerName(rB))
+	case irmovq:
+		inst.rB, inst.valC = rB, valC
+		operands = fmt.Sprintf("$%d, %s", valC, registerName(rB))
+	case rmmovq:
+		inst.rA, inst.rB, inst.valC = rA, rB, valC
+		operands = fmt.Sprintf("%s, %d(%s)", registerName(rA), valC, registerName(rB))
+	case mrmovq:
+		inst.rA, inst.rB, inst.valC = rA, rB, valC
+		operands = fmt.Sprintf("%d(%s), %s", valC, registerName(rB), registerName(rA))
+	case jxx, call:
+		inst.valC = valC
+		operands = fmt.Sprintf("%#x", uint64(valC))
+	case pushq, popq:
+		inst.rA = rA
+		operands = registerName(rA)
+	}
+
+	// instructions without register operands decode with zeroed register fields
+	if instructionSize(inst.opcode) != 2 && instructionSize(inst.opcode) != 10 {
+		inst.rA, inst.rB = 0, 0
+	}
+
+	return randomInst{strings.TrimSpace(name + " " + operands), inst}
+}
+
+// Assemble a source string and return its instruction buffer.
+func assembleInsts(t *testing.T, src string) [][]byte {
+	assembler := NewAssembler(src)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatalf("%v\n%s", err, src)
+	}
+	return assembler.parser.GetInstructionBuffer()
+}
+
+// Generates random instruction streams, assembles them and checks that the machine code
+// agrees with EncodeInst, decodes back to the generated instructions and disassembles to
+// source code that assembles to the same machine code.
+func TestRoundTrip(t *testing.T) {
+	r := rand.New(rand.NewSource(86))
+	names := instructionNames()
+
+	for stream := 0; stream < 200; stream++ {
+		insts := make([]randomInst, 1+r.Intn(30))
+		lines := make([]string, len(insts))
+		for i := range insts {
+			insts[i] = generateInst(r, names)
+			lines[i] = insts[i].src
+		}
+		src := strings.Join(lines, "\n") + "\n"
+
+		code := assembleInsts(t, src)
+		if len(code) != len(insts) {
+			t.Fatalf("expected %d instructions but got %d:\n%s", len(insts), len(code), src)
+		}
+
+		var machineCode []byte
+		for i, inst := range code {
+			expected := insts[i].inst
+			encoded := EncodeInst(expected.opcode, expected.fcode, expected.rA, expected.rB, expected.valC)
+			if !bytes.Equal(inst, encoded) {
+				t.Errorf("%s: assembled to %x but EncodeInst gives %x\n", insts[i].src, inst, encoded)
+			}
+			if decoded := createInstReg(inst); decoded != expected {
+				t.Errorf("%s: decoded to %+v but expected %+v\n", insts[i].src, decoded, expected)
+			}
+			machineCode = append(machineCode, inst...)
+		}
+
+		disassembled := Disassemble(machineCode, 0, nil)
+		texts := make([]string, len(disassembled))
+		for i, line := range disassembled {
+			if !line.Valid {
+				t.Fatalf("invalid instruction at %#x in:\n%s", line.Address, src)
+			}
+			texts[i] = line.Text
+		}
+
+		reassembled := assembleInsts(t, strings.Join(texts, "\n"))
+		if !bytes.Equal(flatten(reassembled), machineCode) {
+			t.Errorf("disassembly does not reassemble to the same machine code:\n%s", strings.Join(texts, "\n"))
+		}
+	}
+}
+
+// Every register field value either names a register that assembles back to it or, for 0xf,
+// is no register and can't be written in assembly.
+func TestRegisterNames(t *testing.T) {
+	for index := byte(0); index < 16; index++ {
+		name := registerName(index)
+		assembler := NewAssembler("pushq " + name + "\n")
+		err := assembler.Assemble()
+		if index == 0xf {
+			if err == nil || name != "%none" {
+				t.Errorf("expected register 0xf to be %%none and rejected but got %s", name)
+			}
+			continue
+		}
+		if code := assembler.parser.GetInstructionBuffer(); err != nil || len(code) != 1 || code[0][1]>>4 != index {
+			t.Errorf("expected %s to assemble to register %d, got %v", name, index, err)
+		}
+	}
+	if err := NewAssembler("rrmovq %rax, %r15\n").Assemble(); err == nil {
+		t.Error("expected %r15 to be rejected")
+	}
+}
+
+// Concatenate the instructions of an instruction buffer.
+func flatten(code [][]byte) []byte {
+	var res []byte
+	for _, inst := range code {
+		res = append(res, inst...)
+	}
+	return res
+}
+
+// Seeds shared by the fuzz targets.
+var fuzzSeeds = []string{
+	asumSource,
+	".pos 0x100\nirmovq a, %r8\nmrmovq 0(%r8), %r8\nhalt\n.pos 0x1000\na: .quad 1\n",
+	"rmmovq %rax, -8(%rsp)\n/* unterminated",
+	".global main, x\n.extern y\nmain: call y\n.quad y\n.align 0\n",
+	"$ % %rxx 0x 0xg -- 12abc\tjmp\n:,()",
+}
+
+// The scanner must never panic, whatever the input.
+func FuzzScan(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		scanner := NewScanner(src)
+		scanner.scan()
+		if len(scanner.tokens) == 0 || scanner.tokens[len(scanner.tokens)-1].tokenType != eof {
+			t.Error("the token list must end with eof")
+		}
+	})
+}
+
+// The parser must never panic, whatever the tokens.
+func FuzzParse(f *testing.F) {
+	for _, seed := range fuzzSeeds {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, src string) {
+		scanner := NewScanner(src)
+		scanner.scan()
+		parser := NewParser(scanner.tokens)
+		parser.parse()
+	})
+}
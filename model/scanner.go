@@ -1,18 +1,19 @@
 package model
 
 import (
-	"errors"
 	"unicode"
 )
 
 // Scans a source string and generates a list of tokens.
 type Scanner struct {
-	src    string  // the source code
-	cur    int     // points at the current unprocessed character
-	start  int     // the start of the sliding window
-	line   uint    // the current line
-	col    uint    // the current col
-	tokens []Token // a list of tokens
+	src      string    // the source code
+	cur      int       // points at the current unprocessed character
+	start    int       // the start of the sliding window
+	line     uint      // the current line
+	col      uint      // the current col
+	startCol uint      // the col at the start of the sliding window
+	tokens   []Token   // a list of tokens
+	reporter *reporter // collects the errors found in the source code
 }
 
 // Create a new scanner and set its source string.
@@ -23,34 +24,56 @@ func NewScanner(src string) *Scanner {
 		0,
 		1,
 		1,
+		1,
 		[]Token{},
+		newReporter("", src),
 	}
 }
 
 func (s *Scanner) SetSource(src string) {
 	s.src = src
+	s.reporter.lines = newReporter(s.reporter.file, src).lines
 }
 
-// Scans the source file and returns a list of tokens.
+// Scans the source file and generates a list of tokens. Scanning continues after an
+// invalid token so that every error is reported. Returns the diagnostics if any errors were found.
 func (s *Scanner) scan() error {
 	for !s.isAtEnd() {
-		err := s.next()
-		if err != nil {
-			return err
-		}
+		s.next()
 	}
+	s.startCol = s.col
 	s.addTokenLiteral(eof, "")
+
+	if diags := s.reporter.diagnostics(); diags.HasErrors() {
+		return diags
+	}
 	return nil
 }
 
-// Return the current character and advance the scanner.
+// Return the current character and advance the scanner. The line and col are updated so
+// that they always point at the next character.
 func (s *Scanner) advance() rune {
 	r := s.src[s.cur]
 	s.cur++
-	s.col++
+	if r == '\n' {
+		s.line++
+		s.col = 1
+	} else {
+		s.col++
+	}
 	return rune(r)
 }
 
+// Returns true if the next character matches the rune and false if it doesn't.
+func (s *Scanner) peekIs(r rune) bool {
+	return !s.isAtEnd() && s.peek() == r
+}
+
+// Return the current character without advancing the scanner.
+func (s *Scanner) peek() rune {
+	return rune(s.src[s.cur])
+}
+
 // Returns true if the scanner is at the end of the file and false if it is not
 func (s *Scanner) isAtEnd() bool {
 	return s.cur >= len(s.src)
@@ -58,47 +81,80 @@ func (s *Scanner) isAtEnd() bool {
 
 // Add a token literal to the token list.
 func (s *Scanner) addTokenLiteral(tokenType TokenType, literal string) {
-	s.tokens = append(s.tokens, NewToken(tokenType, literal, s.line, s.col))
+	s.tokens = append(s.tokens, NewToken(tokenType, literal, s.line, s.startCol))
 }
 
 // Add a token to the token list.
 func (s *Scanner) addToken(tokenType TokenType) {
 	lex := s.src[s.start:s.cur]
-	s.tokens = append(s.tokens, NewToken(tokenType, lex, s.line, s.col))
+	s.tokens = append(s.tokens, NewToken(tokenType, lex, s.line, s.startCol))
 }
 
-// Match a sequence of numbers in the source string. Returns an invalid token error if
-// the scanner encounters a non-numerical character.
+// Match a decimal or hexadecimal number in the source string. The number may have a leading
+// minus sign. Returns false if the number is terminated by a character that can't follow a number.
 func (s *Scanner) matchNumber(r rune) bool {
-	for !s.isAtEnd() && unicode.IsNumber(r) {
+	if r == '-' {
+		if s.isAtEnd() || !unicode.IsNumber(s.peek()) {
+			return false
+		}
 		r = s.advance()
 	}
 
-	if r != ',' && r != '(' && !unicode.IsSpace(r) && !unicode.IsNumber(r) {
-		return false
+	isDigit := unicode.IsNumber
+	if r == '0' && (s.peekIs('x') || s.peekIs('X')) {
+		s.advance()
+		if s.isAtEnd() || !isHexDigit(s.peek()) {
+			return false
+		}
+		isDigit = isHexDigit
 	}
 
-	if !s.isAtEnd() || r == '(' {
-		s.cur--
+	for !s.isAtEnd() && isDigit(s.peek()) {
+		s.advance()
+	}
+
+	if !s.isAtEnd() && !isAtTerminationSeq(s.peek()) {
+		return false
 	}
 
 	s.addToken(num)
 	return true
 }
 
+// Return true if the rune is a hexadecimal digit and false if it isn't.
+func isHexDigit(r rune) bool {
+	return unicode.IsNumber(r) || (r >= 'a' && r <= 'f') || (r >= 'A' && r <= 'F')
+}
+
 // Return true if the rune is a termination sequence and false if it isn't.
 func isAtTerminationSeq(r rune) bool {
-	return r == ':' || r == ',' || unicode.IsSpace(r)
+	return r == ':' || r == ',' || r == '(' || r == ')' || r == '#' || r == '/' || unicode.IsSpace(r)
 }
 
-// Match a sequence of alphanumeric characters in the source string.
-func (s *Scanner) matchIdentifier(r rune) {
-	for !s.isAtEnd() && !isAtTerminationSeq(r) {
-		r = s.advance()
+// Skip a line comment. The newline is left for the scanner.
+func (s *Scanner) skipLineComment() {
+	for !s.isAtEnd() && s.peek() != '\n' {
+		s.advance()
 	}
+}
 
-	if !s.isAtEnd() || r == ':' || r == ',' {
-		s.cur--
+// Skip a block comment. The opening /* has already been consumed. Reports an error if the
+// comment is never closed.
+func (s *Scanner) skipBlockComment() {
+	line, col := s.line, s.startCol
+	for !s.isAtEnd() {
+		if s.advance() == '*' && s.peekIs('/') {
+			s.advance()
+			return
+		}
+	}
+	s.reporter.errorf(line, col, "unterminated block comment")
+}
+
+// Match a sequence of alphanumeric characters in the source string.
+func (s *Scanner) matchIdentifier(r rune) {
+	for !s.isAtEnd() && !isAtTerminationSeq(s.peek()) {
+		s.advance()
 	}
 
 	lex := s.src[s.start:s.cur]
@@ -110,47 +166,45 @@ func (s *Scanner) matchIdentifier(r rune) {
 	}
 }
 
-// Match a register in the source string.
+// Match a register in the source string. Returns false if the characters following the
+// '%' do not name a register in the register table.
 func (s *Scanner) matchReg() bool {
-	r := s.advance()
-	switch r {
-	case '8':
-		s.addTokenLiteral(reg, "%r8")
-	case '9':
-		s.addTokenLiteral(reg, "%r9")
-	case '1':
-		r = s.advance()
-		switch r {
-		case '0':
-			s.addTokenLiteral(reg, "%r10")
-		case '1':
-			s.addTokenLiteral(reg, "%r11")
-		case '2':
-			s.addTokenLiteral(reg, "%r12")
-		case '3':
-			s.addTokenLiteral(reg, "%r13")
-		case '4':
-			s.addTokenLiteral(reg, "%r14")
-		case '5':
-			s.addTokenLiteral(reg, "%r15")
-		default:
-			return false
-		}
-	default:
+	for !s.isAtEnd() && isRegChar(s.peek()) {
+		s.advance()
+	}
+
+	lex := s.src[s.start:s.cur]
+	if _, ok := registerTable[lex]; !ok {
 		return false
 	}
+	s.addToken(reg)
 	return true
 }
 
-// Return the next token from the source file.
-func (s *Scanner) next() error {
+// Return true if the rune can appear in a register name and false if it can't.
+func isRegChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// Scan the next token in the source file. Invalid tokens are reported and skipped.
+func (s *Scanner) next() {
 	s.start = s.cur
+	s.startCol = s.col
 	r := s.advance()
 
 	switch {
-	case r == '\n':
-		s.line++
-		s.col = 1
+	case r == '#':
+		s.skipLineComment()
+	case r == '/' && s.peekIs('/'):
+		s.skipLineComment()
+	case r == '/' && s.peekIs('*'):
+		s.advance()
+		s.skipBlockComment()
+	case r == '$':
+		// immediate values may be prefixed with a $ as in the CS:APP syntax
+		if s.isAtEnd() || !(unicode.IsNumber(s.peek()) || s.peek() == '-') {
+			s.reporter.errorf(s.line, s.startCol, "expected number after $")
+		}
 	case r == '(':
 		s.addTokenLiteral(lparen, "(")
 	case r == ')':
@@ -161,30 +215,26 @@ func (s *Scanner) next() error {
 		s.addTokenLiteral(comma, ",")
 	case r == '.':
 		s.matchIdentifier(r)
-	case r == '0':
-		r = s.advance()
-		switch r {
-		case 'x':
-			s.matchNumber(s.advance())
-		case '(':
-			s.addTokenLiteral(num, "0")
-			s.cur--
-		default:
-			s.matchIdentifier(r)
-		}
 	case r == '%':
-		if r = s.advance(); r == 'r' {
-			if !s.matchReg() {
-				return errors.New("invalid token")
-			}
-		} else {
-			s.matchIdentifier(r)
+		if !s.matchReg() {
+			s.invalidToken("invalid register")
+		}
+	case unicode.IsNumber(r) || r == '-':
+		if !s.matchNumber(r) {
+			s.invalidToken("invalid number")
 		}
-	case unicode.IsNumber(r):
-		s.matchNumber(r)
-	case unicode.IsLetter(r) || unicode.IsSymbol(r):
+	case unicode.IsLetter(r) || unicode.IsSymbol(r) || r == '_':
 		s.matchIdentifier(r)
+	case unicode.IsSpace(r):
+	default:
+		s.reporter.errorf(s.line, s.startCol, "unexpected character %q", r)
 	}
+}
 
-	return nil
+// Report the lexeme in the sliding window as an invalid token and skip the rest of it.
+func (s *Scanner) invalidToken(msg string) {
+	for !s.isAtEnd() && !isAtTerminationSeq(s.peek()) {
+		s.advance()
+	}
+	s.reporter.errorf(s.line, s.startCol, "%s %s", msg, s.src[s.start:s.cur])
 }
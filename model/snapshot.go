@@ -0,0 +1,55 @@
+package model
+
+import (
+	"fmt"
+	"y86/snapshot"
+)
+
+// Capture the memory, registers, program counter, condition codes, status, counters and the
+// end of the heap of the syscall instruction. Returns an error if memory is larger than a
+// snapshot can hold.
+func (cpu *CPU) Snapshot() (*snapshot.State, error) {
+	if cpu.mem.limit() > snapshot.MaxMem {
+		return nil, fmt.Errorf("error: snapshots only support memories of up to %#x bytes", snapshot.MaxMem)
+	}
+
+	mem := cpu.GetMem()
+	return &snapshot.State{
+		PC:           uint64(cpu.state.pc),
+		Status:       cpu.state.status,
+		ZF:           cpu.state.cc.z,
+		SF:           cpu.state.cc.s,
+		OF:           cpu.state.cc.of,
+		Cycles:       uint64(cpu.cycles),
+		Instructions: uint64(cpu.instructions),
+		Brk:          uint64(cpu.sys.brk),
+		Regs:         [numReg]int64(cpu.reg),
+		Mem:          mem,
+	}, nil
+}
+
+// Reset the CPU and restore a snapshot. Watchpoints, the tracer and the history size are
+// kept. Returns an error if the snapshot was taken from a CPU with a different memory size or
+// has an invalid status.
+func (cpu *CPU) Restore(s *snapshot.State) error {
+	if len(s.Mem) != cpu.mem.limit() {
+		return fmt.Errorf("error: snapshot has %d bytes of memory, expected %d", len(s.Mem), cpu.mem.limit())
+	}
+	if _, ok := statusNames[s.Status]; !ok {
+		return fmt.Errorf("error: snapshot has an invalid status %d", s.Status)
+	}
+
+	cpu.Reset()
+	cpu.mem.writeBytes(0, s.Mem)
+	cpu.reg = registerFile(s.Regs)
+	cpu.state.pc = int(s.PC)
+	cpu.state.status = s.Status
+	cpu.state.cc = cc{of: s.OF, z: s.ZF, s: s.SF}
+	cpu.cycles, cpu.instructions = int(s.Cycles), int(s.Instructions)
+	cpu.sys.brk = int(s.Brk)
+	if s.Brk == 0 {
+		// older snapshots don't have brk, so the heap starts after everything in memory
+		cpu.sys.brk = (cpu.mem.used() + 7) &^ 7
+	}
+	return nil
+}
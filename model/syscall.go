@@ -0,0 +1,185 @@
+package model
+
+import (
+	"fmt"
+	"io"
+)
+
+/*
+ * The syscall instruction asks the host for a service. The number of the service is in %rax,
+ * its arguments are in %rdi and %rsi and its result is returned in %rax. Services are Go
+ * functions: the built-in services below are available to every CPU, and embedders can add
+ * services or replace them with RegisterSyscall.
+ */
+
+// Numbers of the built-in services.
+const (
+	SysExit        = 0 // stop the CPU with the exit code in %rdi
+	SysWriteInt    = 1 // print %rdi as a decimal integer
+	SysWriteString = 2 // print the %rsi bytes at address %rdi
+	SysReadInt     = 3 // read an integer into %rax
+	SysCycles      = 4 // return the number of cycles executed in %rax
+	SysAlloc       = 5 // allocate %rdi bytes of heap memory and return their address in %rax, or 0
+)
+
+// Registers of the arguments and result of a service.
+const (
+	sysNumReg  = 0 // %rax
+	sysArg1Reg = 7 // %rdi
+	sysArg2Reg = 6 // %rsi
+)
+
+// A service called by the syscall instruction. It reads its arguments from the registers and
+// memory of the CPU and writes its result to them. An error stops the CPU with ADR.
+type SyscallHandler func(cpu *CPU) error
+
+// The built-in services.
+var builtinSyscalls = map[int64]SyscallHandler{
+	SysExit:        sysExit,
+	SysWriteInt:    sysWriteInt,
+	SysWriteString: sysWriteString,
+	SysReadInt:     sysReadInt,
+	SysCycles:      sysCycles,
+	SysAlloc:       sysAlloc,
+}
+
+// State of the services of a CPU.
+type syscalls struct {
+	handlers map[int64]SyscallHandler // services added by RegisterSyscall
+	console  *Console                 // input and output of the services, nil if there is none
+	brk      int                      // first address of free heap memory
+	exitCode int                      // exit code of the program
+}
+
+// Add a service or replace a built-in one. Services are kept when the CPU is reset.
+func (cpu *CPU) RegisterSyscall(num int64, handler SyscallHandler) {
+	if cpu.sys.handlers == nil {
+		cpu.sys.handlers = make(map[int64]SyscallHandler)
+	}
+	cpu.sys.handlers[num] = handler
+}
+
+// Set the input and output of the services that read and print. Either may be nil, in which
+// case reading or printing stops the CPU with ADR.
+func (cpu *CPU) SetSyscallIO(in io.Reader, out io.Writer) {
+	cpu.SetSyscallConsole(NewConsole(in, out))
+}
+
+// Set the console of the services that read and print. Sharing the console attached as a
+// device lets programs mix both without either buffering input that the other needs.
+func (cpu *CPU) SetSyscallConsole(console *Console) {
+	cpu.sys.console = console
+}
+
+// Return the exit code the program passed to the exit service, or 0 if it didn't exit.
+func (cpu *CPU) ExitCode() int {
+	return cpu.sys.exitCode
+}
+
+// Execute the syscall instruction: call the service with the number in %rax. Raises INS if
+// there's no such service.
+func (cpu *CPU) syscall() {
+	num := cpu.readReg(sysNumReg)
+	handler, ok := cpu.sys.handlers[num]
+	if !ok {
+		handler, ok = builtinSyscalls[num]
+	}
+	if !ok {
+		cpu.state.status = ins
+		return
+	}
+
+	if err := handler(cpu); err != nil {
+		cpu.state.status = adr
+	}
+	if cpu.state.status == aok {
+		cpu.state.pc++
+	}
+}
+
+// Return the console of the services, or an error if there is none or it has no output when
+// the service prints.
+func (cpu *CPU) syscallConsole(prints bool) (*Console, error) {
+	if c := cpu.sys.console; c == nil || prints && c.out == nil {
+		return nil, fmt.Errorf("error: system calls have no input or output")
+	}
+	return cpu.sys.console, nil
+}
+
+func sysExit(cpu *CPU) error {
+	cpu.sys.exitCode = int(cpu.readReg(sysArg1Reg))
+	cpu.state.status = hlt
+	return nil
+}
+
+func sysWriteInt(cpu *CPU) error {
+	console, err := cpu.syscallConsole(true)
+	if err != nil {
+		return err
+	}
+	return console.Write(ConsoleInt, cpu.readReg(sysArg1Reg))
+}
+
+func sysWriteString(cpu *CPU) error {
+	console, err := cpu.syscallConsole(true)
+	if err != nil {
+		return err
+	}
+	bytes, err := cpu.readBytesFromMem(int(cpu.readReg(sysArg1Reg)), int(cpu.readReg(sysArg2Reg)))
+	if err != nil {
+		return err
+	}
+	_, err = console.out.Write(bytes)
+	return err
+}
+
+func sysReadInt(cpu *CPU) error {
+	console, err := cpu.syscallConsole(false)
+	if err != nil {
+		return err
+	}
+	val, err := console.Read(ConsoleInt)
+	if err != nil {
+		return err
+	}
+	cpu.writeReg(sysNumReg, val)
+	return nil
+}
+
+func sysCycles(cpu *CPU) error {
+	cpu.writeReg(sysNumReg, int64(cpu.cycles))
+	return nil
+}
+
+// Allocate memory from the heap, which starts after the program and grows towards the stack.
+// Blocks are aligned to 8 bytes and never freed. Returns 0 if the block would reach the stack,
+// which is everything from %rsp up unless %rsp is 0, or overlap a device or the end of memory.
+func sysAlloc(cpu *CPU) error {
+	size := cpu.readReg(sysArg1Reg)
+	addr := cpu.sys.brk
+	if size < 0 || size > int64(cpu.mem.limit()-addr) {
+		cpu.writeReg(sysNumReg, 0)
+		return nil
+	}
+
+	end := addr + int(size+7)&^7
+	sp := int(cpu.readReg(stackPtrReg))
+	if r, ok := cpu.addrMap.find(addr, end-addr); !ok || r.dev != nil || sp != 0 && end > sp {
+		cpu.writeReg(sysNumReg, 0)
+		return nil
+	}
+	cpu.sys.brk = end
+	cpu.writeReg(sysNumReg, int64(addr))
+	return nil
+}
+
+// Return the first address after the segments of an image, aligned to 8 bytes.
+func imageEnd(image *Image) int {
+	end := 0
+	for _, s := range image.Segments {
+		if s.Addr+len(s.Data) > end {
+			end = s.Addr + len(s.Data)
+		}
+	}
+	return (end + 7) &^ 7
+}
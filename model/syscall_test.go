@@ -0,0 +1,193 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Return a CPU that executes a program with the syscall instruction.
+func loadSyscalls(t *testing.T, source string) *CPU {
+	isa, err := ParseISA("extended,syscall")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := &CPU{}
+	cpu.SetISA(isa)
+	assembler := NewAssembler(source)
+	assembler.SetISA(isa)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	if err := assembler.Load(cpu); err != nil {
+		t.Fatal(err)
+	}
+	return cpu
+}
+
+const syscallSource = `
+	irmovq stack, %rsp
+	irmovq $3, %rax
+	syscall
+	rrmovq %rax, %rdi
+	irmovq $1, %rax
+	syscall
+	irmovq hello, %rdi
+	irmovq $8, %rsi
+	irmovq $2, %rax
+	syscall
+	irmovq $20, %rdi
+	irmovq $5, %rax
+	syscall
+	rrmovq %rax, %r8
+	irmovq $5, %rax
+	syscall
+	rrmovq %rax, %r9
+	irmovq $4, %rax
+	syscall
+	rrmovq %rax, %r10
+	irmovq $3, %rdi
+	irmovq $0, %rax
+	syscall
+	halt
+	.align 8
+hello:	.quad 0x0a6f6c6c6568202c
+	.pos 0x400
+stack:
+`
+
+func TestSyscalls(t *testing.T) {
+	var out bytes.Buffer
+	cpu := loadSyscalls(t, syscallSource)
+	cpu.SetSyscallIO(strings.NewReader("-12"), &out)
+	if err := cpu.Execute(); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "-12, hello\n" || cpu.ExitCode() != 3 {
+		t.Errorf("expected -12, hello and exit code 3 but got %q and %d", out.String(), cpu.ExitCode())
+	}
+	if heap := int64(imageEnd(syscallImage(t, cpu.isa))); cpu.Reg(8) != heap || cpu.Reg(9) != heap+24 {
+		t.Errorf("expected blocks at %#x and %#x but got %#x and %#x", heap, heap+24, cpu.Reg(8), cpu.Reg(9))
+	}
+	if cpu.Reg(10) != int64(cpu.Cycles()-4) || cpu.Reg(7) != 3 {
+		t.Errorf("expected %d cycles but got %d", cpu.Cycles()-4, cpu.Reg(10))
+	}
+	if cpu.PC() != 0x86 || cpu.Instructions() != 23 {
+		t.Errorf("expected exit to stop at 0x86 but got %#x", cpu.PC())
+	}
+
+	// reading past the end of the input stops the CPU
+	cpu.Load(syscallImage(t, cpu.isa))
+	cpu.Execute()
+	if cpu.Status() != adr || cpu.ExitCode() != 0 {
+		t.Errorf("expected ADR but got %s", StatusName(cpu.Status()))
+	}
+}
+
+func TestSyscallConsole(t *testing.T) {
+	// the console device and the read service take turns reading the same input
+	cpu := loadSyscalls(t, `
+	irmovq 0xff00, %rdi
+	mrmovq 8(%rdi), %rbx
+	irmovq $3, %rax
+	syscall
+	mrmovq 8(%rdi), %rcx
+	halt
+`)
+	console := NewConsole(strings.NewReader("1 2 3"), nil)
+	if err := cpu.AttachDevice(ConsoleAddr, console); err != nil {
+		t.Fatal(err)
+	}
+	cpu.SetSyscallConsole(console)
+	if err := cpu.Execute(); err != nil || cpu.Reg(3) != 1 || cpu.Reg(0) != 2 || cpu.Reg(1) != 3 {
+		t.Errorf("expected 1, 2 and 3 but got %d, %d and %d, %v", cpu.Reg(3), cpu.Reg(0), cpu.Reg(1), err)
+	}
+}
+
+// Return the image of the syscall test program.
+func syscallImage(t *testing.T, isa *ISA) *Image {
+	assembler := NewAssembler(syscallSource)
+	assembler.SetISA(isa)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	return assembler.Image()
+}
+
+func TestRegisterSyscall(t *testing.T) {
+	cpu := loadSyscalls(t, "irmovq $42, %rax\nsyscall\nirmovq $1, %rax\nsyscall\nhalt\n")
+	cpu.RegisterSyscall(42, func(cpu *CPU) error {
+		cpu.writeReg(1, cpu.Reg(1)+1)
+		return nil
+	})
+	cpu.RegisterSyscall(SysWriteInt, func(cpu *CPU) error {
+		return fmt.Errorf("no output")
+	})
+	cpu.Execute()
+	if cpu.Status() != adr || cpu.Reg(1) != 1 {
+		t.Errorf("expected the services to be called but got %s with %%rcx = %d", StatusName(cpu.Status()),
+			cpu.Reg(1))
+	}
+
+	// unknown services raise INS, and the pipelined processor doesn't support syscall
+	cpu = loadSyscalls(t, "irmovq $99, %rax\nsyscall\nhalt\n")
+	if cpu.Execute(); cpu.Status() != ins || cpu.PC() != 10 {
+		t.Errorf("expected INS at 0xa but got %s at %#x", StatusName(cpu.Status()), cpu.PC())
+	}
+	pipe := &Pipe{}
+	pipe.SetISA(cpu.isa)
+	pipe.Load(&Image{Segments: []Segment{{0, []byte{0xe1}}}})
+	if pipe.Execute(); pipe.Status() != ins {
+		t.Errorf("expected INS but got %s", StatusName(pipe.Status()))
+	}
+}
+
+func TestAllocStack(t *testing.T) {
+	// the program ends at 0x50, so the first block fills the space up to the stack
+	cpu := loadSyscalls(t, `
+	irmovq $0x60, %rsp
+	irmovq $16, %rdi
+	irmovq $5, %rax
+	syscall
+	rrmovq %rax, %r8
+	irmovq $1, %rdi
+	irmovq $5, %rax
+	syscall
+	rrmovq %rax, %r9
+	irmovq $0x20, %rsp
+	irmovq $5, %rax
+	syscall
+	rrmovq %rax, %r10
+	halt
+`)
+	if err := cpu.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.Reg(8) != 0x50 || cpu.Reg(9) != 0 || cpu.Reg(10) != 0 {
+		t.Errorf("expected only the block below the stack but got %#x, %#x and %#x", cpu.Reg(8), cpu.Reg(9),
+			cpu.Reg(10))
+	}
+}
+
+func TestStepBackOverSyscalls(t *testing.T) {
+	cpu := loadSyscalls(t, syscallSource)
+	cpu.SetSyscallIO(strings.NewReader("-12"), &bytes.Buffer{})
+	cpu.SetHistory(100)
+	if err := cpu.Execute(); err != nil {
+		t.Fatal(err)
+	}
+	first, second := cpu.Reg(8), cpu.Reg(9)
+
+	// going back before the allocations restores the heap and the exit code
+	if err := cpu.GoToCycle(10); err != nil {
+		t.Fatal(err)
+	}
+	if cpu.sys.brk != int(first) || cpu.ExitCode() != 0 {
+		t.Errorf("expected the heap at %#x and no exit code but got %#x and %d", first, cpu.sys.brk, cpu.ExitCode())
+	}
+	if err := cpu.Execute(); err != nil || cpu.Reg(8) != first || cpu.Reg(9) != second {
+		t.Errorf("expected blocks at %#x and %#x again but got %#x and %#x", first, second, cpu.Reg(8), cpu.Reg(9))
+	}
+}
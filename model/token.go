@@ -38,3 +38,11 @@ func NewToken(tokType TokenType, lex string, line uint, col uint) Token {
 func (t Token) String() string {
 	return t.lex
 }
+
+// Describe the token for an error message.
+func (t Token) describe() string {
+	if t.tokenType == eof {
+		return "end of file"
+	}
+	return t.lex
+}
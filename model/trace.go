@@ -0,0 +1,38 @@
+package model
+
+import (
+	"y86/trace"
+)
+
+// Receives a record for every instruction the CPU executes. trace.Writer is a Tracer.
+type Tracer interface {
+	Trace(rec *trace.Record)
+}
+
+// Record every instruction executed by Tick with a tracer, or stop tracing if the tracer is nil.
+func (cpu *CPU) SetTracer(t Tracer) {
+	cpu.tracer = t
+}
+
+// Start the record of the instruction at the program counter.
+func (cpu *CPU) startRecord() {
+	cpu.record = &trace.Record{Cycle: int64(cpu.cycles), PC: int64(cpu.state.pc)}
+}
+
+// Fill in the record of the current instruction and pass it to the tracer. The values of the
+// instruction are only recorded if it was fetched.
+func (cpu *CPU) endRecord(fetched bool) {
+	rec := cpu.record
+	cpu.record = nil
+
+	if fetched {
+		inst := cpu.state.instreg
+		code, _ := cpu.readBytesFromMem(int(rec.PC), instructionSize(inst.opcode))
+		rec.Inst = decodeLine(code, int(rec.PC), nil).Text
+		rec.Icode, rec.Ifun, rec.RA, rec.RB, rec.ValC = inst.opcode, inst.fcode, inst.rA, inst.rB, inst.valC
+		rec.ValA, rec.ValB, rec.ValE, rec.ValM = cpu.state.valA, cpu.state.valB, cpu.state.valE, cpu.state.valM
+	}
+	rec.ZF, rec.SF, rec.OF = cpu.state.cc.z, cpu.state.cc.s, cpu.state.cc.of
+	rec.Status = cpu.state.status
+	cpu.tracer.Trace(rec)
+}
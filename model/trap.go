@@ -0,0 +1,285 @@
+package model
+
+import (
+	"fmt"
+)
+
+/*
+ * Traps are optional and disabled by default, in which case faults stop the CPU. EnableTraps
+ * maps a trap controller with three registers:
+ *
+ *     0x00  vectors  address of the vector table, 0 to disable traps
+ *     0x08  mask     bit n enables interrupt line n
+ *     0x10  pending  bit n is set while interrupt line n is requested, writes clear bits
+ *
+ * The vector table holds the address of a handler for each vector, or 0 if there's no handler.
+ * A trap pushes the program counter and then the flags on the stack, disables interrupts and
+ * jumps to the handler. An exception saves the address of the instruction that faulted and an
+ * interrupt saves the address of the next instruction. The iret instruction pops the flags and
+ * program counter, which restores the condition codes and enables interrupts again.
+ */
+
+// Vectors of the traps.
+const (
+	VectorADR = 0 // bad address
+	VectorINS = 1 // bad instruction
+	VectorDZ  = 2 // division by zero
+	VectorIRQ = 8 // interrupt line 0, line n uses VectorIRQ + n
+)
+
+// Number of interrupt lines.
+const NumIRQ = 8
+
+// Address the command line maps the trap controller at.
+const TrapAddr = 0xff10
+
+// Registers of the trap controller, as offsets from the address it's mapped at.
+const (
+	TrapVectors = 0x00
+	TrapMask    = 0x08
+	TrapPending = 0x10
+)
+
+// Bits of the flags saved on the stack by a trap.
+const (
+	FlagZF = 1 << iota // zero
+	FlagSF             // sign
+	FlagOF             // overflow
+	FlagIF             // interrupts enabled
+)
+
+// Vectors of the exceptions by status.
+var exceptionVectors = map[byte]int{adr: VectorADR, ins: VectorINS, dz: VectorDZ}
+
+// The trap controller of the CPU.
+type trapUnit struct {
+	vectors  int64 // address of the vector table, 0 if traps are disabled
+	mask     int64 // enabled interrupt lines
+	pending  int64 // requested interrupt lines
+	disabled bool  // true while interrupts are disabled by a handler
+}
+
+// The trap controller has three quad registers.
+func (t *trapUnit) Size() int {
+	return 24
+}
+
+func (t *trapUnit) Read(offset int) (int64, error) {
+	switch offset {
+	case TrapVectors:
+		return t.vectors, nil
+	case TrapMask:
+		return t.mask, nil
+	case TrapPending:
+		return t.pending, nil
+	default:
+		return 0, fmt.Errorf("trap controller: invalid register %#x", offset)
+	}
+}
+
+func (t *trapUnit) Write(offset int, val int64) error {
+	switch offset {
+	case TrapVectors:
+		t.vectors = val
+	case TrapMask:
+		t.mask = val
+	case TrapPending:
+		t.pending &^= val
+	default:
+		return fmt.Errorf("trap controller: invalid register %#x", offset)
+	}
+	return nil
+}
+
+// Implemented by devices that run alongside the CPU, such as timers. The CPU calls Tick at the
+// start of every cycle with a function that requests an interrupt.
+type Clocked interface {
+	Tick(irq func(line int))
+}
+
+// Map the trap controller at an address so that faults and interrupts run handlers instead of
+// stopping the CPU. The controller is kept when the CPU is reset, but its registers are
+// cleared. Returns an error if traps are already enabled or the controller overlaps a device.
+func (cpu *CPU) EnableTraps(addr int) error {
+	if cpu.traps != nil {
+		return fmt.Errorf("error: traps are already enabled")
+	}
+	t := &trapUnit{}
+	if err := cpu.AttachDevice(addr, t); err != nil {
+		return err
+	}
+	cpu.traps = t
+	return nil
+}
+
+// Request an interrupt on a line. The interrupt is delivered before the next instruction if
+// the line is enabled and interrupts aren't disabled by a handler. Returns an error if traps
+// aren't enabled or the line is invalid.
+func (cpu *CPU) Interrupt(line int) error {
+	if cpu.traps == nil {
+		return fmt.Errorf("error: traps are not enabled")
+	}
+	if line < 0 || line >= NumIRQ {
+		return fmt.Errorf("error: invalid interrupt line %d", line)
+	}
+	cpu.traps.pending |= 1 << uint(line)
+	return nil
+}
+
+// Advance the devices that run alongside the CPU by one cycle.
+func (cpu *CPU) tickDevices() {
+	for _, m := range cpu.Devices() {
+		if dev, ok := m.Device.(Clocked); ok {
+			dev.Tick(func(line int) { cpu.Interrupt(line) })
+		}
+	}
+}
+
+// Deliver the pending interrupt with the lowest line. Returns true if a handler was entered.
+func (cpu *CPU) interrupt() bool {
+	t := cpu.traps
+	if t == nil || t.vectors == 0 || t.disabled || t.pending&t.mask == 0 {
+		return false
+	}
+
+	line := 0
+	for t.pending&t.mask&(1<<uint(line)) == 0 {
+		line++
+	}
+	if !cpu.trap(VectorIRQ+line, cpu.state.pc) {
+		return false
+	}
+	t.pending &^= 1 << uint(line)
+	return true
+}
+
+// Run the handler of the exception raised by the instruction at an address if the status is
+// a fault. Returns true if a handler was entered.
+func (cpu *CPU) exception(pc int) bool {
+	vector, ok := exceptionVectors[cpu.state.status]
+	return ok && cpu.trap(vector, pc)
+}
+
+// Push the program counter and flags and jump to the handler of a vector. Returns false and
+// leaves the status unchanged if there's no handler or the stack is invalid.
+func (cpu *CPU) trap(vector int, pc int) bool {
+	t := cpu.traps
+	if t == nil || t.vectors == 0 {
+		return false
+	}
+
+	status := cpu.state.status
+	cpu.state.status = aok
+	handler := cpu.readMem(int(t.vectors) + 8*vector)
+	sp := cpu.readReg(stackPtrReg) - 16
+	if cpu.state.status == aok && handler != 0 {
+		cpu.writeLongToMem(int(sp)+8, int64(pc))
+		cpu.writeLongToMem(int(sp), cpu.flagsWord())
+	}
+	if cpu.state.status != aok || handler == 0 {
+		cpu.state.status = status
+		return false
+	}
+
+	cpu.writeReg(stackPtrReg, sp)
+	t.disabled = true
+	cpu.state.pc = int(handler)
+	return true
+}
+
+// Return the condition codes and interrupt flag as saved by a trap.
+func (cpu *CPU) flagsWord() int64 {
+	var flags int64
+	if cpu.state.cc.z {
+		flags |= FlagZF
+	}
+	if cpu.state.cc.s {
+		flags |= FlagSF
+	}
+	if cpu.state.cc.of {
+		flags |= FlagOF
+	}
+	if !cpu.traps.disabled {
+		flags |= FlagIF
+	}
+	return flags
+}
+
+// Execute the iret instruction: pop the flags and the program counter. Raises INS if traps
+// aren't enabled.
+func (cpu *CPU) iret() {
+	if cpu.traps == nil {
+		cpu.state.status = ins
+		return
+	}
+
+	sp := cpu.readReg(stackPtrReg)
+	flags := cpu.readMem(int(sp))
+	pc := cpu.readMem(int(sp) + 8)
+	if cpu.state.status != aok {
+		return
+	}
+	cpu.writeReg(stackPtrReg, sp+16)
+	cpu.state.cc = cc{z: flags&FlagZF != 0, s: flags&FlagSF != 0, of: flags&FlagOF != 0}
+	cpu.traps.disabled = flags&FlagIF == 0
+	cpu.state.pc = int(pc)
+}
+
+// A timer device that requests an interrupt periodically. Its register at offset 0 holds the
+// period in cycles, 0 to stop the timer, and the register at offset 8 counts the interrupts
+// requested.
+type Timer struct {
+	line   int   // interrupt line
+	period int64 // cycles between interrupts, 0 if stopped
+	count  int64 // cycles since the last interrupt
+	fired  int64 // number of interrupts requested
+}
+
+// Address the command line maps the timer at.
+const TimerAddr = 0xff28
+
+// Create a stopped timer that requests interrupts on a line.
+func NewTimer(line int) *Timer {
+	return &Timer{line: line}
+}
+
+// The timer has two quad registers.
+func (t *Timer) Size() int {
+	return 16
+}
+
+func (t *Timer) Read(offset int) (int64, error) {
+	switch offset {
+	case 0:
+		return t.period, nil
+	case 8:
+		return t.fired, nil
+	default:
+		return 0, fmt.Errorf("timer: invalid register %#x", offset)
+	}
+}
+
+// Writing the period restarts the timer.
+func (t *Timer) Write(offset int, val int64) error {
+	switch offset {
+	case 0:
+		t.period, t.count = val, 0
+	case 8:
+		t.fired = val
+	default:
+		return fmt.Errorf("timer: invalid register %#x", offset)
+	}
+	return nil
+}
+
+// Count a cycle and request an interrupt at the end of each period.
+func (t *Timer) Tick(irq func(line int)) {
+	if t.period <= 0 {
+		return
+	}
+	if t.count++; t.count >= t.period {
+		t.count = 0
+		t.fired++
+		irq(t.line)
+	}
+}
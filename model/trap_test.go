@@ -0,0 +1,164 @@
+package model
+
+import (
+	"testing"
+)
+
+// Return the extended instruction set with iret.
+func trapISA(t *testing.T) *ISA {
+	isa, err := NewISA("extended,iret", "extended", "iret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return isa
+}
+
+// Return a CPU with traps enabled that executes a program with the iret instruction.
+func loadTraps(t *testing.T, source string) *CPU {
+	isa := trapISA(t)
+	cpu := &CPU{}
+	cpu.SetISA(isa)
+	if err := cpu.EnableTraps(TrapAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	assembler := NewAssembler(source)
+	assembler.SetISA(isa)
+	if err := assembler.Assemble(); err != nil {
+		t.Fatal(err)
+	}
+	if err := assembler.Load(cpu); err != nil {
+		t.Fatal(err)
+	}
+	return cpu
+}
+
+const exceptionSource = `
+	irmovq stack, %rsp
+	irmovq 0xff10, %rdi
+	irmovq vectors, %rax
+	rmmovq %rax, 0(%rdi)
+	irmovq $0, %rbx
+	irmovq $5, %rcx
+	divq %rbx, %rcx
+	irmovq $1, %rdx
+	.quad 0xff
+	halt
+dz:	mrmovq 8(%rsp), %rsi
+	irmovq $2, %r8
+	addq %r8, %rsi
+	rmmovq %rsi, 8(%rsp)
+	irmovq $42, %rcx
+	iret
+	.align 8
+vectors:
+	.quad 0
+	.quad 0
+	.quad dz
+	.pos 0x400
+stack:
+`
+
+func TestExceptions(t *testing.T) {
+	// the handler of DZ skips the division, and the bad instruction stops the CPU because INS
+	// has no handler
+	cpu := loadTraps(t, exceptionSource)
+	cpu.Execute()
+	if cpu.Status() != ins || cpu.Reg(1) != 42 || cpu.Reg(2) != 1 || cpu.Reg(4) != 0x400 {
+		t.Errorf("expected INS after the handler but got %s with %%rcx = %d", StatusName(cpu.Status()),
+			cpu.Reg(1))
+	}
+	if cpu.PC() != 0x48 || cpu.traps.disabled {
+		t.Errorf("expected INS at 0x48 with interrupts enabled but got %#x", cpu.PC())
+	}
+
+	// the registers of the trap controller are cleared by a reset, so faults stop the CPU
+	cpu.Reset()
+	if cpu.traps.vectors != 0 || cpu.Interrupt(0) != nil {
+		t.Error("expected the trap controller to be kept and cleared")
+	}
+	if err := cpu.EnableTraps(0x1000); err == nil {
+		t.Error("expected traps to be enabled only once")
+	}
+
+	// iret raises INS without traps
+	cpu = &CPU{}
+	cpu.SetISA(trapISA(t))
+	cpu.Load(&Image{Segments: []Segment{{0, []byte{0xe0}}}})
+	if cpu.Execute(); cpu.Status() != ins {
+		t.Errorf("expected INS but got %s", StatusName(cpu.Status()))
+	}
+	if cpu.Interrupt(0) == nil {
+		t.Error("expected interrupts to fail without traps")
+	}
+}
+
+const interruptSource = `
+	irmovq stack, %rsp
+	irmovq 0xff10, %rdi
+	irmovq vectors, %rax
+	rmmovq %rax, 0(%rdi)
+	irmovq $1, %rax
+	rmmovq %rax, 8(%rdi)
+	irmovq $7, %rax
+	rmmovq %rax, 24(%rdi)
+	irmovq $1, %r10
+	irmovq $1, %r11
+	irmovq $50, %rcx
+loop:	subq %r10, %rcx
+	jne loop
+	halt
+timer:	addq %r11, %r9
+	iret
+	.pos 0x300
+vectors:
+	.pos 0x340
+	.quad timer
+	.pos 0x400
+stack:
+`
+
+func TestInterrupts(t *testing.T) {
+	cpu := loadTraps(t, interruptSource)
+	timer := NewTimer(0)
+	if err := cpu.AttachDevice(TimerAddr, timer); err != nil {
+		t.Fatal(err)
+	}
+
+	// the handler changes the condition codes, which iret restores for the loop
+	cpu.Execute()
+	if cpu.Status() != hlt || cpu.Reg(1) != 0 || cpu.Reg(4) != 0x400 {
+		t.Errorf("expected the loop to end but got %s with %%rcx = %d", StatusName(cpu.Status()), cpu.Reg(1))
+	}
+	if cpu.Reg(9) == 0 || cpu.Reg(9) != timer.fired {
+		t.Errorf("expected %d interrupts to be handled but got %d", timer.fired, cpu.Reg(9))
+	}
+
+	// going back restores the trap controller and the timer, so the program runs the same again
+	handled, fired := cpu.Reg(9), timer.fired
+	cpu, timer = loadTraps(t, interruptSource), NewTimer(0)
+	cpu.AttachDevice(TimerAddr, timer)
+	cpu.SetHistory(1000)
+	cpu.Execute()
+	if err := cpu.GoToCycle(0); err != nil {
+		t.Fatal(err)
+	}
+	if *cpu.traps != (trapUnit{}) || *timer != *NewTimer(0) {
+		t.Errorf("expected the trap controller and timer to be cleared but got %+v, %+v", *cpu.traps, *timer)
+	}
+	if cpu.Execute(); cpu.Reg(9) != handled || timer.fired != fired {
+		t.Errorf("expected %d interrupts again but got %d handled and %d requested", handled, cpu.Reg(9), timer.fired)
+	}
+
+	// masked interrupts stay pending
+	cpu.Reset()
+	if err := cpu.Interrupt(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := cpu.Interrupt(NumIRQ); err == nil {
+		t.Error("expected an invalid line to be rejected")
+	}
+	if cpu.interrupt() || cpu.traps.pending != 1<<3 {
+		t.Errorf("expected line 3 to be pending but got %#x", cpu.traps.pending)
+	}
+}
@@ -7,35 +7,47 @@ package model
 
 // Table of lexemes and their respective token types.
 var lexemeTable = map[string]TokenType{
-	"halt":   instruction,
-	"nop":    instruction,
-	"rrmovq": instruction,
-	"irmovq": instruction,
-	"rmmovq": instruction,
-	"mrmovq": instruction,
-	"addq":   instruction,
-	"subq":   instruction,
-	"andq":   instruction,
-	"xorq":   instruction,
-	"mulq":   instruction,
-	"divq":   instruction,
-	"modq":   instruction,
-	"jmp":    instruction,
-	"jle":    instruction,
-	"jl":     instruction,
-	"je":     instruction,
-	"jne":    instruction,
-	"jge":    instruction,
-	"jg":     instruction,
-	"call":   instruction,
-	"ret":    instruction,
-	"pushq":  instruction,
-	"popq":   instruction,
-	".pos":   dir,
-	".quad":  dir,
+	"halt":    instruction,
+	"nop":     instruction,
+	"rrmovq":  instruction,
+	"cmovle":  instruction,
+	"cmovl":   instruction,
+	"cmove":   instruction,
+	"cmovne":  instruction,
+	"cmovge":  instruction,
+	"cmovg":   instruction,
+	"irmovq":  instruction,
+	"rmmovq":  instruction,
+	"mrmovq":  instruction,
+	"addq":    instruction,
+	"subq":    instruction,
+	"andq":    instruction,
+	"xorq":    instruction,
+	"mulq":    instruction,
+	"divq":    instruction,
+	"modq":    instruction,
+	"jmp":     instruction,
+	"jle":     instruction,
+	"jl":      instruction,
+	"je":      instruction,
+	"jne":     instruction,
+	"jge":     instruction,
+	"jg":      instruction,
+	"call":    instruction,
+	"ret":     instruction,
+	"pushq":   instruction,
+	"popq":    instruction,
+	"iret":    instruction,
+	"syscall": instruction,
+	".pos":    dir,
+	".quad":   dir,
+	".align":  dir,
+	".global": dir,
+	".extern": dir,
 }
 
-// Table of register strings and their numberical values.
+// Table of register strings and their numberical values. Like in yis there's no %r15, since
+// register 0xf means no register.
 var registerTable = map[string]byte{
 	"%rax": 0,
 	"%rcx": 1,
@@ -52,35 +64,42 @@ var registerTable = map[string]byte{
 	"%r12": 12,
 	"%r13": 13,
 	"%r14": 14,
-	"%r15": 15,
 }
 
 // Maps instruction strings to their unique identifiers. This includes the opcode, fcode, and size.
 var instructionTable = map[string][]byte{
-	"halt":   {0, 0, 1},
-	"nop":    {1, 0, 1},
-	"rrmovq": {2, 0, 2},
-	"irmovq": {3, 0, 10},
-	"rmmovq": {4, 0, 10},
-	"mrmovq": {5, 0, 10},
-	"addq":   {6, 0, 2},
-	"subq":   {6, 1, 2},
-	"andq":   {6, 2, 2},
-	"xorq":   {6, 3, 2},
-	"mulq":   {6, 4, 2},
-	"divq":   {6, 4, 2},
-	"modq":   {6, 5, 2},
-	"jmp":    {7, 0, 9},
-	"jle":    {7, 1, 9},
-	"jl":     {7, 2, 9},
-	"je":     {7, 3, 9},
-	"jne":    {7, 4, 9},
-	"jge":    {7, 5, 9},
-	"jg":     {7, 6, 9},
-	"call":   {8, 0, 9},
-	"ret":    {9, 0, 1},
-	"pushq":  {10, 0, 2},
-	"popq":   {11, 0, 2},
+	"halt":    {0, 0, 1},
+	"nop":     {1, 0, 1},
+	"rrmovq":  {2, 0, 2},
+	"cmovle":  {2, 1, 2},
+	"cmovl":   {2, 2, 2},
+	"cmove":   {2, 3, 2},
+	"cmovne":  {2, 4, 2},
+	"cmovge":  {2, 5, 2},
+	"cmovg":   {2, 6, 2},
+	"irmovq":  {3, 0, 10},
+	"rmmovq":  {4, 0, 10},
+	"mrmovq":  {5, 0, 10},
+	"addq":    {6, 0, 2},
+	"subq":    {6, 1, 2},
+	"andq":    {6, 2, 2},
+	"xorq":    {6, 3, 2},
+	"mulq":    {6, 4, 2},
+	"divq":    {6, 5, 2},
+	"modq":    {6, 6, 2},
+	"jmp":     {7, 0, 9},
+	"jle":     {7, 1, 9},
+	"jl":      {7, 2, 9},
+	"je":      {7, 3, 9},
+	"jne":     {7, 4, 9},
+	"jge":     {7, 5, 9},
+	"jg":      {7, 6, 9},
+	"call":    {8, 0, 9},
+	"ret":     {9, 0, 1},
+	"pushq":   {10, 0, 2},
+	"popq":    {11, 0, 2},
+	"iret":    {14, 0, 1},
+	"syscall": {14, 1, 1},
 }
 
 // Returns true if all the tokens are eof and false otherwise.
@@ -0,0 +1,150 @@
+package model
+
+import (
+	"fmt"
+)
+
+// What a watchpoint watches.
+type WatchKind byte
+
+const (
+	WatchRead   WatchKind = 1 << iota // memory reads
+	WatchWrite                        // memory writes
+	WatchReg                          // changes to a register
+	WatchAccess = WatchRead | WatchWrite
+)
+
+// A watchpoint stops execution with status WCH when an instruction accesses a range of
+// memory or changes a register.
+type Watchpoint struct {
+	ID    int       // set by AddWatch
+	Kind  WatchKind // memory reads and/or writes, or a register
+	Addr  int       // first address of a memory watchpoint
+	Size  int       // number of bytes of a memory watchpoint
+	Reg   byte      // register of a register watchpoint
+	Cond  bool      // only stop when the new value is equal to Value
+	Value int64     // value compared against when Cond is set
+}
+
+// Describes a watchpoint that was hit.
+type WatchHit struct {
+	Watch Watchpoint // the watchpoint that was hit
+	PC    int        // address of the instruction that hit it
+	Addr  int        // address of the quad that was accessed, unused for registers
+	Write bool       // false if memory was read
+	Old   int64      // value before the instruction
+	New   int64      // value after the instruction, equal to Old for reads
+}
+
+func (hit WatchHit) String() string {
+	var target, access string
+	switch {
+	case hit.Watch.Kind == WatchReg:
+		target, access = RegisterName(hit.Watch.Reg), "changed"
+	case hit.Write:
+		target, access = fmt.Sprintf("%#x", hit.Addr), "written"
+	default:
+		target, access = fmt.Sprintf("%#x", hit.Addr), "read"
+	}
+	return fmt.Sprintf("watchpoint %d: %s %s by instruction at %#x: %#x -> %#x",
+		hit.Watch.ID, target, access, hit.PC, uint64(hit.Old), uint64(hit.New))
+}
+
+// Implemented by processors that support watchpoints.
+type Watcher interface {
+	AddWatch(w Watchpoint) (int, error)
+	RemoveWatch(id int) bool
+	Watches() []Watchpoint
+	WatchHits() []WatchHit
+	Resume()
+}
+
+// Add a watchpoint and return its ID. Returns an error if the watchpoint is invalid.
+func (cpu *CPU) AddWatch(w Watchpoint) (int, error) {
+	switch w.Kind {
+	case WatchRead, WatchWrite, WatchAccess:
+		if w.Size <= 0 || !cpu.mem.valid(w.Addr, w.Size) {
+			return 0, fmt.Errorf("error: invalid address range %#x-%#x", w.Addr, w.Addr+w.Size)
+		}
+	case WatchReg:
+		if w.Reg >= numReg {
+			return 0, fmt.Errorf("error: invalid register %d", w.Reg)
+		}
+	default:
+		return 0, fmt.Errorf("error: invalid watchpoint kind %d", w.Kind)
+	}
+
+	cpu.watch.next++
+	w.ID = cpu.watch.next
+	cpu.watch.points = append(cpu.watch.points, w)
+	return w.ID, nil
+}
+
+// Remove a watchpoint. Returns false if there's no watchpoint with the ID.
+func (cpu *CPU) RemoveWatch(id int) bool {
+	for i, w := range cpu.watch.points {
+		if w.ID == id {
+			cpu.watch.points = append(cpu.watch.points[:i], cpu.watch.points[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Return the watchpoints in the order they were added.
+func (cpu *CPU) Watches() []Watchpoint {
+	return append([]Watchpoint(nil), cpu.watch.points...)
+}
+
+// Return the watchpoints hit by the last instruction if the status is WCH, or by the
+// instruction undone by StepBack.
+func (cpu *CPU) WatchHits() []WatchHit {
+	return append([]WatchHit(nil), cpu.watch.hits...)
+}
+
+// Clear the WCH status so that execution can continue after a watchpoint was hit.
+func (cpu *CPU) Resume() {
+	if cpu.state.status == wch {
+		cpu.state.status = aok
+	}
+	cpu.watch.hits = nil
+}
+
+// Watchpoints of a CPU.
+type watchState struct {
+	points []Watchpoint // active watchpoints
+	hits   []WatchHit   // watchpoints hit by the current instruction
+	next   int          // ID of the last watchpoint added
+}
+
+// Record the memory watchpoints that overlap an 8-byte access.
+func (cpu *CPU) checkMemWatch(addr int, write bool, old int64, new int64) {
+	kind := WatchRead
+	if write {
+		kind = WatchWrite
+	}
+
+	for _, w := range cpu.watch.points {
+		if w.Kind&kind == 0 || addr+8 <= w.Addr || addr >= w.Addr+w.Size {
+			continue
+		}
+		if w.Cond && new != w.Value {
+			continue
+		}
+		cpu.watch.hits = append(cpu.watch.hits, WatchHit{w, cpu.state.pc, addr, write, old, new})
+	}
+}
+
+// Record the register watchpoints of a register that changes value.
+func (cpu *CPU) checkRegWatch(index byte, old int64, new int64) {
+	if old == new {
+		return
+	}
+
+	for _, w := range cpu.watch.points {
+		if w.Kind != WatchReg || w.Reg != index || (w.Cond && new != w.Value) {
+			continue
+		}
+		cpu.watch.hits = append(cpu.watch.hits, WatchHit{w, cpu.state.pc, 0, true, old, new})
+	}
+}
@@ -0,0 +1,260 @@
+package object
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+ * Layout of an object file. All integers are little endian and every string is stored
+ * as a uint32 length followed by its bytes.
+ *
+ *     header      magic [4]byte, version uint16, flags uint16, entry uint64
+ *     counts      sections, symbols, relocations, lines uint32
+ *     sections    name string, kind uint8, addr uint64, size uint32, data [size]byte
+ *     symbols     name string, section int32, value uint64, global uint8
+ *     relocations section uint32, offset uint64, symbol uint32, kind uint8, addend int64
+ *     debug       source string, then addr uint64, line uint32 for each line entry
+ *
+ * The debug block is only present if the hasDebug flag is set.
+ */
+
+const hasDebug uint16 = 1 << 0 // the file contains a source name and a line table
+
+const maxString = 1 << 16 // longest string accepted by Decode
+const maxCount = 1 << 24  // largest table or section accepted by Decode
+
+var ErrBadMagic = errors.New("object: not a y86 object file")
+
+// Write an object file. The line table is only written if the file has a source name or lines.
+func Encode(w io.Writer, f *File) error {
+	bw := bufio.NewWriter(w)
+	e := encoder{w: bw}
+
+	var flags uint16
+	if f.Source != "" || len(f.Lines) > 0 {
+		flags |= hasDebug
+	}
+
+	e.bytes([]byte(Magic))
+	e.put(Version)
+	e.put(flags)
+	e.put(f.Entry)
+	e.put(uint32(len(f.Sections)))
+	e.put(uint32(len(f.Symbols)))
+	e.put(uint32(len(f.Relocations)))
+	e.put(uint32(len(f.Lines)))
+
+	for _, s := range f.Sections {
+		e.str(s.Name)
+		e.put(uint8(s.Kind))
+		e.put(s.Addr)
+		e.put(uint32(len(s.Data)))
+		e.bytes(s.Data)
+	}
+
+	for _, s := range f.Symbols {
+		e.str(s.Name)
+		e.put(s.Section)
+		e.put(s.Value)
+		e.put(boolToByte(s.Global))
+	}
+
+	for _, r := range f.Relocations {
+		e.put(r.Section)
+		e.put(r.Offset)
+		e.put(r.Symbol)
+		e.put(uint8(r.Kind))
+		e.put(r.Addend)
+	}
+
+	if flags&hasDebug != 0 {
+		e.str(f.Source)
+		for _, l := range f.Lines {
+			e.put(l.Addr)
+			e.put(l.Line)
+		}
+	}
+
+	if e.err != nil {
+		return e.err
+	}
+	return bw.Flush()
+}
+
+// Read an object file. Returns ErrBadMagic if the data isn't an object file and an error
+// if the version is newer than the one supported or the file is malformed.
+func Decode(r io.Reader) (*File, error) {
+	d := decoder{r: bufio.NewReader(r)}
+	f := &File{}
+
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(d.r, magic); err != nil || string(magic) != Magic {
+		return nil, ErrBadMagic
+	}
+
+	var version, flags uint16
+	var numSections, numSymbols, numRelocations, numLines uint32
+	d.get(&version)
+	if d.err == nil && version > Version {
+		return nil, fmt.Errorf("object: unsupported version %d", version)
+	}
+	d.get(&flags)
+	d.get(&f.Entry)
+	d.get(&numSections)
+	d.get(&numSymbols)
+	d.get(&numRelocations)
+	d.get(&numLines)
+
+	for i := uint32(0); i < d.count(numSections); i++ {
+		var s Section
+		var kind uint8
+		var size uint32
+		s.Name = d.str()
+		d.get(&kind)
+		d.get(&s.Addr)
+		d.get(&size)
+		s.Kind = SectionKind(kind)
+		s.Data = d.bytes(d.count(size))
+		f.Sections = append(f.Sections, s)
+	}
+
+	for i := uint32(0); i < d.count(numSymbols); i++ {
+		var s Symbol
+		var global uint8
+		s.Name = d.str()
+		d.get(&s.Section)
+		d.get(&s.Value)
+		d.get(&global)
+		s.Global = global != 0
+		f.Symbols = append(f.Symbols, s)
+	}
+
+	for i := uint32(0); i < d.count(numRelocations); i++ {
+		var r Relocation
+		var kind uint8
+		d.get(&r.Section)
+		d.get(&r.Offset)
+		d.get(&r.Symbol)
+		d.get(&kind)
+		d.get(&r.Addend)
+		r.Kind = RelocationKind(kind)
+		f.Relocations = append(f.Relocations, r)
+	}
+
+	if flags&hasDebug != 0 {
+		f.Source = d.str()
+		for i := uint32(0); i < d.count(numLines); i++ {
+			var l LineEntry
+			d.get(&l.Addr)
+			d.get(&l.Line)
+			f.Lines = append(f.Lines, l)
+		}
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("object: %v", d.err)
+	}
+	if err := f.validate(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Check that the indexes stored in the relocations and symbols are in range.
+func (f *File) validate() error {
+	for i, s := range f.Symbols {
+		if s.Section != Undefined && s.Section != Absolute && (s.Section < 0 || int(s.Section) >= len(f.Sections)) {
+			return fmt.Errorf("object: symbol %d refers to section %d", i, s.Section)
+		}
+	}
+	for i, r := range f.Relocations {
+		if int(r.Section) >= len(f.Sections) {
+			return fmt.Errorf("object: relocation %d refers to section %d", i, r.Section)
+		}
+		if int(r.Symbol) >= len(f.Symbols) {
+			return fmt.Errorf("object: relocation %d refers to symbol %d", i, r.Symbol)
+		}
+		// written so that an offset close to 2^64 can't overflow
+		if data := f.Sections[r.Section].Data; len(data) < 8 || r.Offset > uint64(len(data))-8 {
+			return fmt.Errorf("object: relocation %d is outside of its section", i)
+		}
+	}
+	return nil
+}
+
+// Writes little endian values and remembers the first error.
+type encoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *encoder) put(val interface{}) {
+	if e.err == nil {
+		e.err = binary.Write(e.w, binary.LittleEndian, val)
+	}
+}
+
+func (e *encoder) bytes(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+func (e *encoder) str(s string) {
+	e.put(uint32(len(s)))
+	e.bytes([]byte(s))
+}
+
+// Reads little endian values and remembers the first error.
+type decoder struct {
+	r   io.Reader
+	err error
+}
+
+func (d *decoder) get(val interface{}) {
+	if d.err == nil {
+		d.err = binary.Read(d.r, binary.LittleEndian, val)
+	}
+}
+
+func (d *decoder) bytes(n uint32) []byte {
+	if d.err != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	_, d.err = io.ReadFull(d.r, b)
+	return b
+}
+
+func (d *decoder) str() string {
+	var n uint32
+	d.get(&n)
+	if d.err == nil && n > maxString {
+		d.err = fmt.Errorf("string of length %d is too long", n)
+	}
+	return string(d.bytes(n))
+}
+
+// Return the number of items to read. Returns 0 after an error or if the count is too large
+// so that corrupt files can't make the decoder allocate unbounded memory.
+func (d *decoder) count(n uint32) uint32 {
+	if d.err != nil {
+		return 0
+	}
+	if n > maxCount {
+		d.err = fmt.Errorf("count %d is too large", n)
+		return 0
+	}
+	return n
+}
+
+func boolToByte(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,135 @@
+// Package object defines the on-disk format of assembled y86 programs. An object file holds
+// the code and data sections of a program along with the base address of each section, a
+// symbol table, the relocation entries that refer to the symbols and an optional table that
+// maps addresses back to lines of source code.
+package object
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The first bytes of every object file.
+const Magic = "Y86O"
+
+// The version of the format written by Encode. Decode rejects files with a newer version.
+const Version uint16 = 1
+
+// Section indexes with a special meaning.
+const (
+	Undefined int32 = -1 // the symbol is defined in another object file
+	Absolute  int32 = -2 // the symbol is an address outside of every section
+)
+
+// The kind of content stored in a section.
+type SectionKind uint8
+
+const (
+	Code SectionKind = iota // machine instructions
+	Data                    // data declared with .quad
+)
+
+func (k SectionKind) String() string {
+	switch k {
+	case Code:
+		return "code"
+	case Data:
+		return "data"
+	default:
+		return fmt.Sprintf("kind(%d)", uint8(k))
+	}
+}
+
+// The kind of value patched by a relocation.
+type RelocationKind uint8
+
+const (
+	Abs64 RelocationKind = iota // little endian 8-byte absolute address
+)
+
+// A contiguous block of code or data that is loaded at a base address.
+type Section struct {
+	Name string      // .text or .data
+	Kind SectionKind // code or data
+	Addr uint64      // base address
+	Data []byte      // contents
+}
+
+// Returns true if the address is inside the section.
+func (s *Section) Contains(addr uint64) bool {
+	return addr >= s.Addr && addr < s.Addr+uint64(len(s.Data))
+}
+
+// A label and the address it refers to.
+type Symbol struct {
+	Name    string // label
+	Section int32  // index of the section that defines the symbol, Undefined or Absolute
+	Value   uint64 // the address of the label
+	Global  bool   // visible to other object files
+}
+
+// Returns true if the symbol is defined in this object file.
+func (s *Symbol) Defined() bool {
+	return s.Section != Undefined
+}
+
+// A place in a section that holds the address of a symbol.
+type Relocation struct {
+	Section uint32         // index of the section that holds the address
+	Offset  uint64         // offset of the address from the start of the section
+	Symbol  uint32         // index of the symbol in the symbol table
+	Kind    RelocationKind // how the address is stored
+	Addend  int64          // constant added to the address of the symbol
+}
+
+// Maps the address of an instruction or data item to the line of source code it came from.
+type LineEntry struct {
+	Addr uint64 // address of the first byte
+	Line uint32 // line in the source file
+}
+
+// An assembled program or a unit of one.
+type File struct {
+	Entry       uint64       // address of the first instruction
+	Sections    []Section    // code and data
+	Symbols     []Symbol     // symbol table
+	Relocations []Relocation // addresses of symbols stored in the sections
+	Source      string       // name of the source file, part of the debug information
+	Lines       []LineEntry  // line table sorted by address, part of the debug information
+}
+
+// Return the index of a symbol in the symbol table or -1 if there's no symbol with that name.
+func (f *File) Lookup(name string) int {
+	for i := range f.Symbols {
+		if f.Symbols[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Return the index of the section that contains an address or -1 if no section does. An
+// address right after the last byte of a section belongs to it if no other section contains
+// the address, so that labels at the end of a section move with it.
+func (f *File) SectionAt(addr uint64) int {
+	end := -1
+	for i := range f.Sections {
+		s := &f.Sections[i]
+		if s.Contains(addr) {
+			return i
+		} else if addr == s.Addr+uint64(len(s.Data)) {
+			end = i
+		}
+	}
+	return end
+}
+
+// Return the source line of an address using the line table. Returns false if the
+// file has no debug information for the address.
+func (f *File) LineAt(addr uint64) (uint32, bool) {
+	i := sort.Search(len(f.Lines), func(i int) bool { return f.Lines[i].Addr > addr }) - 1
+	if i < 0 {
+		return 0, false
+	}
+	return f.Lines[i].Line, true
+}
@@ -0,0 +1,104 @@
+package object
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var testFile = &File{
+	Entry: 0x100,
+	Sections: []Section{
+		{Name: ".text", Kind: Code, Addr: 0x100, Data: []byte{0x30, 0xf0, 0x00, 0x10, 0, 0, 0, 0, 0, 0, 0x00}},
+		{Name: ".data", Kind: Data, Addr: 0x1000, Data: []byte{1, 0, 0, 0, 0, 0, 0, 0}},
+	},
+	Symbols: []Symbol{
+		{Name: "main", Section: 0, Value: 0x100, Global: true},
+		{Name: "a", Section: 1, Value: 0x1000},
+		{Name: "stack", Section: Absolute, Value: 0x2000},
+		{Name: "print", Section: Undefined},
+	},
+	Relocations: []Relocation{
+		{Section: 0, Offset: 2, Symbol: 1, Kind: Abs64},
+	},
+	Source: "test.ys",
+	Lines: []LineEntry{
+		{Addr: 0x100, Line: 2},
+		{Addr: 0x10a, Line: 3},
+		{Addr: 0x1000, Line: 6},
+	},
+}
+
+func TestEncodeDecode(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, testFile); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f, testFile) {
+		t.Errorf("expected %+v but got %+v\n", testFile, f)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var buf bytes.Buffer
+	Encode(&buf, testFile)
+	valid := buf.Bytes()
+
+	newer := append([]byte{}, valid...)
+	newer[len(Magic)] = byte(Version + 1)
+
+	badReloc := &File{Sections: testFile.Sections, Relocations: []Relocation{{Section: 0, Symbol: 3}}}
+	var relocBuf bytes.Buffer
+	Encode(&relocBuf, badReloc)
+
+	hugeOffset := &File{Sections: testFile.Sections, Symbols: testFile.Symbols,
+		Relocations: []Relocation{{Section: 0, Offset: 1<<64 - 4, Symbol: 1, Kind: Abs64}}}
+	var offsetBuf bytes.Buffer
+	Encode(&offsetBuf, hugeOffset)
+
+	testcases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad magic", []byte("Y86Xabcdefgh")},
+		{"newer version", newer},
+		{"truncated", valid[:len(valid)-5]},
+		{"relocation out of range", relocBuf.Bytes()},
+		{"relocation offset overflows", offsetBuf.Bytes()},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Decode(bytes.NewReader(tc.data)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestLineAt(t *testing.T) {
+	testcases := []struct {
+		addr uint64
+		line uint32
+		ok   bool
+	}{
+		{0xff, 0, false},
+		{0x100, 2, true},
+		{0x105, 2, true},
+		{0x10a, 3, true},
+		{0x1000, 6, true},
+	}
+
+	for _, tc := range testcases {
+		line, ok := testFile.LineAt(tc.addr)
+		if line != tc.line || ok != tc.ok {
+			t.Errorf("%#x: expected %d, %t but got %d, %t\n", tc.addr, tc.line, tc.ok, line, ok)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Package snapshot defines the on-disk format of a snapshot of the y86 CPU. A snapshot holds
+// the full machine state: memory, registers, program counter, condition codes, status,
+// counters and the heap of the syscall instruction, so that a run can be checkpointed, shared
+// and resumed later.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+ * Layout of a snapshot file. All integers are little endian.
+ *
+ *     header   magic [4]byte, version uint16, flags uint16
+ *     state    pc uint64, status uint8, cc uint8, cycles uint64, instructions uint64,
+ *              brk uint64 (since version 2)
+ *     regs     [16]int64
+ *     memory   size uint32, pages uint32, then addr uint32, data [PageSize]byte for each page
+ *
+ * Only pages that contain a byte other than 0 are stored. The cc byte holds ZF in bit 0, SF
+ * in bit 1 and OF in bit 2. No flags are defined yet.
+ */
+
+// The first bytes of every snapshot file.
+const Magic = "Y86S"
+
+// The version of the format written by Encode. Decode rejects files with a newer version.
+const Version uint16 = 2
+
+// Size of the blocks of memory stored in a snapshot file.
+const PageSize = 256
+
+// Largest memory in bytes that Encode and Decode accept.
+const MaxMem = 1 << 24
+
+// Bits of the cc byte.
+const (
+	flagZF uint8 = 1 << iota
+	flagSF
+	flagOF
+)
+
+var ErrBadMagic = errors.New("snapshot: not a y86 snapshot file")
+
+// The state of a CPU.
+type State struct {
+	PC           uint64    // program counter
+	Status       uint8     // status code
+	ZF, SF, OF   bool      // condition codes
+	Cycles       uint64    // number of cycles executed
+	Instructions uint64    // number of instructions executed
+	Brk          uint64    // first address of free heap memory, 0 in version 1 files
+	Regs         [16]int64 // register file
+	Mem          []byte    // contents of the whole memory
+}
+
+// Write a snapshot file.
+func Encode(w io.Writer, s *State) error {
+	if len(s.Mem) > MaxMem {
+		return fmt.Errorf("snapshot: memory of %d bytes is too large", len(s.Mem))
+	}
+
+	var pages []uint32
+	zero := make([]byte, PageSize)
+	for addr := 0; addr < len(s.Mem); addr += PageSize {
+		if p := page(s.Mem, addr); !bytes.Equal(p, zero[:len(p)]) {
+			pages = append(pages, uint32(addr))
+		}
+	}
+
+	var cc uint8
+	if s.ZF {
+		cc |= flagZF
+	}
+	if s.SF {
+		cc |= flagSF
+	}
+	if s.OF {
+		cc |= flagOF
+	}
+
+	bw := bufio.NewWriter(w)
+	e := encoder{w: bw}
+	e.bytes([]byte(Magic))
+	e.put(Version)
+	e.put(uint16(0))
+	e.put(s.PC)
+	e.put(s.Status)
+	e.put(cc)
+	e.put(s.Cycles)
+	e.put(s.Instructions)
+	e.put(s.Brk)
+	e.put(s.Regs)
+	e.put(uint32(len(s.Mem)))
+	e.put(uint32(len(pages)))
+	for _, addr := range pages {
+		p := page(s.Mem, int(addr))
+		e.put(addr)
+		e.bytes(p)
+		// the last page is padded if the memory size isn't a multiple of the page size
+		e.bytes(zero[len(p):])
+	}
+
+	if e.err != nil {
+		return e.err
+	}
+	return bw.Flush()
+}
+
+// Read a snapshot file. Returns ErrBadMagic if the data isn't a snapshot and an error if the
+// version is newer than the one supported or the file is malformed.
+func Decode(r io.Reader) (*State, error) {
+	d := decoder{r: bufio.NewReader(r)}
+	s := &State{}
+
+	magic := make([]byte, len(Magic))
+	if _, err := io.ReadFull(d.r, magic); err != nil || string(magic) != Magic {
+		return nil, ErrBadMagic
+	}
+
+	var version, flags uint16
+	var cc uint8
+	var size, numPages uint32
+	d.get(&version)
+	if d.err == nil && version > Version {
+		return nil, fmt.Errorf("snapshot: unsupported version %d", version)
+	}
+	d.get(&flags)
+	d.get(&s.PC)
+	d.get(&s.Status)
+	d.get(&cc)
+	d.get(&s.Cycles)
+	d.get(&s.Instructions)
+	if version >= 2 {
+		d.get(&s.Brk)
+	}
+	d.get(&s.Regs)
+	d.get(&size)
+	d.get(&numPages)
+	s.ZF, s.SF, s.OF = cc&flagZF != 0, cc&flagSF != 0, cc&flagOF != 0
+
+	if d.err == nil && size > MaxMem {
+		return nil, fmt.Errorf("snapshot: memory of %d bytes is too large", size)
+	}
+	s.Mem = make([]byte, size)
+	data := make([]byte, PageSize)
+	for i := uint32(0); d.err == nil && i < numPages; i++ {
+		var addr uint32
+		d.get(&addr)
+		d.get(data)
+		if d.err == nil && (addr%PageSize != 0 || addr >= size) {
+			return nil, fmt.Errorf("snapshot: page at %#x is outside of memory", addr)
+		}
+		copy(s.Mem[addr:], data)
+	}
+
+	if d.err != nil {
+		return nil, fmt.Errorf("snapshot: %v", d.err)
+	}
+	return s, nil
+}
+
+// Return the page of memory at an address, which is shorter than PageSize at the end of memory.
+func page(mem []byte, addr int) []byte {
+	end := addr + PageSize
+	if end > len(mem) {
+		end = len(mem)
+	}
+	return mem[addr:end]
+}
+
+// Writes little endian values and remembers the first error.
+type encoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *encoder) put(val interface{}) {
+	if e.err == nil {
+		e.err = binary.Write(e.w, binary.LittleEndian, val)
+	}
+}
+
+func (e *encoder) bytes(b []byte) {
+	if e.err == nil {
+		_, e.err = e.w.Write(b)
+	}
+}
+
+// Reads little endian values and remembers the first error.
+type decoder struct {
+	r   io.Reader
+	err error
+}
+
+func (d *decoder) get(val interface{}) {
+	if d.err == nil {
+		d.err = binary.Read(d.r, binary.LittleEndian, val)
+	}
+}
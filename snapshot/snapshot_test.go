@@ -0,0 +1,80 @@
+package snapshot
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// Size of everything before the first page: header, state, registers and memory counts.
+const headerSize = 8 + 34 + 128 + 8
+
+// Return a state with a few pages of memory in use, including the last, partial page.
+func testState() *State {
+	s := &State{PC: 0x13, Status: 1, ZF: true, OF: true, Cycles: 42, Instructions: 41, Brk: 0x208,
+		Mem: make([]byte, 0xffff)}
+	s.Regs[0], s.Regs[4], s.Regs[14] = 7, 0x200, -1
+	s.Mem[0], s.Mem[0x1ff], s.Mem[0x1000] = 0x30, 0x12, 0x34
+	s.Mem[len(s.Mem)-1] = 0xff
+	return s
+}
+
+func TestEncodeDecode(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Encode(&buf, testState()); err != nil {
+		t.Fatal(err)
+	}
+	if size := headerSize + 4*(4+PageSize); buf.Len() != size {
+		t.Errorf("expected only the 4 pages in use to be written in %d bytes but got %d", size, buf.Len())
+	}
+
+	s, err := Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s, testState()) {
+		t.Error("decoded snapshot differs from the one encoded")
+	}
+
+	// version 1 files have no brk
+	Encode(&buf, testState())
+	old := append(buf.Bytes()[:34:34], buf.Bytes()[42:]...)
+	old[len(Magic)] = 1
+	want := testState()
+	want.Brk = 0
+	if s, err := Decode(bytes.NewReader(old)); err != nil || !reflect.DeepEqual(s, want) {
+		t.Errorf("expected a version 1 snapshot to be decoded, got %v", err)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	var buf bytes.Buffer
+	Encode(&buf, testState())
+	valid := buf.Bytes()
+
+	newer := append([]byte{}, valid...)
+	newer[len(Magic)] = byte(Version + 1)
+
+	badPage := append([]byte{}, valid...)
+	binary.LittleEndian.PutUint32(badPage[headerSize:], 0x10000)
+
+	testcases := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"bad magic", []byte("Y86Xabcdefgh")},
+		{"newer version", newer},
+		{"truncated", valid[:len(valid)-5]},
+		{"page out of range", badPage},
+	}
+
+	for _, tc := range testcases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := Decode(bytes.NewReader(tc.data)); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
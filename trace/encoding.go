@@ -0,0 +1,235 @@
+package trace
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+ * Layout of a binary trace. Integers are varints as written by encoding/binary; signed
+ * values use the zig-zag encoding of PutVarint.
+ *
+ *     header   magic [4]byte, version uint8
+ *     record   cycle uvarint, pc varint, inst uvarint, [len uvarint, text [len]byte],
+ *              code uint8 (icode<<4 | ifun), regs uint8 (rA<<4 | rB),
+ *              valC, valA, valB, valE, valM varint, flags uint8, status uint8,
+ *              regs uvarint, then reg uint8, value varint for each register written,
+ *              mem uvarint, then addr varint, value varint for each quad written
+ *
+ * Instruction strings are numbered in the order they first appear. The inst field is the
+ * number of the string, and the text only follows the first time a string appears.
+ */
+
+// The first bytes of a binary trace.
+const Magic = "Y86T"
+
+// The version of the binary format written by Writer.
+const Version uint8 = 1
+
+const maxString = 1 << 16 // longest instruction string accepted by Reader
+const maxCount = 1 << 10  // most register or memory writes accepted in a record
+
+// Bits of the flags byte.
+const (
+	flagZF uint8 = 1 << iota
+	flagSF
+	flagOF
+)
+
+var errCorrupt = errors.New("trace: corrupt binary trace")
+
+func (w *Writer) writeHeader() {
+	w.started = true
+	w.w.WriteString(Magic)
+	w.err = w.w.WriteByte(Version)
+}
+
+func (w *Writer) writeBinary(rec *Record) {
+	if !w.started {
+		w.writeHeader()
+	}
+
+	w.uvarint(uint64(rec.Cycle))
+	w.varint(rec.PC)
+	if index, ok := w.strings[rec.Inst]; ok {
+		w.uvarint(index)
+	} else {
+		index = uint64(len(w.strings))
+		w.strings[rec.Inst] = index
+		w.uvarint(index)
+		w.uvarint(uint64(len(rec.Inst)))
+		w.w.WriteString(rec.Inst)
+	}
+
+	w.w.WriteByte(rec.Icode<<4 | rec.Ifun&0xf)
+	w.w.WriteByte(rec.RA<<4 | rec.RB&0xf)
+	for _, val := range []int64{rec.ValC, rec.ValA, rec.ValB, rec.ValE, rec.ValM} {
+		w.varint(val)
+	}
+
+	var flags uint8
+	if rec.ZF {
+		flags |= flagZF
+	}
+	if rec.SF {
+		flags |= flagSF
+	}
+	if rec.OF {
+		flags |= flagOF
+	}
+	w.w.WriteByte(flags)
+	w.w.WriteByte(rec.Status)
+
+	w.uvarint(uint64(len(rec.Regs)))
+	for _, reg := range rec.Regs {
+		w.w.WriteByte(reg.Reg)
+		w.varint(reg.Value)
+	}
+	w.uvarint(uint64(len(rec.Mem)))
+	for _, mem := range rec.Mem {
+		w.varint(mem.Addr)
+		w.varint(mem.Value)
+	}
+}
+
+func (w *Writer) uvarint(val uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	_, err := w.w.Write(buf[:binary.PutUvarint(buf[:], val)])
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *Writer) varint(val int64) {
+	var buf [binary.MaxVarintLen64]byte
+	_, err := w.w.Write(buf[:binary.PutVarint(buf[:], val)])
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (r *Reader) readHeader() error {
+	header := make([]byte, len(Magic)+1)
+	if _, err := io.ReadFull(r.r, header); err != nil {
+		return errCorrupt
+	}
+	if version := header[len(Magic)]; version > Version {
+		return fmt.Errorf("trace: unsupported version %d", version)
+	}
+	return nil
+}
+
+func (r *Reader) readBinary() (*Record, error) {
+	if _, err := r.r.Peek(1); err == io.EOF {
+		return nil, io.EOF
+	}
+
+	d := decoder{r: r}
+	rec := &Record{}
+	rec.Cycle = int64(d.uvarint())
+	rec.PC = d.varint()
+
+	index := d.uvarint()
+	switch {
+	case index < uint64(len(r.strings)):
+		rec.Inst = r.strings[index]
+	case index == uint64(len(r.strings)):
+		rec.Inst = d.str()
+		r.strings = append(r.strings, rec.Inst)
+	default:
+		d.fail()
+	}
+
+	code, regs := d.byte(), d.byte()
+	rec.Icode, rec.Ifun = code>>4, code&0xf
+	rec.RA, rec.RB = regs>>4, regs&0xf
+	for _, val := range []*int64{&rec.ValC, &rec.ValA, &rec.ValB, &rec.ValE, &rec.ValM} {
+		*val = d.varint()
+	}
+
+	flags := d.byte()
+	rec.ZF, rec.SF, rec.OF = flags&flagZF != 0, flags&flagSF != 0, flags&flagOF != 0
+	rec.Status = d.byte()
+
+	for n := d.count(); n > 0; n-- {
+		rec.Regs = append(rec.Regs, RegWrite{d.byte(), d.varint()})
+	}
+	for n := d.count(); n > 0; n-- {
+		rec.Mem = append(rec.Mem, MemWrite{d.varint(), d.varint()})
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	return rec, nil
+}
+
+// Reads the fields of a binary record and remembers the first error.
+type decoder struct {
+	r   *Reader
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errCorrupt
+	}
+}
+
+func (d *decoder) byte() uint8 {
+	if d.err != nil {
+		return 0
+	}
+	b, err := d.r.r.ReadByte()
+	if err != nil {
+		d.fail()
+	}
+	return b
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	val, err := binary.ReadUvarint(d.r.r)
+	if err != nil {
+		d.fail()
+	}
+	return val
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	val, err := binary.ReadVarint(d.r.r)
+	if err != nil {
+		d.fail()
+	}
+	return val
+}
+
+func (d *decoder) str() string {
+	n := d.uvarint()
+	if d.err != nil || n > maxString {
+		d.fail()
+		return ""
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(d.r.r, b); err != nil {
+		d.fail()
+	}
+	return string(b)
+}
+
+// Return the number of items to read. Returns 0 after an error or if the count is too large.
+func (d *decoder) count() uint64 {
+	n := d.uvarint()
+	if d.err != nil || n > maxCount {
+		d.fail()
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,180 @@
+// Package trace defines the execution trace of a y86 program. A trace has a record for every
+// instruction the CPU executes with the decoded instruction, the values computed by each
+// stage, the registers and memory written, the condition codes and the status. Traces are
+// written as JSON Lines, one record per line, or in a compact binary format, and read back
+// with a Reader that detects the format.
+package trace
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// The format of a trace.
+type Format uint8
+
+const (
+	JSON   Format = iota // JSON Lines
+	Binary               // compact binary format
+)
+
+func (f Format) String() string {
+	switch f {
+	case JSON:
+		return "json"
+	case Binary:
+		return "binary"
+	default:
+		return fmt.Sprintf("format(%d)", uint8(f))
+	}
+}
+
+// A register written by an instruction.
+type RegWrite struct {
+	Reg   uint8 `json:"reg"`
+	Value int64 `json:"value"`
+}
+
+// A quad written to memory by an instruction.
+type MemWrite struct {
+	Addr  int64 `json:"addr"`
+	Value int64 `json:"value"`
+}
+
+// The execution of a single instruction.
+type Record struct {
+	Cycle  int64      `json:"cycle"`          // number of the cycle, starting at 1
+	PC     int64      `json:"pc"`             // address of the instruction
+	Inst   string     `json:"inst"`           // assembly syntax, empty if the instruction couldn't be fetched
+	Icode  uint8      `json:"icode"`          // opcode
+	Ifun   uint8      `json:"ifun"`           // fcode
+	RA     uint8      `json:"rA"`             // register A
+	RB     uint8      `json:"rB"`             // register B
+	ValC   int64      `json:"valC"`           // constant
+	ValA   int64      `json:"valA"`           // value read from rA
+	ValB   int64      `json:"valB"`           // value read from rB
+	ValE   int64      `json:"valE"`           // ALU output
+	ValM   int64      `json:"valM"`           // value read from memory
+	Regs   []RegWrite `json:"regs,omitempty"` // registers written, in order
+	Mem    []MemWrite `json:"mem,omitempty"`  // memory written, in order
+	ZF     bool       `json:"zf"`             // condition codes after the instruction
+	SF     bool       `json:"sf"`
+	OF     bool       `json:"of"`
+	Status uint8      `json:"status"` // status after the instruction
+}
+
+// Writes a trace. Errors are remembered and returned by Flush, so that the CPU can record
+// instructions without handling errors.
+type Writer struct {
+	w       *bufio.Writer
+	format  Format
+	strings map[string]uint64 // index of each instruction string written to a binary trace
+	started bool              // true once the header of a binary trace is written
+	err     error             // first error
+}
+
+// Create a writer for a trace in a format.
+func NewWriter(w io.Writer, format Format) *Writer {
+	return &Writer{w: bufio.NewWriter(w), format: format, strings: make(map[string]uint64)}
+}
+
+// Write a record.
+func (w *Writer) Trace(rec *Record) {
+	if w.err != nil {
+		return
+	}
+
+	switch w.format {
+	case JSON:
+		var line []byte
+		if line, w.err = json.Marshal(rec); w.err == nil {
+			w.w.Write(line)
+			w.err = w.w.WriteByte('\n')
+		}
+	case Binary:
+		w.writeBinary(rec)
+	default:
+		w.err = fmt.Errorf("trace: unknown format %v", w.format)
+	}
+}
+
+// Write any buffered records and return the first error.
+func (w *Writer) Flush() error {
+	if w.err == nil && w.format == Binary && !w.started {
+		w.writeHeader()
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return w.w.Flush()
+}
+
+// Reads a trace in either format.
+type Reader struct {
+	r       *bufio.Reader
+	format  Format
+	strings []string // instruction strings read from a binary trace
+}
+
+// Create a reader for a trace. The format is detected from the first bytes.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len(Magic))
+	if err == nil && bytes.Equal(header, []byte(Magic)) {
+		reader := &Reader{r: br, format: Binary}
+		return reader, reader.readHeader()
+	}
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return &Reader{r: br, format: JSON}, nil
+}
+
+// Return the format of the trace.
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// Read the next record. Returns io.EOF at the end of the trace.
+func (r *Reader) Read() (*Record, error) {
+	if r.format == Binary {
+		return r.readBinary()
+	}
+
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			rec := &Record{}
+			if err := json.Unmarshal(line, rec); err != nil {
+				return nil, fmt.Errorf("trace: %v", err)
+			}
+			return rec, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Read every record of a trace.
+func ReadAll(r io.Reader) ([]Record, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []Record{}
+	for {
+		rec, err := reader.Read()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, *rec)
+	}
+}
@@ -0,0 +1,91 @@
+package trace
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testRecords = []Record{
+	{Cycle: 1, PC: 0, Inst: "irmovq $-1, %rax", Icode: 3, RA: 0xf, ValC: -1, Regs: []RegWrite{{0, -1}}},
+	{Cycle: 2, PC: 0xa, Inst: "pushq %rax", Icode: 0xa, RA: 0, RB: 0xf, ValA: -1, ValB: 0x200, ValE: 0x1f8,
+		Regs: []RegWrite{{4, 0x1f8}}, Mem: []MemWrite{{0x1f8, -1}}},
+	{Cycle: 3, PC: 0xc, Inst: "irmovq $-1, %rax", Icode: 3, RA: 0xf, ValC: -1, ZF: true, OF: true},
+	{Cycle: 4, PC: 0x16, Inst: "halt", Status: 1},
+	{Cycle: 5, PC: 0xffff, Status: 2},
+}
+
+func TestWriteRead(t *testing.T) {
+	for _, format := range []Format{JSON, Binary} {
+		var buf bytes.Buffer
+		w := NewWriter(&buf, format)
+		for i := range testRecords {
+			w.Trace(&testRecords[i])
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		reader, err := NewReader(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reader.Format() != format {
+			t.Errorf("expected the %v format to be detected but got %v", format, reader.Format())
+		}
+
+		records, err := ReadAll(&buf)
+		if err != nil {
+			t.Fatalf("%v: %v", format, err)
+		}
+		if !reflect.DeepEqual(records, testRecords) {
+			t.Errorf("%v: expected\n%+v\nbut got\n%+v", format, testRecords, records)
+		}
+	}
+}
+
+func TestJSONLines(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, JSON)
+	w.Trace(&testRecords[3])
+	w.Flush()
+
+	expected := `{"cycle":4,"pc":22,"inst":"halt","icode":0,"ifun":0,"rA":0,"rB":0,"valC":0,"valA":0,` +
+		`"valB":0,"valE":0,"valM":0,"zf":false,"sf":false,"of":false,"status":1}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("expected %s but got %s", expected, buf.String())
+	}
+}
+
+func TestBinaryIsCompact(t *testing.T) {
+	var jsonBuf, binaryBuf bytes.Buffer
+	jsonWriter, binaryWriter := NewWriter(&jsonBuf, JSON), NewWriter(&binaryBuf, Binary)
+	for i := range testRecords {
+		jsonWriter.Trace(&testRecords[i])
+		binaryWriter.Trace(&testRecords[i])
+	}
+	jsonWriter.Flush()
+	binaryWriter.Flush()
+
+	if binaryBuf.Len()*4 > jsonBuf.Len() {
+		t.Errorf("expected the binary trace to be much smaller than %d bytes but got %d", jsonBuf.Len(), binaryBuf.Len())
+	}
+}
+
+func TestReadCorrupt(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, Binary)
+	w.Trace(&testRecords[1])
+	w.Flush()
+
+	data := buf.Bytes()
+	for _, input := range []string{string(data[:len(data)-3]), Magic, Magic + "\x02", "{\"cycle\": true}\n"} {
+		if _, err := ReadAll(strings.NewReader(input)); err == nil {
+			t.Errorf("expected an error for %q", input)
+		}
+	}
+	if _, err := ReadAll(strings.NewReader(Magic + "\x01")); err != nil {
+		t.Errorf("expected an empty trace to be valid but got %v", err)
+	}
+}